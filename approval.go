@@ -0,0 +1,252 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fortanix/sdkms-client-go/sdkms"
+	"google.golang.org/grpc/codes"
+)
+
+const (
+	defaultApprovalTimeout = time.Hour
+	// maxPendingApprovals bounds the approval requests the plugin has open,
+	// so that reading many secrets does not flood the reviewers.
+	maxPendingApprovals = 64
+	// approvalNoticePeriod is how long Status mentions that DSM required
+	// approval.
+	approvalNoticePeriod = 10 * time.Minute
+)
+
+// approvalConfig makes the plugin create approval requests in DSM when
+// the key is under a quorum approval policy.
+type approvalConfig struct {
+	// Timeout is how long an approval request is waited for. After that it
+	// is withdrawn, and the next Decrypt of the same DEK creates a new one.
+	Timeout *duration `json:"timeout,omitempty"`
+}
+
+func (c approvalConfig) validate() error {
+	if c.Timeout != nil && *c.Timeout <= 0 {
+		return errors.New("`decrypt_approval.timeout` must be positive")
+	}
+	return nil
+}
+
+// approvalBackend is implemented by backends that can report on approvals
+// that operations are waiting for.
+type approvalBackend interface {
+	approvalStatus() string
+}
+
+// isApprovalRequired reports whether DSM rejected an operation because the
+// key is under a quorum approval policy.
+func isApprovalRequired(err error) bool {
+	var backendErr *sdkms.BackendError
+	if !errors.As(err, &backendErr) || backendErr.StatusCode < 400 || backendErr.StatusCode >= 500 {
+		return false
+	}
+	message := strings.ToLower(backendErr.Message)
+	return strings.Contains(message, "approval") || strings.Contains(message, "quorum")
+}
+
+// approvals tracks the approval requests the plugin created to decrypt.
+// Decrypt never waits for approval: the first attempt creates a request,
+// and the retries of the apiserver check it until it is approved, denied
+// or times out.
+type approvals struct {
+	create  bool // false unless `decrypt_approval` is configured
+	timeout time.Duration
+
+	mu       sync.Mutex
+	pending  map[[sha256.Size]byte]*pendingApproval
+	required time.Time // when DSM last required approval
+}
+
+type pendingApproval struct {
+	id      string // empty while the request is being created
+	kid     string
+	created time.Time
+	denied  error // set once the request was denied or failed
+}
+
+func newApprovals(config *approvalConfig) *approvals {
+	a := &approvals{timeout: defaultApprovalTimeout, pending: make(map[[sha256.Size]byte]*pendingApproval)}
+	if config != nil {
+		a.create = true
+		if config.Timeout != nil {
+			a.timeout = time.Duration(*config.Timeout)
+		}
+	}
+	return a
+}
+
+// decrypt handles a decrypt request that DSM rejected with cause because
+// it needs approval. The lock is only held to look up and update pending
+// requests, never across calls to DSM.
+func (a *approvals) decrypt(ctx context.Context, b *dsmBackend, request sdkms.DecryptRequest, cause error) (*sdkms.DecryptResponse, error) {
+	kid := *request.Key.Kid
+	a.mu.Lock()
+	a.required = time.Now()
+	a.mu.Unlock()
+	if !a.create {
+		return nil, newPluginError(codes.FailedPrecondition, reasonDsmApprovalRequired, nil,
+			"key %v requires quorum approval to decrypt, set `decrypt_approval` to request it: %v", kid, cause)
+	}
+	client := b.config.makeClient()
+	a.expire(ctx, b)
+
+	h := sha256.New()
+	h.Write([]byte(kid))
+	h.Write(*request.Iv)
+	h.Write(*request.Tag)
+	h.Write(request.Cipher)
+	var id [sha256.Size]byte
+	copy(id[:], h.Sum(nil))
+
+	a.mu.Lock()
+	p := a.pending[id]
+	if p == nil {
+		if len(a.pending) >= maxPendingApprovals {
+			a.mu.Unlock()
+			return nil, newPluginError(codes.FailedPrecondition, reasonDsmApprovalRequired, nil,
+				"key %v requires quorum approval to decrypt and %v approval requests are already pending", kid, maxPendingApprovals)
+		}
+		// Reserve the entry so that concurrent retries do not create a
+		// second request while this one is created.
+		p = &pendingApproval{kid: kid, created: time.Now()}
+		a.pending[id] = p
+		a.mu.Unlock()
+
+		hostname, _ := os.Hostname()
+		description := fmt.Sprintf("Decrypt a Kubernetes data encryption key on %v", hostname)
+		var created *sdkms.ApprovalRequest
+		err := b.config.withDsmContext(ctx, func(ctx context.Context) (err error) {
+			created, err = client.RequestApprovalToDecrypt(ctx, request, &description)
+			return err
+		})
+		a.mu.Lock()
+		defer a.mu.Unlock()
+		if err != nil {
+			delete(a.pending, id)
+			return nil, fmt.Errorf("failed to request approval to decrypt: %v", err)
+		}
+		log.Printf("Created approval request %v to decrypt with key %v", created.RequestID, kid)
+		p.id = created.RequestID
+		return nil, approvalPendingError(p.id, kid)
+	}
+	requestID, denied := p.id, p.denied
+	a.mu.Unlock()
+	if denied != nil {
+		return nil, denied
+	}
+	if requestID == "" {
+		return nil, newPluginError(codes.FailedPrecondition, reasonDsmApprovalPending, nil,
+			"waiting for an approval request to decrypt with key %v to be created", kid)
+	}
+
+	var current *sdkms.ApprovalRequest
+	err := b.config.withDsmContext(ctx, func(ctx context.Context) (err error) {
+		current, err = client.GetApprovalRequest(ctx, requestID)
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to check approval request %v: %v", requestID, err)
+	}
+	switch current.Status {
+	case sdkms.ApprovalStatusPending:
+		return nil, approvalPendingError(requestID, kid)
+	case sdkms.ApprovalStatusApproved:
+		var result *sdkms.ApprovableResult
+		err := b.config.withDsmContext(ctx, func(ctx context.Context) (err error) {
+			result, err = client.GetApprovalRequestResult(ctx, requestID)
+			return err
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to get result of approval request %v: %v", requestID, err)
+		}
+		a.remove(id, p)
+		var resp sdkms.DecryptResponse
+		if err := result.Parse(&resp); err != nil {
+			return nil, err
+		}
+		log.Printf("Decrypted with key %v after approval request %v was approved", kid, requestID)
+		return &resp, nil
+	default:
+		denied := newPluginError(codes.PermissionDenied, reasonDsmApprovalDenied,
+			map[string]string{metadataApprovalRequest: requestID},
+			"approval request %v to decrypt with key %v is %v", requestID, kid, current.Status)
+		log.Printf("Approval request %v to decrypt with key %v is %v", requestID, kid, current.Status)
+		a.mu.Lock()
+		p.denied = denied
+		a.mu.Unlock()
+		return nil, denied
+	}
+}
+
+// remove forgets the request for id if it is still p.
+func (a *approvals) remove(id [sha256.Size]byte, p *pendingApproval) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.pending[id] == p {
+		delete(a.pending, id)
+	}
+}
+
+// expire forgets the requests created more than the timeout ago, denied
+// ones included, and withdraws them in DSM.
+func (a *approvals) expire(ctx context.Context, b *dsmBackend) {
+	var expired []*pendingApproval
+	a.mu.Lock()
+	for id, p := range a.pending {
+		if time.Since(p.created) > a.timeout && p.id != "" {
+			expired = append(expired, p)
+			delete(a.pending, id)
+		}
+	}
+	a.mu.Unlock()
+	if len(expired) == 0 {
+		return
+	}
+	client := b.config.makeClient()
+	for _, p := range expired {
+		log.Printf("Approval request %v to decrypt with key %v timed out, withdrawing it", p.id, p.kid)
+		if err := b.config.withDsmContext(ctx, func(ctx context.Context) error {
+			return client.DeleteApprovalRequest(ctx, p.id)
+		}); err != nil {
+			log.Printf("Failed to withdraw approval request %v: %v", p.id, err)
+		}
+	}
+}
+
+func approvalPendingError(id, kid string) error {
+	return newPluginError(codes.FailedPrecondition, reasonDsmApprovalPending,
+		map[string]string{metadataApprovalRequest: id},
+		"waiting for approval request %v to decrypt with key %v", id, kid)
+}
+
+// status returns a note on approvals for the Status log line.
+func (a *approvals) status() string {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	waiting := 0
+	for _, p := range a.pending {
+		if p.denied == nil {
+			waiting++
+		}
+	}
+	switch {
+	case waiting > 0:
+		return fmt.Sprintf("%v approval requests to decrypt are pending in DSM", waiting)
+	case time.Since(a.required) < approvalNoticePeriod:
+		return "DSM requires quorum approval to decrypt"
+	}
+	return ""
+}
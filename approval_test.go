@@ -0,0 +1,124 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/fortanix/k8s-sdkms-plugin/dsmtest"
+	"github.com/fortanix/sdkms-client-go/sdkms"
+	"google.golang.org/grpc/codes"
+)
+
+// startApprovalTest starts the plugin with `decrypt_approval` and returns
+// ciphertext wrapped under a key that then comes under a quorum policy.
+func startApprovalTest(t *testing.T, timeout time.Duration) (*dsmtest.Server, KeyManagementServiceClient, *EncryptResponse) {
+	t.Helper()
+	dsm := dsmtest.NewServer(testAPIKey)
+	t.Cleanup(dsm.Close)
+	kid := dsm.AddKey("k8s")
+	client := startTestPlugin(t, dsm, func(config *pluginConfig) {
+		approval := duration(timeout)
+		config.DecryptApproval = &approvalConfig{Timeout: &approval}
+	})
+	encrypted, err := client.Encrypt(requestContext(t), &EncryptRequest{Plaintext: []byte("dek")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	dsm.SetQuorumApproval(kid, true)
+	return dsm, client, encrypted
+}
+
+// onlyPendingApproval returns the only approval request pending in dsm.
+func onlyPendingApproval(t *testing.T, dsm *dsmtest.Server) string {
+	t.Helper()
+	ids := dsm.ApprovalRequests(sdkms.ApprovalStatusPending)
+	if len(ids) != 1 {
+		t.Fatalf("%v approval requests are pending, want 1", len(ids))
+	}
+	return ids[0]
+}
+
+func TestDecryptApprovalApproved(t *testing.T) {
+	dsm, client, encrypted := startApprovalTest(t, time.Hour)
+	ctx := requestContext(t)
+	request := &DecryptRequest{Ciphertext: encrypted.Ciphertext, KeyId: encrypted.KeyId}
+
+	_, err := client.Decrypt(ctx, request)
+	checkError(t, err, codes.FailedPrecondition, reasonDsmApprovalPending)
+	id := onlyPendingApproval(t, dsm)
+	// Retries check the same request rather than create another one.
+	_, err = client.Decrypt(ctx, request)
+	checkError(t, err, codes.FailedPrecondition, reasonDsmApprovalPending)
+	if onlyPendingApproval(t, dsm) != id {
+		t.Fatal("a retry created another approval request")
+	}
+
+	dsm.Approve(id)
+	decrypted, err := client.Decrypt(ctx, request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(decrypted.Plaintext, []byte("dek")) {
+		t.Fatalf("got %q", decrypted.Plaintext)
+	}
+}
+
+func TestDecryptApprovalDenied(t *testing.T) {
+	dsm, client, encrypted := startApprovalTest(t, time.Hour)
+	ctx := requestContext(t)
+	request := &DecryptRequest{Ciphertext: encrypted.Ciphertext, KeyId: encrypted.KeyId}
+
+	_, err := client.Decrypt(ctx, request)
+	checkError(t, err, codes.FailedPrecondition, reasonDsmApprovalPending)
+	dsm.Deny(onlyPendingApproval(t, dsm))
+	for i := 0; i < 2; i++ {
+		_, err = client.Decrypt(ctx, request)
+		checkError(t, err, codes.PermissionDenied, reasonDsmApprovalDenied)
+	}
+	if ids := dsm.ApprovalRequests(sdkms.ApprovalStatusPending); len(ids) != 0 {
+		t.Fatalf("a retry after denial created approval requests %v", ids)
+	}
+}
+
+func TestDecryptApprovalTimeout(t *testing.T) {
+	dsm, client, encrypted := startApprovalTest(t, 50*time.Millisecond)
+	ctx := requestContext(t)
+	request := &DecryptRequest{Ciphertext: encrypted.Ciphertext, KeyId: encrypted.KeyId}
+
+	_, err := client.Decrypt(ctx, request)
+	checkError(t, err, codes.FailedPrecondition, reasonDsmApprovalPending)
+	first := onlyPendingApproval(t, dsm)
+	time.Sleep(100 * time.Millisecond)
+
+	// The timed out request is withdrawn and replaced.
+	_, err = client.Decrypt(ctx, request)
+	checkError(t, err, codes.FailedPrecondition, reasonDsmApprovalPending)
+	if second := onlyPendingApproval(t, dsm); second == first {
+		t.Fatal("the timed out approval request was not replaced")
+	}
+}
+
+func TestDualDecryptApprovalRequired(t *testing.T) {
+	dsm := dsmtest.NewServer(testAPIKey)
+	defer dsm.Close()
+	kid := dsm.AddKey("k8s")
+	dsm.AddKey("k8s-secondary")
+	client := startTestPlugin(t, dsm, func(config *pluginConfig) {
+		endpoint, apiKey, keyName := dsm.URL, testAPIKey, "k8s-secondary"
+		config.Secondary = &pluginConfig{SdkmsEndpoint: &endpoint, ApiKey: &apiKey, KeyName: &keyName}
+	})
+	ctx := requestContext(t)
+	encrypted, err := client.Encrypt(ctx, &EncryptRequest{Plaintext: []byte("dek")})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The secondary key must not be used to get around the approval policy.
+	dsm.SetQuorumApproval(kid, true)
+	_, err = client.Decrypt(ctx, &DecryptRequest{Ciphertext: encrypted.Ciphertext, KeyId: encrypted.KeyId})
+	checkError(t, err, codes.FailedPrecondition, reasonDsmApprovalRequired)
+	if n := dsm.Requests("/crypto/v1/decrypt"); n != 1 {
+		t.Fatalf("%v decrypt requests to DSM, want 1", n)
+	}
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+)
+
+// Backend performs the cryptographic operations behind kmsServer. Every
+// backend produces the same AES-GCM wrappedData envelope, so ciphertext
+// does not depend on how the key is reached.
+type Backend interface {
+	// Wrap encrypts plain under the configured key.
+	Wrap(ctx context.Context, plain []byte) (*wrappedData, error)
+	// Unwrap decrypts data with the key it names.
+	Unwrap(ctx context.Context, data *wrappedData) ([]byte, error)
+	// DescribeKey returns the current state of the configured key.
+	DescribeKey(ctx context.Context) (*KeyInfo, error)
+	// Health reports whether the backend can currently serve requests.
+	Health(ctx context.Context) error
+}
+
+// KeyInfo describes the key a Backend encrypts with.
+type KeyInfo struct {
+	KID        string
+	Name       string
+	Type       string
+	Enabled    bool
+	Exportable bool
+	// Size is the key size in bits, 0 if unknown.
+	Size int
+	// Operations is nil if the backend cannot tell what the key allows.
+	Operations *keyOperations
+	// ActivationDate and DeactivationDate are zero if not set.
+	ActivationDate   time.Time
+	DeactivationDate time.Time
+	// Mode is the cipher mode the key is restricted to, empty if any.
+	Mode string
+}
+
+// nonProductionBackend is implemented by backends that are only meant for
+// development clusters.
+type nonProductionBackend interface {
+	nonProductionWarning() string
+}
+
+// keyDisabledError is returned by backends when an operation failed because
+// the key is disabled.
+type keyDisabledError struct {
+	err error
+}
+
+func (e *keyDisabledError) Error() string { return e.err.Error() }
+func (e *keyDisabledError) Unwrap() error { return e.err }
+
+func isKeyDisabledError(err error) bool {
+	var disabledErr *keyDisabledError
+	return errors.As(err, &disabledErr)
+}
+
+func (p pluginConfig) makeBackend() (Backend, error) {
+	backend, err := p.makeSingleBackend()
+	if err != nil || p.Secondary == nil {
+		return backend, err
+	}
+	secondary, err := p.Secondary.makeSingleBackend()
+	if err != nil {
+		return nil, fmt.Errorf("secondary: %v", err)
+	}
+	return &dualBackend{primary: backend, secondary: secondary}, nil
+}
+
+func (p pluginConfig) makeSingleBackend() (Backend, error) {
+	if p.Pkcs11 != nil {
+		return newPkcs11Backend(*p.Pkcs11, p.AllowedKeyIDs)
+	}
+	if p.Kmip != nil {
+		return newKmipBackend(p)
+	}
+	if p.LocalKek != nil {
+		return newLocalKekBackend(*p.LocalKek)
+	}
+	return newDsmBackend(p), nil
+}
+
+// primaryBackend returns the backend that encrypts with the configured key,
+// looking through a dualBackend.
+func primaryBackend(backend Backend) Backend {
+	if dual, ok := backend.(*dualBackend); ok {
+		return dual.primary
+	}
+	return backend
+}
+
+func (p pluginConfig) backendCount() int {
+	n := 0
+	for _, set := range []bool{p.Pkcs11 != nil, p.Kmip != nil, p.LocalKek != nil} {
+		if set {
+			n++
+		}
+	}
+	return n
+}
+
+// verifyBackend checks that backend is reachable and that the configured
+// key can be used by the plugin.
+func (p pluginConfig) verifyBackend(backend Backend) error {
+	if dual, ok := backend.(*dualBackend); ok {
+		return p.verifyDualBackend(dual)
+	}
+	ctx := context.Background()
+	if err := backend.Health(ctx); err != nil {
+		return err
+	}
+	key, err := backend.DescribeKey(ctx)
+	if err != nil {
+		return fmt.Errorf("invalid key: %v", err)
+	}
+	if problems := keyProblems(key, time.Now()); len(problems) > 0 {
+		return fmt.Errorf("key %v cannot be used: %v", key.KID, strings.Join(problems, "; "))
+	}
+	if p.LocalCrypto != nil && *p.LocalCrypto && !key.Exportable {
+		return errors.New("`local_crypto` requires a key whose policy allows export")
+	}
+	if pinned, ok := backend.(pinnedBackend); ok {
+		if err := pinned.verifyPin(ctx); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// verifyDualBackend lets the plugin start as long as one of the two keys is
+// usable, so that secrets can still be decrypted after losing the other.
+func (p pluginConfig) verifyDualBackend(dual *dualBackend) error {
+	primaryErr := p.verifyBackend(dual.primary)
+	secondaryErr := p.Secondary.verifyBackend(dual.secondary)
+	switch {
+	case primaryErr != nil && secondaryErr != nil:
+		return fmt.Errorf("%v; secondary: %v", primaryErr, secondaryErr)
+	case primaryErr != nil:
+		log.Printf("WARNING: primary key is not usable, only decryption with the secondary key will work: %v", primaryErr)
+	case secondaryErr != nil:
+		log.Printf("WARNING: secondary key is not usable, encryption will fail until it is: %v", secondaryErr)
+	}
+	return nil
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/fortanix/sdkms-client-go/sdkms"
+)
+
+const (
+	defaultBatchMaxSize = 32
+
+	encryptOperation = "/crypto/v1/encrypt"
+	decryptOperation = "/crypto/v1/decrypt"
+)
+
+type batchConfig struct {
+	Window  *duration `json:"window,omitempty"`
+	MaxSize *int      `json:"max_size,omitempty"`
+}
+
+func (c batchConfig) validate() error {
+	if c.Window == nil {
+		return errors.New("required field `batch.window` is missing")
+	}
+	if *c.Window <= 0 {
+		return errors.New("`batch.window` must be positive")
+	}
+	if c.MaxSize != nil && *c.MaxSize < 2 {
+		return errors.New("`batch.max_size` must be at least 2")
+	}
+	return nil
+}
+
+type batchResult struct {
+	body json.RawMessage
+	err  error
+}
+
+type batchItem struct {
+	request  sdkms.BatchRequestItem
+	deadline time.Time // zero if the caller has no deadline
+	done     chan batchResult
+}
+
+// batcher coalesces crypto operations issued within a short window into a
+// single call to the DSM batch API and hands each caller its own result.
+type batcher struct {
+	makeClient func() sdkms.Client
+	window     time.Duration
+	maxSize    int
+	timeout    time.Duration
+
+	mu      sync.Mutex
+	pending []*batchItem
+	timer   *time.Timer
+}
+
+func newBatcher(config batchConfig, makeClient func() sdkms.Client, timeout time.Duration) *batcher {
+	maxSize := defaultBatchMaxSize
+	if config.MaxSize != nil {
+		maxSize = *config.MaxSize
+	}
+	return &batcher{
+		makeClient: makeClient,
+		window:     time.Duration(*config.Window),
+		maxSize:    maxSize,
+		timeout:    timeout,
+	}
+}
+
+func (b *batcher) encrypt(ctx context.Context, request sdkms.EncryptRequest) (*sdkms.EncryptResponse, error) {
+	var resp sdkms.EncryptResponse
+	if err := b.do(ctx, encryptOperation, request, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+func (b *batcher) decrypt(ctx context.Context, request sdkms.DecryptRequest) (*sdkms.DecryptResponse, error) {
+	var resp sdkms.DecryptResponse
+	if err := b.do(ctx, decryptOperation, request, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// do queues a single operation and waits until its batch has completed or
+// ctx is done.
+func (b *batcher) do(ctx context.Context, operation string, body interface{}, response interface{}) error {
+	item := &batchItem{
+		request: sdkms.BatchRequestItem{
+			Method:    http.MethodPost,
+			Operation: operation,
+			Body:      body,
+		},
+		done: make(chan batchResult, 1),
+	}
+	item.deadline, _ = ctx.Deadline()
+	b.enqueue(item)
+
+	select {
+	case result := <-item.done:
+		if result.err != nil {
+			return result.err
+		}
+		if err := json.Unmarshal(result.body, response); err != nil {
+			return fmt.Errorf("failed to decode batch item response: %v", err)
+		}
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (b *batcher) enqueue(item *batchItem) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.pending = append(b.pending, item)
+	if len(b.pending) >= b.maxSize {
+		b.flushLocked()
+		return
+	}
+	if b.timer == nil {
+		b.timer = time.AfterFunc(b.window, b.flush)
+	}
+}
+
+func (b *batcher) flush() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.flushLocked()
+}
+
+func (b *batcher) flushLocked() {
+	if b.timer != nil {
+		b.timer.Stop()
+		b.timer = nil
+	}
+	if len(b.pending) == 0 {
+		return
+	}
+	items := b.pending
+	b.pending = nil
+	go b.send(items)
+}
+
+func (b *batcher) send(items []*batchItem) {
+	requests := make([]sdkms.BatchRequest, len(items))
+	for i, item := range items {
+		requests[i] = sdkms.BatchRequest{SingleItem: &item.request}
+	}
+	ctx, cancel := b.batchContext(items)
+	defer cancel()
+	client := b.makeClient()
+	resp, err := client.Batch(ctx, sdkms.BatchRequest{
+		Batch: &sdkms.BatchRequestList{
+			BatchExecutionType: sdkms.BatchExecutionTypeUnordered,
+			Items:              requests,
+		},
+	})
+	if err == nil && (resp.Batch == nil || len(resp.Batch.Items) != len(items)) {
+		err = errors.New("batch response does not match the number of requests")
+	}
+	if err != nil {
+		for _, item := range items {
+			item.done <- batchResult{err: err}
+		}
+		return
+	}
+	for i, item := range items {
+		item.done <- parseBatchItem(resp.Batch.Items[i])
+	}
+}
+
+// batchContext bounds the batch call by the request timeout, and by the
+// latest deadline among the waiting callers since nobody is left to
+// receive the result after that.
+func (b *batcher) batchContext(items []*batchItem) (context.Context, context.CancelFunc) {
+	deadline := time.Now().Add(b.timeout)
+	var latest time.Time
+	for _, item := range items {
+		if item.deadline.IsZero() {
+			return context.WithDeadline(context.Background(), deadline)
+		}
+		if item.deadline.After(latest) {
+			latest = item.deadline
+		}
+	}
+	if latest.Before(deadline) {
+		deadline = latest
+	}
+	return context.WithDeadline(context.Background(), deadline)
+}
+
+func parseBatchItem(resp sdkms.BatchResponse) batchResult {
+	if resp.SingleItem == nil {
+		return batchResult{err: errors.New("unexpected nested batch in batch response")}
+	}
+	if skipped := resp.SingleItem.Skipped; skipped != nil {
+		return batchResult{err: fmt.Errorf("batch item skipped: %v", skipped.Reason)}
+	}
+	result := resp.SingleItem.Result
+	if result == nil {
+		return batchResult{err: errors.New("batch item has no result")}
+	}
+	if result.Status >= 300 {
+		message, ok := result.Body.(string)
+		if !ok {
+			message = fmt.Sprintf("%v", result.Body)
+		}
+		return batchResult{err: &sdkms.BackendError{StatusCode: int(result.Status), Message: message}}
+	}
+	body, err := json.Marshal(result.Body)
+	if err != nil {
+		return batchResult{err: fmt.Errorf("failed to read batch item body: %v", err)}
+	}
+	return batchResult{body: body}
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/fortanix/k8s-sdkms-plugin/dsmtest"
+	"google.golang.org/grpc/codes"
+)
+
+// withBatch configures batching with window and maxSize.
+func withBatch(window time.Duration, maxSize int) func(*pluginConfig) {
+	return func(config *pluginConfig) {
+		w := duration(window)
+		config.Batch = &batchConfig{Window: &w, MaxSize: &maxSize}
+	}
+}
+
+// concurrently calls f n times at once and waits for every call.
+func concurrently(n int, f func(i int)) {
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			f(i)
+		}(i)
+	}
+	wg.Wait()
+}
+
+func TestBatchCoalesces(t *testing.T) {
+	dsm := dsmtest.NewServer(testAPIKey)
+	defer dsm.Close()
+	dsm.AddKey("k8s")
+	client := startTestPlugin(t, dsm, withBatch(200*time.Millisecond, 32))
+	ctx := requestContext(t)
+
+	encrypted := make([]*EncryptResponse, 8)
+	batches := dsm.Requests("/batch/v1")
+	concurrently(len(encrypted), func(i int) {
+		var err error
+		if encrypted[i], err = client.Encrypt(ctx, &EncryptRequest{Plaintext: []byte{byte(i)}}); err != nil {
+			t.Error(err)
+		}
+	})
+	if t.Failed() {
+		t.FailNow()
+	}
+	if n := dsm.Requests("/batch/v1") - batches; n != 1 {
+		t.Fatalf("%v batch calls for concurrent Encrypt requests, want 1", n)
+	}
+
+	batches = dsm.Requests("/batch/v1")
+	concurrently(len(encrypted), func(i int) {
+		resp, err := client.Decrypt(ctx, &DecryptRequest{Ciphertext: encrypted[i].Ciphertext, KeyId: encrypted[i].KeyId})
+		if err != nil {
+			t.Error(err)
+		} else if len(resp.Plaintext) != 1 || resp.Plaintext[0] != byte(i) {
+			t.Errorf("request %v got plaintext %v", i, resp.Plaintext)
+		}
+	})
+	if n := dsm.Requests("/batch/v1") - batches; n != 1 {
+		t.Fatalf("%v batch calls for concurrent Decrypt requests, want 1", n)
+	}
+	if n := dsm.Requests("/crypto/v1/encrypt") + dsm.Requests("/crypto/v1/decrypt"); n != 0 {
+		t.Fatalf("%v crypto requests outside the batch API", n)
+	}
+}
+
+// TestBatchItemErrors checks that a failed item fails only its own
+// caller.
+func TestBatchItemErrors(t *testing.T) {
+	dsm := dsmtest.NewServer(testAPIKey)
+	defer dsm.Close()
+	dsm.AddKey("k8s")
+	b := newTestDsmBackend(dsm, withBatch(200*time.Millisecond, 32))
+	ctx := context.Background()
+	good, err := b.Wrap(ctx, []byte("dek"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	bad := *good
+	bad.Tag = append([]byte{}, good.Tag...)
+	bad.Tag[0] ^= 1
+
+	batches := dsm.Requests("/batch/v1")
+	errs := make([]error, 2)
+	concurrently(2, func(i int) {
+		data := good
+		if i == 1 {
+			data = &bad
+		}
+		_, errs[i] = b.Unwrap(ctx, data)
+	})
+	if n := dsm.Requests("/batch/v1") - batches; n != 1 {
+		t.Fatalf("%v batch calls, want 1", n)
+	}
+	if errs[0] != nil {
+		t.Fatalf("valid item failed with the other item's error: %v", errs[0])
+	}
+	code, reason, metadata := classifyError(errs[1])
+	if code != codes.FailedPrecondition || reason != reasonDsmRejected || metadata[metadataDsmStatus] != "400" {
+		t.Fatalf("tampered item got %v (%v, %v, %v), want its own 400 from DSM", errs[1], code, reason, metadata)
+	}
+}
+
+func TestBatchDisabledKeyPurgesCache(t *testing.T) {
+	dsm := dsmtest.NewServer(testAPIKey)
+	defer dsm.Close()
+	kid := dsm.AddKey("k8s")
+	ttl := duration(time.Minute)
+	client := startTestPlugin(t, dsm, func(config *pluginConfig) {
+		withBatch(time.Millisecond, 32)(config)
+		config.DecryptCache = &cacheConfig{TTL: &ttl}
+	})
+	ctx := requestContext(t)
+	encrypted, err := client.Encrypt(ctx, &EncryptRequest{Plaintext: []byte("dek")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.Decrypt(ctx, &DecryptRequest{Ciphertext: encrypted.Ciphertext, KeyId: encrypted.KeyId}); err != nil {
+		t.Fatal(err)
+	}
+
+	dsm.SetEnabled(kid, false)
+	_, err = client.Encrypt(ctx, &EncryptRequest{Plaintext: []byte("dek")})
+	checkError(t, err, codes.FailedPrecondition, reasonDsmRejected)
+	// The disabled key message in the batch item purged the cached DEK.
+	_, err = client.Decrypt(ctx, &DecryptRequest{Ciphertext: encrypted.Ciphertext, KeyId: encrypted.KeyId})
+	checkError(t, err, codes.FailedPrecondition, reasonDsmRejected)
+}
+
+func TestBatchMaxSizeFlushesEarly(t *testing.T) {
+	dsm := dsmtest.NewServer(testAPIKey)
+	defer dsm.Close()
+	dsm.AddKey("k8s")
+	client := startTestPlugin(t, dsm, withBatch(time.Minute, 2))
+	ctx := requestContext(t)
+
+	batches := dsm.Requests("/batch/v1")
+	start := time.Now()
+	concurrently(2, func(int) {
+		if _, err := client.Encrypt(ctx, &EncryptRequest{Plaintext: []byte("dek")}); err != nil {
+			t.Error(err)
+		}
+	})
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("a full batch waited %v for the window", elapsed)
+	}
+	if n := dsm.Requests("/batch/v1") - batches; n != 1 {
+		t.Fatalf("%v batch calls, want 1", n)
+	}
+}
+
+// TestBatchCallerDeadline checks that a caller whose deadline passes while
+// its batch is in flight returns, and that the others still get results.
+func TestBatchCallerDeadline(t *testing.T) {
+	dsm := dsmtest.NewServer(testAPIKey)
+	defer dsm.Close()
+	dsm.AddKey("k8s")
+	b := newTestDsmBackend(dsm, withBatch(50*time.Millisecond, 32))
+	data, err := b.Wrap(context.Background(), []byte("dek"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Look up the lineage before DSM slows down.
+	if _, err := b.Unwrap(context.Background(), data); err != nil {
+		t.Fatal(err)
+	}
+
+	dsm.SetFaults(dsmtest.Faults{Latency: 500 * time.Millisecond})
+	var shortErr, longErr error
+	var shortElapsed time.Duration
+	concurrently(2, func(i int) {
+		timeout := 2 * time.Second
+		if i == 0 {
+			timeout = 100 * time.Millisecond
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+		start := time.Now()
+		_, err := b.Unwrap(ctx, data)
+		if i == 0 {
+			shortErr, shortElapsed = err, time.Since(start)
+		} else {
+			longErr = err
+		}
+	})
+	if code, _, _ := classifyError(shortErr); code != codes.DeadlineExceeded {
+		t.Fatalf("caller past its deadline got %v", shortErr)
+	}
+	if shortElapsed > 400*time.Millisecond {
+		t.Fatalf("caller past its deadline waited %v for the batch", shortElapsed)
+	}
+	if longErr != nil {
+		t.Fatalf("caller with time left failed: %v", longErr)
+	}
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"sync"
+	"time"
+)
+
+const (
+	defaultCacheMaxEntries = 1000
+	// maxCacheSweepInterval bounds how long an expired entry can stay in
+	// memory.
+	maxCacheSweepInterval = time.Minute
+)
+
+type cacheConfig struct {
+	TTL        *duration `json:"ttl,omitempty"`
+	MaxEntries *int      `json:"max_entries,omitempty"`
+}
+
+func (c cacheConfig) validate() error {
+	if c.TTL == nil {
+		return errors.New("required field `decrypt_cache.ttl` is missing")
+	}
+	if *c.TTL <= 0 {
+		return errors.New("`decrypt_cache.ttl` must be positive")
+	}
+	if c.MaxEntries != nil && *c.MaxEntries <= 0 {
+		return errors.New("`decrypt_cache.max_entries` must be positive")
+	}
+	return nil
+}
+
+type cacheEntry struct {
+	key     [sha256.Size]byte
+	plain   []byte
+	expires time.Time
+}
+
+// dekFlight is an unwrap in progress for one ciphertext. Concurrent misses
+// for the same DEK wait for it rather than each calling the backend.
+type dekFlight struct {
+	done  chan struct{}
+	plain []byte
+	err   error
+}
+
+// dekCache holds decrypted DEKs keyed by a hash of the wrapped ciphertext.
+// Entries expire after a fixed TTL and the least recently used entry is
+// evicted once the cache is full. Expired entries are swept periodically,
+// and plaintext is zeroed whenever an entry leaves the cache.
+type dekCache struct {
+	mu         sync.Mutex
+	ttl        time.Duration
+	maxEntries int
+	entries    map[[sha256.Size]byte]*list.Element
+	lru        *list.List
+	inflight   map[[sha256.Size]byte]*dekFlight
+	generation int // incremented by purge
+	now        func() time.Time
+}
+
+func newDekCache(config cacheConfig) *dekCache {
+	maxEntries := defaultCacheMaxEntries
+	if config.MaxEntries != nil {
+		maxEntries = *config.MaxEntries
+	}
+	return &dekCache{
+		ttl:        time.Duration(*config.TTL),
+		maxEntries: maxEntries,
+		entries:    make(map[[sha256.Size]byte]*list.Element),
+		lru:        list.New(),
+		inflight:   make(map[[sha256.Size]byte]*dekFlight),
+		now:        time.Now,
+	}
+}
+
+// load returns the plaintext for ciphertext and whether it came from the
+// cache. On a miss it calls unwrap and caches the result, and concurrent
+// misses for the same ciphertext share a single call.
+func (c *dekCache) load(ctx context.Context, ciphertext []byte, unwrap func() ([]byte, error)) ([]byte, bool, error) {
+	key := sha256.Sum256(ciphertext)
+	c.mu.Lock()
+	if plain, ok := c.getLocked(key); ok {
+		c.mu.Unlock()
+		return plain, true, nil
+	}
+	if f, ok := c.inflight[key]; ok {
+		c.mu.Unlock()
+		select {
+		case <-f.done:
+		case <-ctx.Done():
+			return nil, false, ctx.Err()
+		}
+		if f.err != nil {
+			return nil, false, f.err
+		}
+		return append([]byte{}, f.plain...), false, nil
+	}
+	f := &dekFlight{done: make(chan struct{})}
+	c.inflight[key] = f
+	generation := c.generation
+	c.mu.Unlock()
+
+	defer func() {
+		c.mu.Lock()
+		delete(c.inflight, key)
+		// Do not cache what was unwrapped before the cache was purged.
+		if f.err == nil && c.generation == generation {
+			c.putLocked(key, f.plain)
+		}
+		c.mu.Unlock()
+		close(f.done)
+	}()
+	// Waiters fail rather than use an empty result if unwrap panics.
+	f.err = errors.New("unwrap did not return")
+	f.plain, f.err = unwrap()
+	return f.plain, false, f.err
+}
+
+// getLocked returns a copy of the cached plaintext for key, if present.
+func (c *dekCache) getLocked(key [sha256.Size]byte) ([]byte, bool) {
+	elem, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	entry := elem.Value.(*cacheEntry)
+	if c.now().After(entry.expires) {
+		c.remove(elem)
+		return nil, false
+	}
+	c.lru.MoveToFront(elem)
+	return append([]byte{}, entry.plain...), true
+}
+
+// putLocked stores a copy of plain for key.
+func (c *dekCache) putLocked(key [sha256.Size]byte, plain []byte) {
+	if elem, ok := c.entries[key]; ok {
+		c.remove(elem)
+	}
+	elem := c.lru.PushFront(&cacheEntry{
+		key:     key,
+		plain:   append([]byte{}, plain...),
+		expires: c.now().Add(c.ttl),
+	})
+	c.entries[key] = elem
+	for c.lru.Len() > c.maxEntries {
+		c.remove(c.lru.Back())
+	}
+}
+
+// run removes expired entries periodically, so that plaintext does not
+// stay in memory past the TTL when it is not looked up again.
+func (c *dekCache) run() {
+	interval := c.ttl
+	if interval > maxCacheSweepInterval {
+		interval = maxCacheSweepInterval
+	}
+	for range time.Tick(interval) {
+		c.sweep()
+	}
+}
+
+// sweep removes the expired entries.
+func (c *dekCache) sweep() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := c.now()
+	for elem := c.lru.Back(); elem != nil; {
+		prev := elem.Prev()
+		if now.After(elem.Value.(*cacheEntry).expires) {
+			c.remove(elem)
+		}
+		elem = prev
+	}
+}
+
+// purge drops all entries, e.g. when the key is reported disabled.
+func (c *dekCache) purge() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.generation++
+	for c.lru.Len() > 0 {
+		c.remove(c.lru.Back())
+	}
+}
+
+func (c *dekCache) remove(elem *list.Element) {
+	entry := c.lru.Remove(elem).(*cacheEntry)
+	delete(c.entries, entry.key)
+	zero(entry.plain)
+}
+
+func zero(b []byte) {
+	for i := range b {
+		b[i] = 0
+	}
+}
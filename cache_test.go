@@ -0,0 +1,189 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func newTestCache() *dekCache {
+	ttl := duration(time.Minute)
+	return newDekCache(cacheConfig{TTL: &ttl})
+}
+
+func TestDekCacheDeduplicatesMisses(t *testing.T) {
+	c := newTestCache()
+	var calls int32
+	release := make(chan struct{})
+	unwrap := func() ([]byte, error) {
+		atomic.AddInt32(&calls, 1)
+		<-release
+		return []byte("plain"), nil
+	}
+	var wg sync.WaitGroup
+	results := make([][]byte, 8)
+	for i := range results {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			plain, _, err := c.load(context.Background(), []byte("cipher"), unwrap)
+			if err != nil {
+				t.Error(err)
+			}
+			results[i] = plain
+		}(i)
+	}
+	// Let every goroutine reach the cache before the call returns.
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	if calls != 1 {
+		t.Fatalf("unwrap called %v times, want 1", calls)
+	}
+	for _, plain := range results {
+		if string(plain) != "plain" {
+			t.Fatalf("got %q", plain)
+		}
+	}
+	plain, cached, err := c.load(context.Background(), []byte("cipher"), unwrap)
+	if err != nil || !cached || string(plain) != "plain" {
+		t.Fatalf("got %q, %v, %v", plain, cached, err)
+	}
+}
+
+func TestDekCacheSharesErrors(t *testing.T) {
+	c := newTestCache()
+	failure := errors.New("unavailable")
+	if _, _, err := c.load(context.Background(), []byte("cipher"), func() ([]byte, error) {
+		return nil, failure
+	}); err != failure {
+		t.Fatalf("got %v", err)
+	}
+	// Failures are not cached.
+	plain, cached, err := c.load(context.Background(), []byte("cipher"), func() ([]byte, error) {
+		return []byte("plain"), nil
+	})
+	if err != nil || cached || string(plain) != "plain" {
+		t.Fatalf("got %q, %v, %v", plain, cached, err)
+	}
+}
+
+func TestDekCacheWaiterDeadline(t *testing.T) {
+	c := newTestCache()
+	release := make(chan struct{})
+	defer close(release)
+	go c.load(context.Background(), []byte("cipher"), func() ([]byte, error) {
+		<-release
+		return []byte("plain"), nil
+	})
+	time.Sleep(20 * time.Millisecond)
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, _, err := c.load(ctx, []byte("cipher"), func() ([]byte, error) {
+		t.Error("second unwrap while one is in flight")
+		return nil, nil
+	}); err != context.DeadlineExceeded {
+		t.Fatalf("got %v", err)
+	}
+}
+
+func TestDekCachePurgeDuringUnwrap(t *testing.T) {
+	c := newTestCache()
+	c.load(context.Background(), []byte("cipher"), func() ([]byte, error) {
+		c.purge()
+		return []byte("plain"), nil
+	})
+	if _, cached, _ := c.load(context.Background(), []byte("cipher"), func() ([]byte, error) {
+		return []byte("plain"), nil
+	}); cached {
+		t.Fatal("plaintext unwrapped before a purge was cached")
+	}
+}
+
+func TestDekCacheExpiry(t *testing.T) {
+	c := newTestCache()
+	now := time.Now()
+	c.now = func() time.Time { return now }
+	unwrap := func() ([]byte, error) { return []byte("plain"), nil }
+	c.load(context.Background(), []byte("cipher"), unwrap)
+	now = now.Add(2 * time.Minute)
+	if _, cached, _ := c.load(context.Background(), []byte("cipher"), unwrap); cached {
+		t.Fatal("expired entry served")
+	}
+}
+
+// cachedPlain returns the plaintext slice held by the entry for ciphertext.
+func cachedPlain(t *testing.T, c *dekCache, ciphertext string) []byte {
+	t.Helper()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	elem, ok := c.entries[sha256.Sum256([]byte(ciphertext))]
+	if !ok {
+		t.Fatalf("%q is not cached", ciphertext)
+	}
+	return elem.Value.(*cacheEntry).plain
+}
+
+func checkZeroed(t *testing.T, plain []byte) {
+	t.Helper()
+	if !bytes.Equal(plain, make([]byte, len(plain))) {
+		t.Fatalf("plaintext %q was not zeroed", plain)
+	}
+}
+
+func TestDekCacheMaxEntries(t *testing.T) {
+	ttl, maxEntries := duration(time.Minute), 2
+	c := newDekCache(cacheConfig{TTL: &ttl, MaxEntries: &maxEntries})
+	unwrap := func() ([]byte, error) { return []byte("plain"), nil }
+	c.load(context.Background(), []byte("a"), unwrap)
+	c.load(context.Background(), []byte("b"), unwrap)
+	// Using "a" makes "b" the least recently used entry.
+	c.load(context.Background(), []byte("a"), unwrap)
+	evicted := cachedPlain(t, c, "b")
+	c.load(context.Background(), []byte("c"), unwrap)
+
+	c.mu.Lock()
+	_, hasA := c.entries[sha256.Sum256([]byte("a"))]
+	_, hasB := c.entries[sha256.Sum256([]byte("b"))]
+	_, hasC := c.entries[sha256.Sum256([]byte("c"))]
+	c.mu.Unlock()
+	if !hasA || hasB || !hasC {
+		t.Fatalf("cached a: %v, b: %v, c: %v, want b evicted", hasA, hasB, hasC)
+	}
+	checkZeroed(t, evicted)
+}
+
+func TestDekCacheZeroesRemoved(t *testing.T) {
+	c := newTestCache()
+	now := time.Now()
+	c.now = func() time.Time { return now }
+	unwrap := func() ([]byte, error) { return []byte("plain"), nil }
+
+	c.load(context.Background(), []byte("purged"), unwrap)
+	purged := cachedPlain(t, c, "purged")
+	c.purge()
+	checkZeroed(t, purged)
+
+	c.load(context.Background(), []byte("old"), unwrap)
+	old := cachedPlain(t, c, "old")
+	now = now.Add(30 * time.Second)
+	c.load(context.Background(), []byte("new"), unwrap)
+	now = now.Add(45 * time.Second)
+	// The sweep removes expired entries without them being looked up.
+	c.sweep()
+	checkZeroed(t, old)
+	c.mu.Lock()
+	n := c.lru.Len()
+	c.mu.Unlock()
+	if n != 1 {
+		t.Fatalf("%v entries after the sweep, want 1", n)
+	}
+	if plain := cachedPlain(t, c, "new"); string(plain) != "plain" {
+		t.Fatalf("unexpired entry holds %q", plain)
+	}
+}
@@ -1,5 +1,7 @@
 #!/bin/sh
 
+set -e
+
 export GO111MODULE=on
 export CGO_ENABLED=0
 export GOOS=linux
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/fortanix/sdkms-client-go/sdkms"
+	"google.golang.org/grpc/codes"
+)
+
+const keyTypeAes = string(sdkms.ObjectTypeAes)
+
+// dsmBackend is the default Backend. It performs every operation through
+// the DSM REST API.
+type dsmBackend struct {
+	config pluginConfig
+	batch  *batcher     // nil unless `batch` is configured
+	local  *localCrypto // nil unless `local_crypto` is enabled
+
+	approvals *approvals
+	group     *keyGroup // nil unless `group_id` or `group_name` is configured
+
+	lineage *keyLineage
+}
+
+func newDsmBackend(config pluginConfig) *dsmBackend {
+	b := &dsmBackend{
+		config:    config,
+		lineage:   newKeyLineage(config.AllowedKeyIDs),
+		approvals: newApprovals(config.DecryptApproval),
+		group:     newKeyGroup(config),
+	}
+	if config.Batch != nil {
+		b.batch = newBatcher(*config.Batch, config.makeClient, config.Timeouts.dsmRequest())
+	}
+	if config.LocalCrypto != nil && *config.LocalCrypto {
+		log.Println("WARNING: `local_crypto` is enabled, the encryption key is exported from DSM " +
+			"and used in the plugin's memory, where it is exposed to anyone who can read that memory")
+		b.local = newLocalCrypto()
+	}
+	return b
+}
+
+func (b *dsmBackend) Wrap(ctx context.Context, plain []byte) (*wrappedData, error) {
+	if b.local != nil {
+		wrapped, err := b.local.wrap(ctx, b, plain)
+		if err == nil {
+			return wrapped, nil
+		}
+		log.Printf("Local encryption failed, falling back to DSM: %v", err)
+	}
+	descriptor, err := b.keyDescriptor(ctx)
+	if err != nil {
+		return nil, err
+	}
+	tagLen := uint(128)
+	resp, err := b.encrypt(ctx, sdkms.EncryptRequest{
+		Key:    descriptor,
+		Alg:    sdkms.AlgorithmAes,
+		Plain:  plain,
+		Mode:   sdkms.CryptModeSymmetric(sdkms.CipherModeGcm),
+		TagLen: &tagLen,
+	})
+	if err != nil {
+		return nil, checkKeyDisabled(err)
+	}
+	if resp.Kid == nil || resp.Iv == nil || resp.Tag == nil {
+		return nil, newPluginError(codes.Internal, reasonDsmInvalidResponse, nil,
+			"encrypt response from DSM is missing kid, iv or tag")
+	}
+	return &wrappedData{
+		KID:    *resp.Kid,
+		Cipher: resp.Cipher,
+		IV:     *resp.Iv,
+		Tag:    *resp.Tag,
+	}, nil
+}
+
+func (b *dsmBackend) Unwrap(ctx context.Context, data *wrappedData) ([]byte, error) {
+	if err := b.checkDecryptKey(ctx, data.KID); err != nil {
+		return nil, err
+	}
+	if err := b.checkDecryptKeyGroup(ctx, data.KID); err != nil {
+		return nil, err
+	}
+	if b.local != nil {
+		plain, err := b.local.unwrap(data)
+		if err == nil {
+			return plain, nil
+		}
+	}
+	alg := sdkms.AlgorithmAes
+	request := sdkms.DecryptRequest{
+		Key:    sdkms.SobjectByID(data.KID),
+		Alg:    &alg,
+		Cipher: data.Cipher,
+		Mode:   sdkms.CryptModeSymmetric(sdkms.CipherModeGcm),
+		Iv:     &data.IV,
+		Tag:    &data.Tag,
+	}
+	resp, err := b.decrypt(ctx, request)
+	if isApprovalRequired(err) {
+		resp, err = b.approvals.decrypt(ctx, b, request, err)
+	}
+	if err != nil {
+		return nil, checkKeyDisabled(err)
+	}
+	return resp.Plain, nil
+}
+
+func (b *dsmBackend) DescribeKey(ctx context.Context) (*KeyInfo, error) {
+	key, err := b.getSobject(ctx)
+	if err != nil {
+		return nil, err
+	}
+	info := &KeyInfo{
+		Type:       string(key.ObjType),
+		Enabled:    key.Enabled,
+		Exportable: checkExportable(key) == nil,
+	}
+	if key.Kid != nil {
+		info.KID = *key.Kid
+	}
+	if key.Name != nil {
+		info.Name = *key.Name
+	}
+	if key.KeySize != nil {
+		info.Size = int(*key.KeySize)
+	}
+	ops := key.KeyOps
+	if key.EffectiveKeyPolicy != nil {
+		ops = key.EffectiveKeyPolicy.KeyOps
+	}
+	info.Operations = &keyOperations{
+		Encrypt: ops&sdkms.KeyOperationsEncrypt != 0,
+		Decrypt: ops&sdkms.KeyOperationsDecrypt != 0,
+	}
+	if key.ActivationDate != nil {
+		info.ActivationDate, _ = key.ActivationDate.Std()
+	}
+	if key.DeactivationDate != nil {
+		info.DeactivationDate, _ = key.DeactivationDate.Std()
+	}
+	if key.Aes != nil && key.Aes.CipherMode != nil {
+		info.Mode = string(*key.Aes.CipherMode)
+	}
+	return info, nil
+}
+
+// Health verifies the API key by establishing and terminating a session.
+func (b *dsmBackend) Health(ctx context.Context) error {
+	client := b.config.makeClient()
+	err := b.config.withDsmContext(ctx, func(ctx context.Context) error {
+		_, err := client.AuthenticateWithAPIKey(ctx, *b.config.ApiKey)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("invalid `api_key`: %v", err)
+	}
+	b.config.withDsmContext(ctx, client.TerminateSession)
+	return nil
+}
+
+// getSobject returns the configured key, and fails if it is outside the
+// configured group.
+func (b *dsmBackend) getSobject(ctx context.Context) (*sdkms.Sobject, error) {
+	descriptor, err := b.keyDescriptor(ctx)
+	if err != nil {
+		return nil, err
+	}
+	client := b.config.makeClient()
+	encoding := sdkms.SobjectEncodingJson
+	var key *sdkms.Sobject
+	err = b.config.withDsmContext(ctx, func(ctx context.Context) (err error) {
+		key, err = client.GetSobject(ctx, &sdkms.GetSobjectParams{View: &encoding}, *descriptor)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err := b.checkKeyGroup(ctx, key); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+func (b *dsmBackend) encrypt(ctx context.Context, request sdkms.EncryptRequest) (*sdkms.EncryptResponse, error) {
+	ctx, cancel, err := b.config.dsmContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer cancel()
+	if b.batch != nil {
+		return b.batch.encrypt(ctx, request)
+	}
+	client := b.config.makeClient()
+	return client.Encrypt(ctx, request)
+}
+
+func (b *dsmBackend) decrypt(ctx context.Context, request sdkms.DecryptRequest) (*sdkms.DecryptResponse, error) {
+	ctx, cancel, err := b.config.dsmContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer cancel()
+	if b.batch != nil {
+		return b.batch.decrypt(ctx, request)
+	}
+	client := b.config.makeClient()
+	return client.Decrypt(ctx, request)
+}
+
+func (b *dsmBackend) approvalStatus() string {
+	return b.approvals.status()
+}
+
+// checkKeyDisabled marks err as a keyDisabledError if DSM reports that the
+// key is disabled.
+func checkKeyDisabled(err error) error {
+	var backendErr *sdkms.BackendError
+	if errors.As(err, &backendErr) && strings.Contains(strings.ToLower(backendErr.Message), "disabled") {
+		return &keyDisabledError{err: err}
+	}
+	return err
+}
@@ -0,0 +1,142 @@
+package dsmtest
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/fortanix/sdkms-client-go/sdkms"
+)
+
+// quorumRequiredMessage is returned for operations with a key under a
+// quorum approval policy.
+const quorumRequiredMessage = "This operation requires approval by a quorum of reviewers, create an approval request"
+
+// approval is an approval request to decrypt.
+type approval struct {
+	id      string
+	status  sdkms.ApprovalStatus
+	created time.Time
+	request sdkms.DecryptRequest
+	// The result of the operation once the request is approved.
+	resultStatus int
+	result       interface{}
+}
+
+// SetQuorumApproval makes decryption with the key kid require an approval
+// request, as a quorum approval policy in DSM does.
+func (s *Server) SetQuorumApproval(kid string, required bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if k, ok := s.keys[kid]; ok {
+		k.quorum = required
+	}
+}
+
+// ApprovalRequests returns the IDs of the approval requests with status.
+func (s *Server) ApprovalRequests(status sdkms.ApprovalStatus) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var ids []string
+	for id, a := range s.approvals {
+		if a.status == status {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+// Approve approves the pending approval request id, which performs the
+// operation.
+func (s *Server) Approve(id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	a, ok := s.approvals[id]
+	if !ok || a.status != sdkms.ApprovalStatusPending {
+		return
+	}
+	a.status = sdkms.ApprovalStatusApproved
+	k, status, msg := s.usableKey(a.request.Key, sdkms.KeyOperationsDecrypt)
+	if k == nil {
+		a.resultStatus, a.result = status, msg
+		return
+	}
+	a.resultStatus, a.result = s.decryptLocked(k, a.request)
+}
+
+// Deny denies the pending approval request id.
+func (s *Server) Deny(id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if a, ok := s.approvals[id]; ok && a.status == sdkms.ApprovalStatusPending {
+		a.status = sdkms.ApprovalStatusDenied
+	}
+}
+
+func (s *Server) createApproval(body []byte, query map[string][]string) (int, interface{}) {
+	var request struct {
+		Method    string          `json:"method"`
+		Operation string          `json:"operation"`
+		Body      json.RawMessage `json:"body"`
+	}
+	if err := json.Unmarshal(body, &request); err != nil {
+		return http.StatusBadRequest, err.Error()
+	}
+	if request.Method != http.MethodPost || request.Operation != "/crypto/v1/decrypt" {
+		return http.StatusBadRequest, "only approval requests to decrypt are supported"
+	}
+	a := &approval{id: newUUID(), status: sdkms.ApprovalStatusPending, created: time.Now()}
+	if err := json.Unmarshal(request.Body, &a.request); err != nil {
+		return http.StatusBadRequest, err.Error()
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.approvals[a.id] = a
+	return http.StatusOK, a.json()
+}
+
+// approvalRequest serves GET and DELETE on /sys/v1/approval_requests/:id
+// and POST on /sys/v1/approval_requests/:id/result.
+func (s *Server) approvalRequest(r *http.Request, body []byte) (int, interface{}) {
+	id := strings.TrimPrefix(r.URL.Path, "/sys/v1/approval_requests/")
+	id, result := strings.CutSuffix(id, "/result")
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	a, ok := s.approvals[id]
+	if !ok {
+		return http.StatusNotFound, "approval request does not exist"
+	}
+	switch {
+	case result && r.Method == http.MethodPost:
+		if a.status != sdkms.ApprovalStatusApproved {
+			return http.StatusBadRequest, "approval request has not been approved"
+		}
+		content, err := json.Marshal(a.result)
+		if err != nil {
+			return http.StatusInternalServerError, err.Error()
+		}
+		return http.StatusOK, map[string]interface{}{"status": a.resultStatus, "body": json.RawMessage(content)}
+	case !result && r.Method == http.MethodGet:
+		return http.StatusOK, a.json()
+	case !result && r.Method == http.MethodDelete:
+		delete(s.approvals, id)
+		return http.StatusNoContent, nil
+	}
+	return http.StatusMethodNotAllowed, "method not allowed"
+}
+
+func (a *approval) json() map[string]interface{} {
+	created := a.created.UTC().Format("20060102T150405Z")
+	return map[string]interface{}{
+		"request_id": a.id,
+		"acct_id":    "00000000-0000-0000-0000-000000000000",
+		"approvers":  []interface{}{},
+		"created_at": created,
+		"expiry":     a.created.Add(24 * time.Hour).UTC().Format("20060102T150405Z"),
+		"method":     http.MethodPost,
+		"operation":  "/crypto/v1/decrypt",
+		"requester":  map[string]interface{}{"app": "00000000-0000-0000-0000-000000000000"},
+		"status":     a.status,
+	}
+}
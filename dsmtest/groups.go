@@ -0,0 +1,71 @@
+package dsmtest
+
+import (
+	"net/http"
+
+	"github.com/fortanix/sdkms-client-go/sdkms"
+)
+
+// AddGroup adds a group and returns its ID.
+func (s *Server) AddGroup(name string) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	id := newUUID()
+	s.groups[id] = name
+	return id
+}
+
+// SetGroup moves the key kid to the group with ID group.
+func (s *Server) SetGroup(kid, group string) {
+	s.UpdateKey(kid, func(sobject *sdkms.Sobject) { sobject.GroupID = &group })
+}
+
+func (s *Server) findInGroup(name, group string) *key {
+	for _, k := range s.keys {
+		if k.sobject.Name != nil && *k.sobject.Name == name && k.sobject.GroupID != nil && *k.sobject.GroupID == group {
+			return k
+		}
+	}
+	return nil
+}
+
+// listKeys serves GET /crypto/v1/keys, filtered by the group_id and name
+// query parameters.
+func (s *Server) listKeys(r *http.Request, body []byte) (int, interface{}) {
+	if r.Method != http.MethodGet {
+		return http.StatusMethodNotAllowed, "method not allowed"
+	}
+	query := r.URL.Query()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	items := []sdkms.Sobject{}
+	for _, k := range s.keys {
+		o := k.sobject
+		if name := query.Get("name"); name != "" && (o.Name == nil || *o.Name != name) {
+			continue
+		}
+		if group := query.Get("group_id"); group != "" && (o.GroupID == nil || *o.GroupID != group) {
+			continue
+		}
+		items = append(items, o)
+	}
+	total, filtered := uint(len(s.keys)), uint(len(items))
+	return http.StatusOK, map[string]interface{}{
+		"metadata": sdkms.Metadata{TotalCount: &total, FilteredCount: &filtered},
+		"items":    items,
+	}
+}
+
+// listGroups serves GET /sys/v1/groups.
+func (s *Server) listGroups(r *http.Request, body []byte) (int, interface{}) {
+	if r.Method != http.MethodGet {
+		return http.StatusMethodNotAllowed, "method not allowed"
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	groups := []map[string]interface{}{}
+	for id, name := range s.groups {
+		groups = append(groups, map[string]interface{}{"group_id": id, "name": name})
+	}
+	return http.StatusOK, groups
+}
@@ -0,0 +1,502 @@
+// Package dsmtest provides an in-process fake of the DSM REST API that
+// covers the endpoints used by the plugin, with fault injection, so that
+// the plugin can be exercised without a DSM account.
+package dsmtest
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fortanix/sdkms-client-go/sdkms"
+)
+
+// Faults are applied to every request handled by the server.
+type Faults struct {
+	// Latency is added before each request is handled.
+	Latency time.Duration
+	// StatusCode, if set, is returned for every request instead of handling
+	// it, e.g. 401 or 503.
+	StatusCode int
+}
+
+type key struct {
+	sobject sdkms.Sobject
+	value   []byte
+	// quorum makes decryption with the key require an approval request.
+	quorum bool
+}
+
+// Server is a fake DSM holding AES keys in memory.
+type Server struct {
+	*httptest.Server
+
+	apiKey string
+
+	mu        sync.Mutex
+	keys      map[string]*key
+	sessions  map[string]bool
+	faults    Faults
+	requests  map[string]int
+	approvals map[string]*approval
+	groups    map[string]string // names by ID
+}
+
+// NewServer starts a server that accepts apiKey for authentication.
+func NewServer(apiKey string) *Server {
+	s := &Server{
+		apiKey:    apiKey,
+		keys:      make(map[string]*key),
+		sessions:  make(map[string]bool),
+		requests:  make(map[string]int),
+		approvals: make(map[string]*approval),
+		groups:    make(map[string]string),
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/sys/v1/session/auth", s.handle(s.auth))
+	mux.HandleFunc("/sys/v1/session/terminate", s.handle(s.terminate))
+	mux.HandleFunc("/crypto/v1/keys", s.handleRequest(s.listKeys))
+	mux.HandleFunc("/crypto/v1/keys/info", s.handle(s.keyInfo))
+	mux.HandleFunc("/crypto/v1/keys/rekey", s.handle(s.rekey))
+	mux.HandleFunc("/crypto/v1/keys/export", s.handle(s.export))
+	mux.HandleFunc("/crypto/v1/encrypt", s.handle(s.encrypt))
+	mux.HandleFunc("/crypto/v1/decrypt", s.handle(s.decrypt))
+	mux.HandleFunc("/batch/v1", s.handle(s.batch))
+	mux.HandleFunc("/sys/v1/groups", s.handleRequest(s.listGroups))
+	mux.HandleFunc("/sys/v1/approval_requests", s.handle(s.createApproval))
+	mux.HandleFunc("/sys/v1/approval_requests/", s.handleRequest(s.approvalRequest))
+	s.Server = httptest.NewServer(mux)
+	return s
+}
+
+// AddKey adds an enabled 256-bit AES key named name and returns its ID.
+func (s *Server) AddKey(name string) string {
+	value := make([]byte, 32)
+	if _, err := rand.Read(value); err != nil {
+		panic(err)
+	}
+	return s.AddKeyWithValue(name, value)
+}
+
+// AddKeyWithValue adds an enabled AES key with the given value and returns
+// its ID.
+func (s *Server) AddKeyWithValue(name string, value []byte) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.addKeyLocked(name, value)
+}
+
+func (s *Server) addKeyLocked(name string, value []byte) string {
+	kid := newUUID()
+	size := uint32(len(value) * 8)
+	kcv := keyCheckValue(value)
+	s.keys[kid] = &key{
+		sobject: sdkms.Sobject{
+			Kid:       &kid,
+			Name:      &name,
+			ObjType:   sdkms.ObjectTypeAes,
+			KeySize:   &size,
+			Enabled:   true,
+			KeyOps:    sdkms.KeyOperationsEncrypt | sdkms.KeyOperationsDecrypt | sdkms.KeyOperationsAppmanageable,
+			CreatedAt: sdkms.Time(time.Now().UTC().Format("20060102T150405Z")),
+			Creator:   sdkms.Principal{System: &struct{}{}},
+			Origin:    sdkms.ObjectOriginFortanixHSM,
+			Kcv:       &kcv,
+		},
+		value: value,
+	}
+	return kid
+}
+
+// keyCheckValue is the first three bytes of a zero block encrypted with the
+// key, as DSM reports it for AES keys.
+func keyCheckValue(value []byte) string {
+	block, err := aes.NewCipher(value)
+	if err != nil {
+		return ""
+	}
+	out := make([]byte, aes.BlockSize)
+	block.Encrypt(out, make([]byte, aes.BlockSize))
+	return hex.EncodeToString(out[:3])
+}
+
+// UpdateKey lets f modify the metadata of the key kid, e.g. to disable it
+// or to set a deactivation date.
+func (s *Server) UpdateKey(kid string, f func(*sdkms.Sobject)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if k, ok := s.keys[kid]; ok {
+		f(&k.sobject)
+	}
+}
+
+// SetEnabled enables or disables the key kid.
+func (s *Server) SetEnabled(kid string, enabled bool) {
+	s.UpdateKey(kid, func(sobject *sdkms.Sobject) { sobject.Enabled = enabled })
+}
+
+// Rotate replaces the key named name with a new key of the same name, as
+// the DSM rekey API does, and returns the ID of the new key.
+func (s *Server) Rotate(name string) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.rotateLocked(name, nil)
+}
+
+// rotateLocked rotates the key named name, in group if not nil.
+func (s *Server) rotateLocked(name string, group *string) (string, error) {
+	old := s.findByName(name)
+	if group != nil {
+		old = s.findInGroup(name, *group)
+	}
+	if old == nil {
+		return "", fmt.Errorf("no key named %q", name)
+	}
+	value := make([]byte, len(old.value))
+	if _, err := rand.Read(value); err != nil {
+		return "", err
+	}
+	kid := s.addKeyLocked(name, value)
+	oldKid := *old.sobject.Kid
+	renamed := fmt.Sprintf("%v (replaced %v)", name, time.Now().UTC().Format(time.RFC3339Nano))
+	old.sobject.Name = &renamed
+	if old.sobject.Links == nil {
+		old.sobject.Links = &sdkms.KeyLinks{}
+	}
+	old.sobject.Links.Replacement = &kid
+	s.keys[kid].sobject.Links = &sdkms.KeyLinks{Replaced: &oldKid}
+	s.keys[kid].sobject.GroupID = old.sobject.GroupID
+	return kid, nil
+}
+
+// SetFaults replaces the faults applied to subsequent requests.
+func (s *Server) SetFaults(faults Faults) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.faults = faults
+}
+
+// Requests returns how many requests were made to path.
+func (s *Server) Requests(path string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.requests[path]
+}
+
+type handlerFunc func(body []byte, query map[string][]string) (int, interface{})
+
+// handle serves POST requests with h.
+func (s *Server) handle(h handlerFunc) http.HandlerFunc {
+	return s.handleRequest(func(r *http.Request, body []byte) (int, interface{}) {
+		if r.Method != http.MethodPost {
+			return http.StatusMethodNotAllowed, "method not allowed"
+		}
+		return h(body, r.URL.Query())
+	})
+}
+
+// handleRequest applies faults and authentication before calling h.
+func (s *Server) handleRequest(h func(r *http.Request, body []byte) (int, interface{})) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		s.mu.Lock()
+		faults := s.faults
+		s.requests[r.URL.Path]++
+		s.mu.Unlock()
+
+		if faults.Latency > 0 {
+			select {
+			case <-time.After(faults.Latency):
+			case <-r.Context().Done():
+				return
+			}
+		}
+		if faults.StatusCode != 0 {
+			writeResponse(w, faults.StatusCode, http.StatusText(faults.StatusCode))
+			return
+		}
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			writeResponse(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		s.mu.Lock()
+		authorized := s.authorized(r)
+		s.mu.Unlock()
+		if !authorized {
+			writeResponse(w, http.StatusUnauthorized, "invalid credentials")
+			return
+		}
+		status, response := h(r, body)
+		writeResponse(w, status, response)
+	}
+}
+
+func (s *Server) authorized(r *http.Request) bool {
+	auth := r.Header.Get("Authorization")
+	if token, ok := strings.CutPrefix(auth, "Bearer "); ok {
+		return s.sessions[token]
+	}
+	if apiKey, ok := strings.CutPrefix(auth, "Basic "); ok {
+		return apiKey == s.apiKey
+	}
+	return false
+}
+
+func writeResponse(w http.ResponseWriter, status int, response interface{}) {
+	if message, ok := response.(string); ok && status >= 300 {
+		w.WriteHeader(status)
+		io.WriteString(w, message)
+		return
+	}
+	if response == nil {
+		w.WriteHeader(status)
+		return
+	}
+	body, err := json.Marshal(response)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		io.WriteString(w, err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(body)
+}
+
+func (s *Server) auth(body []byte, query map[string][]string) (int, interface{}) {
+	token := newUUID()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sessions[token] = true
+	return http.StatusOK, sdkms.AuthenticationResponse{ExpiresIn: 600, AccessToken: token}
+}
+
+func (s *Server) terminate(body []byte, query map[string][]string) (int, interface{}) {
+	return http.StatusNoContent, nil
+}
+
+func (s *Server) keyInfo(body []byte, query map[string][]string) (int, interface{}) {
+	var descriptor sdkms.SobjectDescriptor
+	if err := json.Unmarshal(body, &descriptor); err != nil {
+		return http.StatusBadRequest, err.Error()
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	k, status, msg := s.lookup(&descriptor)
+	if k == nil {
+		return status, msg
+	}
+	return http.StatusOK, k.sobject
+}
+
+func (s *Server) export(body []byte, query map[string][]string) (int, interface{}) {
+	var descriptor sdkms.SobjectDescriptor
+	if err := json.Unmarshal(body, &descriptor); err != nil {
+		return http.StatusBadRequest, err.Error()
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	k, status, msg := s.usableKey(&descriptor, sdkms.KeyOperationsExport)
+	if k == nil {
+		return status, msg
+	}
+	exported := k.sobject
+	value := sdkms.Blob(append([]byte(nil), k.value...))
+	exported.Value = &value
+	return http.StatusOK, exported
+}
+
+func (s *Server) rekey(body []byte, query map[string][]string) (int, interface{}) {
+	var request sdkms.SobjectRekeyRequest
+	if err := json.Unmarshal(body, &request); err != nil {
+		return http.StatusBadRequest, err.Error()
+	}
+	if request.Dest.Name == nil {
+		return http.StatusBadRequest, "dest.name is required"
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	kid, err := s.rotateLocked(*request.Dest.Name, request.Dest.GroupID)
+	if err != nil {
+		return http.StatusNotFound, err.Error()
+	}
+	return http.StatusOK, s.keys[kid].sobject
+}
+
+func (s *Server) encrypt(body []byte, query map[string][]string) (int, interface{}) {
+	var request sdkms.EncryptRequest
+	if err := json.Unmarshal(body, &request); err != nil {
+		return http.StatusBadRequest, err.Error()
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	k, status, msg := s.usableKey(request.Key, sdkms.KeyOperationsEncrypt)
+	if k == nil {
+		return status, msg
+	}
+	tagLen := uint(128)
+	if request.TagLen != nil {
+		tagLen = *request.TagLen
+	}
+	aead, status, msg := gcm(request.Alg, request.Mode, k.value, tagLen/8)
+	if aead == nil {
+		return status, msg
+	}
+	iv := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(iv); err != nil {
+		return http.StatusInternalServerError, err.Error()
+	}
+	sealed := aead.Seal(nil, iv, request.Plain, nil)
+	split := len(sealed) - aead.Overhead()
+	tag := sealed[split:]
+	return http.StatusOK, sdkms.EncryptResponse{
+		Kid:    k.sobject.Kid,
+		Cipher: sealed[:split],
+		Iv:     &iv,
+		Tag:    &tag,
+	}
+}
+
+func (s *Server) decrypt(body []byte, query map[string][]string) (int, interface{}) {
+	var request sdkms.DecryptRequest
+	if err := json.Unmarshal(body, &request); err != nil {
+		return http.StatusBadRequest, err.Error()
+	}
+	if request.Alg == nil || request.Iv == nil || request.Tag == nil {
+		return http.StatusBadRequest, "alg, iv and tag are required"
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	k, status, msg := s.usableKey(request.Key, sdkms.KeyOperationsDecrypt)
+	if k == nil {
+		return status, msg
+	}
+	if k.quorum {
+		return http.StatusForbidden, quorumRequiredMessage
+	}
+	return s.decryptLocked(k, request)
+}
+
+func (s *Server) decryptLocked(k *key, request sdkms.DecryptRequest) (int, interface{}) {
+	aead, status, msg := gcm(*request.Alg, request.Mode, k.value, uint(len(*request.Tag)))
+	if aead == nil {
+		return status, msg
+	}
+	if len(*request.Iv) != aead.NonceSize() {
+		return http.StatusBadRequest, "invalid IV length"
+	}
+	plain, err := aead.Open(nil, *request.Iv, append(append([]byte{}, request.Cipher...), *request.Tag...), nil)
+	if err != nil {
+		return http.StatusBadRequest, "decryption failed: authentication tag mismatch"
+	}
+	return http.StatusOK, sdkms.DecryptResponse{Kid: k.sobject.Kid, Plain: plain}
+}
+
+func (s *Server) batch(body []byte, query map[string][]string) (int, interface{}) {
+	var request sdkms.BatchRequest
+	if err := json.Unmarshal(body, &request); err != nil {
+		return http.StatusBadRequest, err.Error()
+	}
+	if request.Batch == nil {
+		return http.StatusBadRequest, "only batch requests are supported"
+	}
+	handlers := map[string]handlerFunc{
+		"/crypto/v1/encrypt": s.encrypt,
+		"/crypto/v1/decrypt": s.decrypt,
+	}
+	items := make([]sdkms.BatchResponse, len(request.Batch.Items))
+	for i, item := range request.Batch.Items {
+		result := &sdkms.BatchResponseObjectResult{Status: http.StatusBadRequest, Body: "unsupported batch item"}
+		if item.SingleItem != nil {
+			if h, ok := handlers[item.SingleItem.Operation]; ok {
+				itemBody, _ := json.Marshal(item.SingleItem.Body)
+				status, response := h(itemBody, nil)
+				result = &sdkms.BatchResponseObjectResult{Status: uint16(status), Body: response}
+			}
+		}
+		items[i] = sdkms.BatchResponse{SingleItem: &sdkms.BatchResponseObject{Result: result}}
+	}
+	return http.StatusOK, sdkms.BatchResponse{Batch: &sdkms.BatchResponseList{Items: items}}
+}
+
+// usableKey finds the key described by descriptor and checks that it can
+// perform op.
+func (s *Server) usableKey(descriptor *sdkms.SobjectDescriptor, op sdkms.KeyOperations) (*key, int, string) {
+	if descriptor == nil {
+		return nil, http.StatusBadRequest, "key is required"
+	}
+	k, status, msg := s.lookup(descriptor)
+	if k == nil {
+		return nil, status, msg
+	}
+	if !k.sobject.Enabled {
+		return nil, http.StatusBadRequest, "Security object is disabled"
+	}
+	if k.sobject.KeyOps&op != op {
+		return nil, http.StatusBadRequest, "operation is not allowed for this security object"
+	}
+	return k, 0, ""
+}
+
+func (s *Server) lookup(descriptor *sdkms.SobjectDescriptor) (*key, int, string) {
+	var k *key
+	switch {
+	case descriptor.Kid != nil:
+		k = s.keys[*descriptor.Kid]
+	case descriptor.Name != nil:
+		k = s.findByName(*descriptor.Name)
+	default:
+		return nil, http.StatusBadRequest, "unsupported key descriptor"
+	}
+	if k == nil {
+		return nil, http.StatusNotFound, "sobject does not exist"
+	}
+	return k, 0, ""
+}
+
+func (s *Server) findByName(name string) *key {
+	for _, k := range s.keys {
+		if k.sobject.Name != nil && *k.sobject.Name == name {
+			return k
+		}
+	}
+	return nil
+}
+
+func gcm(alg sdkms.Algorithm, mode *sdkms.CryptMode, value []byte, tagSize uint) (cipher.AEAD, int, string) {
+	if alg != sdkms.AlgorithmAes {
+		return nil, http.StatusBadRequest, "only AES is supported"
+	}
+	if mode == nil || mode.Symmetric == nil || *mode.Symmetric != sdkms.CipherModeGcm {
+		return nil, http.StatusBadRequest, "only GCM mode is supported"
+	}
+	block, err := aes.NewCipher(value)
+	if err != nil {
+		return nil, http.StatusInternalServerError, err.Error()
+	}
+	aead, err := cipher.NewGCMWithTagSize(block, int(tagSize))
+	if err != nil {
+		return nil, http.StatusBadRequest, err.Error()
+	}
+	return aead, 0, ""
+}
+
+func newUUID() string {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		panic(err)
+	}
+	id[6] = id[6]&0x0f | 0x40
+	id[8] = id[8]&0x3f | 0x80
+	h := hex.EncodeToString(id)
+	return h[0:8] + "-" + h[8:12] + "-" + h[12:16] + "-" + h[16:20] + "-" + h[20:32]
+}
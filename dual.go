@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+
+	"google.golang.org/grpc/codes"
+)
+
+// validateSecondary checks the `secondary` section, which selects a backend
+// and key like the top level does but has no server settings of its own.
+func (p pluginConfig) validateSecondary() error {
+	if p.SocketFile != nil || len(p.AllowedPeerUIDs) > 0 || p.DecryptCache != nil || p.Secondary != nil {
+		return errors.New("`secondary` may only select a backend and key")
+	}
+	if err := p.validateBackend(); err != nil {
+		return fmt.Errorf("invalid `secondary`: %v", err)
+	}
+	return nil
+}
+
+// dualBackend wraps every DEK under two keys, possibly in different DSM
+// accounts, so that secrets survive the loss of either key.
+type dualBackend struct {
+	primary   Backend
+	secondary Backend
+}
+
+func (b *dualBackend) Wrap(ctx context.Context, plain []byte) (*wrappedData, error) {
+	type result struct {
+		data *wrappedData
+		err  error
+	}
+	secondary := make(chan result, 1)
+	go func() {
+		data, err := b.secondary.Wrap(ctx, plain)
+		secondary <- result{data, err}
+	}()
+	data, err := b.primary.Wrap(ctx, plain)
+	second := <-secondary
+	if err != nil {
+		return nil, err
+	}
+	if second.err != nil {
+		return nil, fmt.Errorf("failed to wrap with the secondary key: %w", second.err)
+	}
+	data.Secondary = second.data
+	return data, nil
+}
+
+// Unwrap tries the primary key first and falls back to the secondary key
+// if the ciphertext has one and the primary key is unavailable.
+func (b *dualBackend) Unwrap(ctx context.Context, data *wrappedData) ([]byte, error) {
+	plain, _, err := b.unwrap(ctx, data)
+	return plain, err
+}
+
+// unwrap is Unwrap, also returning the KID of the key that was used.
+func (b *dualBackend) unwrap(ctx context.Context, data *wrappedData) ([]byte, string, error) {
+	plain, err := b.primary.Unwrap(ctx, data)
+	if err == nil || data.Secondary == nil || !fallsBack(err) {
+		return plain, data.KID, err
+	}
+	plain, secondErr := b.secondary.Unwrap(ctx, data.Secondary)
+	if secondErr != nil {
+		log.Printf("Failed to unwrap with the secondary key: %v", secondErr)
+		return nil, "", err
+	}
+	log.Printf("WARNING: unwrapped with the secondary key, the primary key failed: %v", err)
+	return plain, data.Secondary.KID, nil
+}
+
+// unwrapWithKID unwraps data with backend and returns the KID of the key
+// that was used, which is the secondary key's if a dualBackend fell back.
+func unwrapWithKID(ctx context.Context, backend Backend, data *wrappedData) ([]byte, string, error) {
+	if dual, ok := backend.(*dualBackend); ok {
+		return dual.unwrap(ctx, data)
+	}
+	plain, err := backend.Unwrap(ctx, data)
+	return plain, data.KID, err
+}
+
+// fallsBack reports whether Unwrap should try the secondary key after the
+// primary one failed with err. Only availability errors qualify: a quorum
+// approval policy or a rejected key must not be worked around.
+func fallsBack(err error) bool {
+	if isApprovalRequired(err) {
+		return false
+	}
+	code, reason, _ := classifyError(err)
+	switch reason {
+	case reasonDsmApprovalRequired, reasonDsmApprovalPending, reasonDsmApprovalDenied:
+		return false
+	case reasonDsmKeyNotFound, reasonDsmUnauthenticated:
+		return true
+	}
+	return code == codes.Unavailable || code == codes.DeadlineExceeded || code == codes.ResourceExhausted
+}
+
+func (b *dualBackend) DescribeKey(ctx context.Context) (*KeyInfo, error) {
+	return b.primary.DescribeKey(ctx)
+}
+
+func (b *dualBackend) Health(ctx context.Context) error {
+	if err := b.primary.Health(ctx); err != nil {
+		return err
+	}
+	if err := b.secondary.Health(ctx); err != nil {
+		return fmt.Errorf("secondary: %w", err)
+	}
+	return nil
+}
+
+func (b *dualBackend) approvalStatus() string {
+	var notes []string
+	for _, backend := range []Backend{b.primary, b.secondary} {
+		if a, ok := backend.(approvalBackend); ok && a.approvalStatus() != "" {
+			notes = append(notes, a.approvalStatus())
+		}
+	}
+	return strings.Join(notes, "; ")
+}
+
+func (b *dualBackend) nonProductionWarning() string {
+	for _, backend := range []Backend{b.primary, b.secondary} {
+		if np, ok := backend.(nonProductionBackend); ok {
+			return np.nonProductionWarning()
+		}
+	}
+	return ""
+}
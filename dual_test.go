@@ -0,0 +1,36 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/fortanix/k8s-sdkms-plugin/dsmtest"
+)
+
+func TestDualDecryptRecordsSecondaryKey(t *testing.T) {
+	dsm := dsmtest.NewServer(testAPIKey)
+	defer dsm.Close()
+	kid := dsm.AddKey("k8s")
+	other := dsmtest.NewServer(testAPIKey)
+	defer other.Close()
+	secondaryKid := other.AddKey("k8s-secondary")
+	client := startTestPlugin(t, dsm, func(config *pluginConfig) {
+		endpoint, apiKey, keyName := other.URL, testAPIKey, "k8s-secondary"
+		config.Secondary = &pluginConfig{SdkmsEndpoint: &endpoint, ApiKey: &apiKey, KeyName: &keyName}
+	})
+	ctx := requestContext(t)
+	encrypted, err := client.Encrypt(ctx, &EncryptRequest{Plaintext: []byte("dek")})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dsm.SetFaults(dsmtest.Faults{StatusCode: http.StatusServiceUnavailable})
+	decrypted, err := client.Decrypt(ctx, &DecryptRequest{Ciphertext: encrypted.Ciphertext, KeyId: encrypted.KeyId})
+	if err != nil || string(decrypted.Plaintext) != "dek" {
+		t.Fatalf("got %v, %v", decrypted, err)
+	}
+	usage := registeredUsage.snapshot()
+	if usage[secondaryKid].Decrypts != 1 || usage[kid].Decrypts != 0 {
+		t.Fatalf("got usage %+v, want one decrypt with the secondary key", usage)
+	}
+}
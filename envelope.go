@@ -0,0 +1,214 @@
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"strconv"
+
+	"github.com/fxamacker/cbor/v2"
+	"google.golang.org/grpc/codes"
+)
+
+// Envelope versions written into the ciphertext returned by Encrypt.
+const (
+	// envelopeVersionLegacy is AES GCM without AAD, encoded with field names.
+	envelopeVersionLegacy = 1
+	// envelopeVersionDual is envelopeVersionLegacy with a secondary key.
+	envelopeVersionDual = 2
+	// envelopeVersionCompact is AES GCM without AAD, encoded with integer
+	// keys and a binary KID. The secondary key is optional.
+	envelopeVersionCompact = 3
+)
+
+// KMS v2 requires ciphertext and key_id to be less than 1 kB.
+const (
+	maxCiphertextSize = 1024
+	maxKeyIDSize      = 1024
+)
+
+// AES-GCM parameters used by every backend.
+const (
+	envelopeIVSize  = 12
+	envelopeTagSize = 16
+)
+
+// strictDecMode decodes ciphertext read from storage, which is not trusted:
+// it rejects duplicate map keys, indefinite-length items, tags, unknown
+// fields and anything nested deeper than an envelope with a secondary key.
+var strictDecMode = func() cbor.DecMode {
+	mode, err := cbor.DecOptions{
+		DupMapKey:         cbor.DupMapKeyEnforcedAPF,
+		IndefLength:       cbor.IndefLengthForbidden,
+		TagsMd:            cbor.TagsForbidden,
+		MaxNestedLevels:   4,
+		MaxArrayElements:  16,
+		MaxMapPairs:       16,
+		ExtraReturnErrors: cbor.ExtraDecErrorUnknownField,
+		FieldNameMatching: cbor.FieldNameMatchingCaseSensitive,
+		UTF8:              cbor.UTF8RejectInvalid,
+	}.DecMode()
+	if err != nil {
+		panic(err)
+	}
+	return mode
+}()
+
+// compactEnvelope is the encoding of envelopeVersionCompact. Key 0 holds
+// the version in every envelope format that uses integer keys, so new
+// fields can be given new keys.
+type compactEnvelope struct {
+	Version   int              `cbor:"0,keyasint"`
+	KID       []byte           `cbor:"1,keyasint,omitempty"` // binary UUID
+	Cipher    []byte           `cbor:"2,keyasint"`
+	IV        []byte           `cbor:"3,keyasint"`
+	Tag       []byte           `cbor:"4,keyasint"`
+	Secondary *compactEnvelope `cbor:"5,keyasint,omitempty"`
+	// KIDText holds the KID if it is not a canonical UUID.
+	KIDText string `cbor:"6,keyasint,omitempty"`
+}
+
+// marshalEnvelope serializes data in the compact or the legacy format.
+func marshalEnvelope(data *wrappedData, compact bool) ([]byte, error) {
+	if compact {
+		return cbor.Marshal(toCompactEnvelope(data))
+	}
+	data.Version = envelopeVersionLegacy
+	if data.Secondary != nil {
+		data.Version = envelopeVersionDual
+	}
+	return cbor.Marshal(data)
+}
+
+// unmarshalEnvelope parses ciphertext written in any supported format and
+// checks it before any of it is sent to a backend.
+func unmarshalEnvelope(ciphertext []byte) (*wrappedData, error) {
+	if len(ciphertext) >= maxCiphertextSize {
+		return nil, invalidEnvelopeError("ciphertext is %v bytes, it must be less than %v", len(ciphertext), maxCiphertextSize)
+	}
+	// Compact envelopes have integer keys and legacy ones field names, so
+	// look at the keys before decoding into either struct.
+	var fields map[interface{}]cbor.RawMessage
+	if err := strictDecMode.Unmarshal(ciphertext, &fields); err != nil {
+		return nil, invalidEnvelopeError("failed to deserialize wrapped cipher data: %v", err)
+	}
+	var data *wrappedData
+	if _, ok := fields[uint64(0)]; ok {
+		var compact compactEnvelope
+		if err := strictDecMode.Unmarshal(ciphertext, &compact); err != nil {
+			return nil, invalidEnvelopeError("failed to deserialize wrapped cipher data: %v", err)
+		}
+		if compact.Version != envelopeVersionCompact {
+			return nil, unknownVersionError(compact.Version)
+		}
+		if compact.Secondary != nil && compact.Secondary.Version != envelopeVersionCompact {
+			return nil, unknownVersionError(compact.Secondary.Version)
+		}
+		data = fromCompactEnvelope(&compact)
+	} else {
+		data = new(wrappedData)
+		if err := strictDecMode.Unmarshal(ciphertext, data); err != nil {
+			return nil, invalidEnvelopeError("failed to deserialize wrapped cipher data: %v", err)
+		}
+		switch data.Version {
+		case envelopeVersionLegacy:
+			if data.Secondary != nil {
+				return nil, invalidEnvelopeError("version %v wrapped cipher data has a secondary key", data.Version)
+			}
+		case envelopeVersionDual:
+			if data.Secondary == nil {
+				return nil, invalidEnvelopeError("wrapped cipher data lacks the secondary key")
+			}
+			// Legacy secondary key data is written without a version.
+			if data.Secondary.Version != 0 {
+				return nil, unknownVersionError(data.Secondary.Version)
+			}
+		default:
+			return nil, unknownVersionError(data.Version)
+		}
+	}
+	if err := data.check(); err != nil {
+		return nil, err
+	}
+	if data.Secondary != nil {
+		if data.Secondary.Secondary != nil {
+			return nil, invalidEnvelopeError("secondary key data must not be nested")
+		}
+		if err := data.Secondary.check(); err != nil {
+			return nil, err
+		}
+	}
+	return data, nil
+}
+
+// check validates the fields every backend relies on.
+func (d *wrappedData) check() error {
+	switch {
+	case d.KID == "":
+		return invalidEnvelopeError("wrapped cipher data has no key ID")
+	case len(d.Cipher) == 0:
+		return invalidEnvelopeError("wrapped cipher data has no cipher")
+	case len(d.IV) != envelopeIVSize:
+		return invalidEnvelopeError("invalid IV length %v, expected %v", len(d.IV), envelopeIVSize)
+	case len(d.Tag) != envelopeTagSize:
+		return invalidEnvelopeError("invalid tag length %v, expected %v", len(d.Tag), envelopeTagSize)
+	}
+	return nil
+}
+
+func invalidEnvelopeError(format string, args ...interface{}) error {
+	return newPluginError(codes.InvalidArgument, reasonInvalidCiphertext, nil, "%v", fmt.Sprintf(format, args...))
+}
+
+func unknownVersionError(version int) error {
+	return newPluginError(codes.InvalidArgument, reasonUnknownVersion,
+		map[string]string{metadataEnvelopeVersion: strconv.Itoa(version)},
+		"unknown version for wrapped cipher data: %v", version)
+}
+
+func toCompactEnvelope(data *wrappedData) *compactEnvelope {
+	c := &compactEnvelope{
+		Version: envelopeVersionCompact,
+		Cipher:  data.Cipher,
+		IV:      data.IV,
+		Tag:     data.Tag,
+	}
+	if id, ok := parseUUID(data.KID); ok {
+		c.KID = id
+	} else {
+		c.KIDText = data.KID
+	}
+	if data.Secondary != nil {
+		c.Secondary = toCompactEnvelope(data.Secondary)
+	}
+	return c
+}
+
+func fromCompactEnvelope(c *compactEnvelope) *wrappedData {
+	data := &wrappedData{
+		Version: c.Version,
+		KID:     c.KIDText,
+		Cipher:  c.Cipher,
+		IV:      c.IV,
+		Tag:     c.Tag,
+	}
+	if len(c.KID) == 16 {
+		data.KID = formatUUID(c.KID)
+	}
+	if c.Secondary != nil {
+		data.Secondary = fromCompactEnvelope(c.Secondary)
+	}
+	return data
+}
+
+// parseUUID returns the binary form of kid if it is a UUID in the
+// canonical lower case form, so that formatUUID restores it exactly.
+func parseUUID(kid string) ([]byte, bool) {
+	if len(kid) != 36 {
+		return nil, false
+	}
+	id, err := hex.DecodeString(kid[0:8] + kid[9:13] + kid[14:18] + kid[19:23] + kid[24:36])
+	if err != nil || formatUUID(id) != kid {
+		return nil, false
+	}
+	return id, true
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/fxamacker/cbor/v2"
+)
+
+func TestUnmarshalEnvelopeSecondaryVersion(t *testing.T) {
+	secondary := &wrappedData{KID: "k2", Cipher: []byte{1}, IV: make([]byte, envelopeIVSize), Tag: make([]byte, envelopeTagSize)}
+	data := &wrappedData{KID: "k1", Cipher: []byte{1}, IV: make([]byte, envelopeIVSize), Tag: make([]byte, envelopeTagSize), Secondary: secondary}
+
+	secondary.Version = envelopeVersionCompact
+	legacy, _ := marshalEnvelope(data, false)
+	if _, err := unmarshalEnvelope(legacy); err == nil {
+		t.Fatal("legacy secondary key data with a version was accepted")
+	}
+
+	compact := toCompactEnvelope(data)
+	compact.Secondary.Version = envelopeVersionLegacy
+	ciphertext, _ := cbor.Marshal(compact)
+	if _, err := unmarshalEnvelope(ciphertext); err == nil {
+		t.Fatal("compact secondary key data with version 1 was accepted")
+	}
+}
+
+// FuzzUnmarshalEnvelope checks that unmarshalEnvelope never panics, and that
+// whatever it accepts passes check and survives being encoded again.
+func FuzzUnmarshalEnvelope(f *testing.F) {
+	for _, v := range loadGoldenVectors(f) {
+		f.Add(v.Ciphertext)
+	}
+	f.Fuzz(func(t *testing.T, ciphertext []byte) {
+		data, err := unmarshalEnvelope(ciphertext)
+		if err != nil {
+			return
+		}
+		if err := data.check(); err != nil {
+			t.Fatalf("accepted invalid envelope: %v", err)
+		}
+		if data.Secondary != nil {
+			if err := data.Secondary.check(); err != nil {
+				t.Fatalf("accepted invalid secondary key data: %v", err)
+			}
+		}
+		encoded, err := marshalEnvelope(data, data.Version == envelopeVersionCompact)
+		if err != nil {
+			t.Fatal(err)
+		}
+		again, err := unmarshalEnvelope(encoded)
+		if err != nil {
+			t.Fatalf("re-encoded envelope was rejected: %v", err)
+		}
+		if again.KID != data.KID || !bytes.Equal(again.Cipher, data.Cipher) {
+			t.Fatalf("got %+v after encoding %+v again", again, data)
+		}
+	})
+}
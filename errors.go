@@ -0,0 +1,201 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+
+	"github.com/fortanix/k8s-sdkms-plugin/kmip"
+	"github.com/fortanix/sdkms-client-go/sdkms"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// errorDomain is reported in the ErrorInfo detail of every gRPC error
+// returned by the plugin.
+const errorDomain = "k8s-sdkms-plugin"
+
+// Reasons reported in the ErrorInfo detail of gRPC errors. These are meant
+// to be stable so that alerts can match on them.
+const (
+	reasonInvalidCiphertext   = "INVALID_CIPHERTEXT"
+	reasonUnknownVersion      = "UNKNOWN_ENVELOPE_VERSION"
+	reasonKeyIDMismatch       = "KEY_ID_MISMATCH"
+	reasonCiphertextTooLarge  = "CIPHERTEXT_TOO_LARGE"
+	reasonKeyNotAllowed       = "KEY_NOT_ALLOWED"
+	reasonKeyPinMismatch      = "KEY_PIN_MISMATCH"
+	reasonKeyUsageLimit       = "KEY_USAGE_LIMIT"
+	reasonKeyOutsideGroup     = "KEY_OUTSIDE_GROUP"
+	reasonPeerNotAllowed      = "PEER_NOT_ALLOWED"
+	reasonDsmUnauthenticated  = "DSM_UNAUTHENTICATED"
+	reasonDsmPermissionDenied = "DSM_PERMISSION_DENIED"
+	reasonDsmKeyNotFound      = "DSM_KEY_NOT_FOUND"
+	reasonDsmApprovalRequired = "DSM_APPROVAL_REQUIRED"
+	reasonDsmApprovalPending  = "DSM_APPROVAL_PENDING"
+	reasonDsmApprovalDenied   = "DSM_APPROVAL_DENIED"
+	reasonDsmRejected         = "DSM_REJECTED"
+	reasonDsmRateLimited      = "DSM_RATE_LIMITED"
+	reasonDsmUnavailable      = "DSM_UNAVAILABLE"
+	reasonDsmInvalidResponse  = "DSM_INVALID_RESPONSE"
+	reasonDeadlineExceeded    = "DEADLINE_EXCEEDED"
+	reasonCanceled            = "CANCELED"
+	reasonInternal            = "INTERNAL"
+	reasonUnknown             = "UNKNOWN"
+)
+
+// Metadata keys reported in the ErrorInfo detail of gRPC errors.
+const (
+	metadataDsmStatus       = "dsm_status"
+	metadataKmipReason      = "kmip_reason"
+	metadataExpectedKeyID   = "expected_key_id"
+	metadataFoundKeyID      = "found_key_id"
+	metadataEnvelopeVersion = "envelope_version"
+	metadataOperation       = "operation"
+	metadataApprovalRequest = "approval_request_id"
+	metadataPkcs11Code      = "pkcs11_code"
+)
+
+// pluginError is an error that already knows which gRPC code it maps to.
+type pluginError struct {
+	code     codes.Code
+	reason   string
+	metadata map[string]string
+	err      error
+}
+
+func (e *pluginError) Error() string { return e.err.Error() }
+func (e *pluginError) Unwrap() error { return e.err }
+
+func newPluginError(code codes.Code, reason string, metadata map[string]string, format string, args ...interface{}) error {
+	return &pluginError{
+		code:     code,
+		reason:   reason,
+		metadata: metadata,
+		err:      fmt.Errorf(format, args...),
+	}
+}
+
+// toStatusError converts err into a gRPC status error with an ErrorInfo
+// detail, so that the apiserver can tell a broken key apart from a network
+// outage. Errors that are already gRPC status errors are returned as is.
+func toStatusError(operation string, err error) error {
+	if err == nil {
+		return nil
+	}
+	if _, ok := status.FromError(err); ok {
+		return err
+	}
+	code, reason, metadata := classifyError(err)
+	if metadata == nil {
+		metadata = make(map[string]string)
+	}
+	metadata[metadataOperation] = operation
+	st := status.New(code, err.Error())
+	if detailed, detailErr := st.WithDetails(&errdetails.ErrorInfo{
+		Reason:   reason,
+		Domain:   errorDomain,
+		Metadata: metadata,
+	}); detailErr == nil {
+		st = detailed
+	}
+	return st.Err()
+}
+
+// classifyModuleError classifies the errors of the PKCS#11 backend, which
+// is only compiled in builds with cgo.
+var classifyModuleError func(err error) (codes.Code, string, map[string]string, bool)
+
+func classifyError(err error) (codes.Code, string, map[string]string) {
+	var pluginErr *pluginError
+	if errors.As(err, &pluginErr) {
+		return pluginErr.code, pluginErr.reason, copyMetadata(pluginErr.metadata)
+	}
+	for cause := err; cause != nil; cause = pkgCause(cause) {
+		switch {
+		case errors.Is(cause, context.DeadlineExceeded):
+			return codes.DeadlineExceeded, reasonDeadlineExceeded, nil
+		case errors.Is(cause, context.Canceled):
+			return codes.Canceled, reasonCanceled, nil
+		}
+		var backendErr *sdkms.BackendError
+		if errors.As(cause, &backendErr) {
+			return classifyBackendError(backendErr)
+		}
+		var kmipErr *kmip.Error
+		if errors.As(cause, &kmipErr) {
+			return classifyKmipError(kmipErr)
+		}
+		if classifyModuleError != nil {
+			if code, reason, metadata, ok := classifyModuleError(cause); ok {
+				return code, reason, metadata
+			}
+		}
+		var netErr net.Error
+		if errors.As(cause, &netErr) {
+			if netErr.Timeout() {
+				return codes.DeadlineExceeded, reasonDeadlineExceeded, nil
+			}
+			return codes.Unavailable, reasonDsmUnavailable, nil
+		}
+	}
+	return codes.Unknown, reasonUnknown, nil
+}
+
+func classifyBackendError(err *sdkms.BackendError) (codes.Code, string, map[string]string) {
+	metadata := map[string]string{metadataDsmStatus: strconv.Itoa(err.StatusCode)}
+	switch {
+	case isApprovalRequired(err):
+		return codes.FailedPrecondition, reasonDsmApprovalRequired, metadata
+	case err.StatusCode == 401:
+		return codes.Unauthenticated, reasonDsmUnauthenticated, metadata
+	case err.StatusCode == 403:
+		return codes.PermissionDenied, reasonDsmPermissionDenied, metadata
+	case err.StatusCode == 404:
+		return codes.FailedPrecondition, reasonDsmKeyNotFound, metadata
+	case err.StatusCode == 429:
+		return codes.ResourceExhausted, reasonDsmRateLimited, metadata
+	case err.StatusCode >= 500:
+		return codes.Unavailable, reasonDsmUnavailable, metadata
+	case err.StatusCode >= 400:
+		return codes.FailedPrecondition, reasonDsmRejected, metadata
+	}
+	return codes.Unknown, reasonUnknown, metadata
+}
+
+func classifyKmipError(err *kmip.Error) (codes.Code, string, map[string]string) {
+	metadata := map[string]string{metadataKmipReason: fmt.Sprintf("%#x", err.Reason)}
+	switch err.Reason {
+	case kmip.ResultReasonItemNotFound:
+		return codes.FailedPrecondition, reasonDsmKeyNotFound, metadata
+	case kmip.ResultReasonAuthenticationFailed:
+		return codes.Unauthenticated, reasonDsmUnauthenticated, metadata
+	case kmip.ResultReasonPermissionDenied:
+		return codes.PermissionDenied, reasonDsmPermissionDenied, metadata
+	case kmip.ResultReasonCryptographicFailure:
+		return codes.InvalidArgument, reasonInvalidCiphertext, metadata
+	}
+	return codes.FailedPrecondition, reasonDsmRejected, metadata
+}
+
+// pkgCause returns the error wrapped by err using the github.com/pkg/errors
+// convention, which the sdkms client uses for transport errors and which
+// the standard library does not see through.
+func pkgCause(err error) error {
+	if c, ok := err.(interface{ Cause() error }); ok {
+		if cause := c.Cause(); cause != err {
+			return cause
+		}
+	}
+	return nil
+}
+
+func copyMetadata(m map[string]string) map[string]string {
+	c := make(map[string]string, len(m))
+	for k, v := range m {
+		c[k] = v
+	}
+	return c
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/fortanix/sdkms-client-go/sdkms"
+)
+
+const (
+	// localKeyLifetime is how long an exported key is used before it is
+	// exported again, so that changes to the key in DSM are picked up even
+	// if the key monitor misses them.
+	localKeyLifetime = 15 * time.Minute
+	// localExportRetry is how long a failed export is remembered, during
+	// which every request goes straight to DSM.
+	localExportRetry = time.Minute
+)
+
+// localCrypto implements the opt-in `local_crypto` mode of dsmBackend: the
+// key is exported from DSM once per lifetime and AES-GCM is done
+// in-process, producing the same wrappedData as DSM would. Only the raw key
+// bytes are locked in memory: the AES key schedule inside aead and the
+// copies left behind by decoding the JSON export response live on the Go
+// heap, which can be swapped out and is not zeroed. Callers fall back to
+// DSM whenever local crypto fails.
+type localCrypto struct {
+	exportMu sync.Mutex // serializes exports
+
+	mu         sync.Mutex
+	current    *exportedKey
+	keys       map[string]*exportedKey
+	failure    error     // the last export failure, if any
+	failed     time.Time // when the export failed
+	generation int       // incremented whenever keys are dropped
+	now        func() time.Time
+}
+
+type exportedKey struct {
+	kid      string
+	value    []byte
+	aead     cipher.AEAD
+	exported time.Time
+}
+
+func newLocalCrypto() *localCrypto {
+	return &localCrypto{keys: make(map[string]*exportedKey), now: time.Now}
+}
+
+// wrap encrypts plain with the exported key, exporting it first if needed.
+func (l *localCrypto) wrap(ctx context.Context, b *dsmBackend, plain []byte) (*wrappedData, error) {
+	key, err := l.currentKey(ctx, b)
+	if err != nil {
+		return nil, err
+	}
+	iv := make([]byte, key.aead.NonceSize())
+	if _, err := rand.Read(iv); err != nil {
+		return nil, err
+	}
+	sealed := key.aead.Seal(nil, iv, plain, nil)
+	split := len(sealed) - key.aead.Overhead()
+	return &wrappedData{
+		KID:    key.kid,
+		Cipher: sealed[:split],
+		IV:     iv,
+		Tag:    sealed[split:],
+	}, nil
+}
+
+// unwrap decrypts data if it was wrapped with a key that has been exported
+// within its lifetime.
+func (l *localCrypto) unwrap(data *wrappedData) ([]byte, error) {
+	l.mu.Lock()
+	key, ok := l.keys[data.KID]
+	if ok && l.expiredLocked(key) {
+		l.dropLocked(key)
+		ok = false
+	}
+	l.mu.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("key %v has not been exported", data.KID)
+	}
+	if len(data.IV) != key.aead.NonceSize() || len(data.Tag) != key.aead.Overhead() {
+		return nil, errors.New("unexpected IV or tag length")
+	}
+	sealed := make([]byte, 0, len(data.Cipher)+len(data.Tag))
+	sealed = append(append(sealed, data.Cipher...), data.Tag...)
+	return key.aead.Open(nil, data.IV, sealed, nil)
+}
+
+// reset makes the next wrap export the configured key again, e.g. after it
+// was rotated. Keys exported before are kept for unwrap.
+func (l *localCrypto) reset() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.current, l.failure = nil, nil
+	l.generation++
+}
+
+// retain drops every exported key but kid, e.g. once the key monitor sees
+// that the configured key changed, so that a key DSM rotated out is no
+// longer used. With an empty kid, e.g. because the key is disabled, every
+// key is dropped.
+func (l *localCrypto) retain(kid string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, key := range l.keys {
+		if key.kid != kid {
+			log.Printf("Dropping key %v exported for local crypto", key.kid)
+			l.dropLocked(key)
+		}
+	}
+	l.failure = nil
+	l.generation++
+}
+
+func (l *localCrypto) expiredLocked(key *exportedKey) bool {
+	return l.now().Sub(key.exported) >= localKeyLifetime
+}
+
+// dropLocked forgets key and wipes its material.
+func (l *localCrypto) dropLocked(key *exportedKey) {
+	if l.keys[key.kid] == key {
+		delete(l.keys, key.kid)
+	}
+	if l.current == key {
+		l.current = nil
+	}
+	zero(key.value)
+	munlock(key.value)
+}
+
+func (l *localCrypto) currentKey(ctx context.Context, b *dsmBackend) (*exportedKey, error) {
+	l.exportMu.Lock()
+	defer l.exportMu.Unlock()
+	l.mu.Lock()
+	if key := l.current; key != nil {
+		if !l.expiredLocked(key) {
+			l.mu.Unlock()
+			return key, nil
+		}
+		l.dropLocked(key)
+	}
+	if l.failure != nil && l.now().Sub(l.failed) < localExportRetry {
+		err := l.failure
+		l.mu.Unlock()
+		return nil, err
+	}
+	generation := l.generation
+	l.mu.Unlock()
+
+	key, err := b.exportKey(ctx)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if err != nil {
+		l.failure, l.failed = err, l.now()
+		return nil, err
+	}
+	key.exported = l.now()
+	if l.generation != generation {
+		// The key changed while it was exported.
+		zero(key.value)
+		munlock(key.value)
+		return nil, errors.New("key changed during export")
+	}
+	if old, ok := l.keys[key.kid]; ok {
+		l.dropLocked(old)
+	}
+	l.current, l.failure = key, nil
+	l.keys[key.kid] = key
+	log.Printf("Exported key %v from DSM for local crypto", key.kid)
+	return key, nil
+}
+
+// keyChanged drops the keys exported for local crypto other than kid, the
+// configured key as the key monitor last saw it.
+func (b *dsmBackend) keyChanged(kid string) {
+	if b.local != nil {
+		b.local.retain(kid)
+	}
+}
+
+// keyDisabled drops every key exported for local crypto, so that requests
+// go to DSM, which enforces the key's state.
+func (b *dsmBackend) keyDisabled() {
+	if b.local != nil {
+		b.local.retain("")
+	}
+}
+
+// exportKey exports the configured key, after checking that its policy
+// allows export.
+func (b *dsmBackend) exportKey(ctx context.Context) (*exportedKey, error) {
+	key, err := b.getSobject(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkExportable(key); err != nil {
+		return nil, err
+	}
+	client := b.config.makeClient()
+	var exported *sdkms.Sobject
+	err = b.config.withDsmContext(ctx, func(ctx context.Context) (err error) {
+		exported, err = client.ExportSobject(ctx, *sdkms.SobjectByID(*key.Kid))
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to export key: %v", err)
+	}
+	if exported.Value == nil {
+		return nil, errors.New("DSM returned no key material on export")
+	}
+	value := *exported.Value
+	if err := mlock(value); err != nil {
+		zero(value)
+		return nil, fmt.Errorf("failed to lock key material in memory: %v", err)
+	}
+	block, err := aes.NewCipher(value)
+	if err != nil {
+		zero(value)
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		zero(value)
+		return nil, err
+	}
+	return &exportedKey{kid: *key.Kid, value: value, aead: aead}, nil
+}
+
+func checkExportable(key *sdkms.Sobject) error {
+	if key.Kid == nil {
+		return errors.New("DSM returned a key without kid")
+	}
+	if key.NeverExportable != nil && *key.NeverExportable {
+		return errors.New("key is marked as never exportable")
+	}
+	if key.KeyOps&sdkms.KeyOperationsExport == 0 {
+		return errors.New("key policy does not allow the EXPORT operation")
+	}
+	return nil
+}
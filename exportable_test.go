@@ -0,0 +1,177 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	"github.com/fortanix/k8s-sdkms-plugin/dsmtest"
+	"github.com/fortanix/sdkms-client-go/sdkms"
+)
+
+func allowExport(dsm *dsmtest.Server, kid string) {
+	dsm.UpdateKey(kid, func(sobject *sdkms.Sobject) { sobject.KeyOps |= sdkms.KeyOperationsExport })
+}
+
+// newLocalCryptoTest returns a backend in `local_crypto` mode for the
+// exportable key "k8s", and a key monitor wired to it like startServer
+// does.
+func newLocalCryptoTest(t *testing.T) (*dsmtest.Server, string, *dsmBackend, *keyMonitor) {
+	t.Helper()
+	dsm := dsmtest.NewServer(testAPIKey)
+	t.Cleanup(dsm.Close)
+	kid := dsm.AddKey("k8s")
+	allowExport(dsm, kid)
+	b := newTestDsmBackend(dsm, func(config *pluginConfig) {
+		local := true
+		config.LocalCrypto = &local
+	})
+	m := newTestMonitor(b)
+	m.onKeyChange = b.keyChanged
+	m.onKeyDisabled = b.keyDisabled
+	m.refreshKey()
+	return dsm, kid, b, m
+}
+
+// remoteCalls returns the number of encrypt, decrypt and export requests
+// made to dsm.
+func remoteCalls(dsm *dsmtest.Server) (crypto, exports int) {
+	return dsm.Requests("/crypto/v1/encrypt") + dsm.Requests("/crypto/v1/decrypt"), dsm.Requests("/crypto/v1/keys/export")
+}
+
+func TestLocalCryptoRoundTrip(t *testing.T) {
+	dsm, kid, b, _ := newLocalCryptoTest(t)
+	ctx := context.Background()
+	for i := 0; i < 3; i++ {
+		wrapped, err := b.Wrap(ctx, []byte("dek"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if wrapped.KID != kid {
+			t.Fatalf("wrapped with key %v, want %v", wrapped.KID, kid)
+		}
+		plain, err := b.Unwrap(ctx, wrapped)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(plain, []byte("dek")) {
+			t.Fatalf("got %q", plain)
+		}
+	}
+	if crypto, exports := remoteCalls(dsm); crypto != 0 || exports != 1 {
+		t.Fatalf("%v crypto requests and %v exports to DSM, want 0 and 1", crypto, exports)
+	}
+}
+
+func TestLocalCryptoFollowsRotation(t *testing.T) {
+	dsm, kid, b, m := newLocalCryptoTest(t)
+	ctx := context.Background()
+	old, err := b.Wrap(ctx, []byte("dek"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	exported := b.local.keys[kid].value
+
+	rotated, err := dsm.Rotate("k8s")
+	if err != nil {
+		t.Fatal(err)
+	}
+	allowExport(dsm, rotated)
+	m.refreshKey()
+	if !bytes.Equal(exported, make([]byte, len(exported))) {
+		t.Fatal("the key rotated out was not zeroed")
+	}
+	wrapped, err := b.Wrap(ctx, []byte("dek"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if wrapped.KID != rotated {
+		t.Fatalf("wrapped with key %v after rotation, want %v", wrapped.KID, rotated)
+	}
+	// The old key is no longer used locally, DSM decrypts with it.
+	if _, err := b.Unwrap(ctx, old); err != nil {
+		t.Fatal(err)
+	}
+	if n := dsm.Requests("/crypto/v1/decrypt"); n != 1 {
+		t.Fatalf("%v decrypt requests to DSM, want 1", n)
+	}
+}
+
+func TestLocalCryptoDisabledKey(t *testing.T) {
+	dsm, kid, b, m := newLocalCryptoTest(t)
+	ctx := context.Background()
+	wrapped, err := b.Wrap(ctx, []byte("dek"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dsm.SetEnabled(kid, false)
+	m.refreshKey()
+	if _, err := b.Wrap(ctx, []byte("dek")); !isKeyDisabledError(err) {
+		t.Fatalf("Wrap with a disabled key got %v", err)
+	}
+	if _, err := b.Unwrap(ctx, wrapped); !isKeyDisabledError(err) {
+		t.Fatalf("Unwrap with a disabled key got %v", err)
+	}
+	if crypto, _ := remoteCalls(dsm); crypto != 2 {
+		t.Fatalf("%v crypto requests to DSM, want 2", crypto)
+	}
+}
+
+func TestLocalCryptoKeyLifetime(t *testing.T) {
+	dsm, _, b, _ := newLocalCryptoTest(t)
+	ctx := context.Background()
+	now := time.Now()
+	b.local.now = func() time.Time { return now }
+	wrapped, err := b.Wrap(ctx, []byte("dek"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now = now.Add(localKeyLifetime)
+	if _, err := b.local.unwrap(wrapped); err == nil {
+		t.Fatal("a key past its lifetime was used to unwrap")
+	}
+	if _, err := b.Wrap(ctx, []byte("dek")); err != nil {
+		t.Fatal(err)
+	}
+	if _, exports := remoteCalls(dsm); exports != 2 {
+		t.Fatalf("%v exports, want the key exported again", exports)
+	}
+}
+
+func TestLocalCryptoExportFailure(t *testing.T) {
+	dsm, kid, b, _ := newLocalCryptoTest(t)
+	ctx := context.Background()
+	now := time.Now()
+	b.local.now = func() time.Time { return now }
+	dsm.UpdateKey(kid, func(sobject *sdkms.Sobject) { sobject.KeyOps &^= sdkms.KeyOperationsExport })
+
+	infos := dsm.Requests("/crypto/v1/keys/info")
+	for i := 0; i < 3; i++ {
+		if _, err := b.Wrap(ctx, []byte("dek")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Only the first Wrap tried to export, the others went to DSM directly.
+	if n := dsm.Requests("/crypto/v1/keys/info") - infos; n != 1 {
+		t.Fatalf("%v key lookups for 3 Wrap calls, want 1", n)
+	}
+	infos = dsm.Requests("/crypto/v1/keys/info")
+	if crypto, _ := remoteCalls(dsm); crypto != 3 {
+		t.Fatalf("%v crypto requests to DSM, want 3", crypto)
+	}
+
+	allowExport(dsm, kid)
+	now = now.Add(localExportRetry)
+	if _, err := b.Wrap(ctx, []byte("dek")); err != nil {
+		t.Fatal(err)
+	}
+	if n := dsm.Requests("/crypto/v1/keys/info"); n != infos+1 {
+		t.Fatalf("%v key lookups after the retry interval, want 1", n-infos)
+	}
+	if crypto, exports := remoteCalls(dsm); crypto != 3 || exports != 1 {
+		t.Fatalf("%v crypto requests and %v exports, want the key exported again", crypto, exports)
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+var goldenDir = filepath.Join("testdata", "golden")
+
+// goldenVector is a ciphertext in an envelope format that a plugin release
+// wrote, kept in testdata/golden so that changes to the envelope codec
+// which break existing secrets fail the tests.
+type goldenVector struct {
+	Name          string `json:"name"`
+	PluginVersion string `json:"plugin_version"`
+	// Synthetic vectors were written by later code in the format of
+	// PluginVersion, not by that release itself.
+	Synthetic       bool `json:"synthetic,omitempty"`
+	EnvelopeVersion int  `json:"envelope_version"`
+	Compact         bool `json:"compact"`
+	// Key files hold base64 local KEKs, relative to goldenDir.
+	KeyFile          string `json:"key_file"`
+	SecondaryKeyFile string `json:"secondary_key_file,omitempty"`
+	Plaintext        []byte `json:"plaintext"`
+	Ciphertext       []byte `json:"ciphertext"`
+}
+
+func loadGoldenVectors(tb testing.TB) []goldenVector {
+	tb.Helper()
+	content, err := os.ReadFile(filepath.Join(goldenDir, "vectors.json"))
+	if err != nil {
+		tb.Fatal(err)
+	}
+	var vectors []goldenVector
+	if err := json.Unmarshal(content, &vectors); err != nil {
+		tb.Fatalf("failed to parse vectors.json: %v", err)
+	}
+	if len(vectors) == 0 {
+		tb.Fatal("no golden vectors")
+	}
+	return vectors
+}
+
+// TestGoldenVectors decodes and decrypts every golden vector, and checks
+// that encoding the decoded envelope again reproduces the ciphertext byte
+// for byte.
+func TestGoldenVectors(t *testing.T) {
+	for _, v := range loadGoldenVectors(t) {
+		t.Run(v.Name, func(t *testing.T) {
+			data, err := unmarshalEnvelope(v.Ciphertext)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if data.Version != v.EnvelopeVersion {
+				t.Fatalf("decoded envelope version %v, expected %v", data.Version, v.EnvelopeVersion)
+			}
+			checkGoldenUnwrap(t, v.KeyFile, data, v.Plaintext)
+			if (v.SecondaryKeyFile != "") != (data.Secondary != nil) {
+				t.Fatal("secondary key data does not match the vector")
+			}
+			if data.Secondary != nil {
+				checkGoldenUnwrap(t, v.SecondaryKeyFile, data.Secondary, v.Plaintext)
+			}
+			encoded, err := marshalEnvelope(data, v.Compact)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(encoded, v.Ciphertext) {
+				t.Fatalf("encoding the envelope again gives %x", encoded)
+			}
+		})
+	}
+}
+
+func checkGoldenUnwrap(t *testing.T, keyFile string, data *wrappedData, expected []byte) {
+	t.Helper()
+	content, err := os.ReadFile(filepath.Join(goldenDir, keyFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	kek, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(content)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	backend, err := newLocalKekBackendWithKey(kek)
+	if err != nil {
+		t.Fatal(err)
+	}
+	plain, err := backend.Unwrap(context.Background(), data)
+	if err != nil {
+		t.Fatalf("%v: %v", keyFile, err)
+	}
+	if !bytes.Equal(plain, expected) {
+		t.Fatalf("%v: decrypted %x, expected %x", keyFile, plain, expected)
+	}
+}
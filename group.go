@@ -0,0 +1,201 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/fortanix/sdkms-client-go/sdkms"
+	"google.golang.org/grpc/codes"
+)
+
+// keyResolveInterval is how long the key that `key_name` resolves to in
+// the configured group is used before it is looked up again, so that
+// rotations are picked up.
+const keyResolveInterval = 30 * time.Second
+
+// keyGroup restricts the keys the plugin uses to one DSM group, given by
+// `group_id` or `group_name`. Names are resolved within the group rather
+// than across every group the app can access.
+type keyGroup struct {
+	mu       sync.Mutex
+	id       string // empty until `group_name` is resolved
+	kid      string // the key `key_name` resolved to
+	resolved time.Time
+	members  map[string]bool // KIDs known to be in the group
+}
+
+func newKeyGroup(config pluginConfig) *keyGroup {
+	if config.GroupID == nil && config.GroupName == nil {
+		return nil
+	}
+	g := &keyGroup{members: make(map[string]bool)}
+	if config.GroupID != nil {
+		g.id = *config.GroupID
+	}
+	return g
+}
+
+// groupIDLocked returns the ID of the configured group, looking it up by
+// name the first time if needed.
+func (b *dsmBackend) groupIDLocked(ctx context.Context) (string, error) {
+	g := b.group
+	if g.id != "" {
+		return g.id, nil
+	}
+	client := b.config.makeClient()
+	var groups []sdkms.Group
+	err := b.config.withDsmContext(ctx, func(ctx context.Context) (err error) {
+		groups, err = client.ListGroups(ctx, nil)
+		return err
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to list groups: %v", err)
+	}
+	var ids []string
+	for _, group := range groups {
+		if group.Name == *b.config.GroupName {
+			ids = append(ids, group.GroupID)
+		}
+	}
+	switch len(ids) {
+	case 0:
+		return "", fmt.Errorf("no group named %q", *b.config.GroupName)
+	case 1:
+		g.id = ids[0]
+		return g.id, nil
+	}
+	return "", fmt.Errorf("%v groups are named %q", len(ids), *b.config.GroupName)
+}
+
+// keyDescriptor returns the descriptor of the configured key. With a
+// group, a key name is resolved to the ID of the key of that name in the
+// group, and a key ID must belong to the group.
+func (b *dsmBackend) keyDescriptor(ctx context.Context) (*sdkms.SobjectDescriptor, error) {
+	if b.group == nil {
+		return b.config.makeSobjectDescriptor(), nil
+	}
+	if b.config.KeyName == nil {
+		if err := b.checkDecryptKeyGroup(ctx, *b.config.KeyID); err != nil {
+			return nil, err
+		}
+		return b.config.makeSobjectDescriptor(), nil
+	}
+	g := b.group
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.kid != "" && time.Since(g.resolved) < keyResolveInterval {
+		return sdkms.SobjectByID(g.kid), nil
+	}
+	group, err := b.groupIDLocked(ctx)
+	if err != nil {
+		return nil, err
+	}
+	client := b.config.makeClient()
+	withMetadata := true
+	var keys *sdkms.ListSobjectsResponse
+	err = b.config.withDsmContext(ctx, func(ctx context.Context) (err error) {
+		keys, err = client.ListSobjects(ctx, &sdkms.ListSobjectsParams{
+			GroupID:      &group,
+			Name:         b.config.KeyName,
+			WithMetadata: &withMetadata,
+			// The client dereferences Sort without checking for nil.
+			Sort: &sdkms.SobjectSort{},
+		})
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	switch len(keys.Items) {
+	case 0:
+		return nil, newPluginError(codes.FailedPrecondition, reasonDsmKeyNotFound, nil,
+			"no key named %q in group %v", *b.config.KeyName, group)
+	case 1:
+	default:
+		return nil, fmt.Errorf("%v keys are named %q in group %v", len(keys.Items), *b.config.KeyName, group)
+	}
+	key := keys.Items[0]
+	if key.Kid == nil {
+		return nil, newPluginError(codes.Internal, reasonDsmInvalidResponse, nil, "DSM returned a key without kid")
+	}
+	g.kid, g.resolved = *key.Kid, time.Now()
+	g.members[*key.Kid] = true
+	return sdkms.SobjectByID(g.kid), nil
+}
+
+// checkKeyGroup fails unless key is in the configured group.
+func (b *dsmBackend) checkKeyGroup(ctx context.Context, key *sdkms.Sobject) error {
+	if b.group == nil || key.Kid == nil {
+		return nil
+	}
+	g := b.group
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	group, err := b.groupIDLocked(ctx)
+	if err != nil {
+		return err
+	}
+	if key.GroupID == nil || *key.GroupID != group {
+		return keyOutsideGroupError(*key.Kid, group)
+	}
+	g.members[*key.Kid] = true
+	return nil
+}
+
+// checkDecryptKeyGroup fails unless the key kid is in the configured
+// group, looking the key up the first time. It also checks a key given by
+// `key_id` before it is used to encrypt.
+func (b *dsmBackend) checkDecryptKeyGroup(ctx context.Context, kid string) error {
+	if b.group == nil {
+		return nil
+	}
+	b.group.mu.Lock()
+	member := b.group.members[kid]
+	b.group.mu.Unlock()
+	if member {
+		return nil
+	}
+	client := b.config.makeClient()
+	var key *sdkms.Sobject
+	err := b.config.withDsmContext(ctx, func(ctx context.Context) (err error) {
+		key, err = client.GetSobject(ctx, nil, *sdkms.SobjectByID(kid))
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	return b.checkKeyGroup(ctx, key)
+}
+
+func keyOutsideGroupError(kid, group string) error {
+	return newPluginError(codes.PermissionDenied, reasonKeyOutsideGroup,
+		map[string]string{metadataFoundKeyID: kid},
+		"key %v is not in group %v", kid, group)
+}
+
+// rotationGroup returns the group the new key is created in on rotation.
+func (b *dsmBackend) rotationGroup(ctx context.Context) (*string, error) {
+	if b.group == nil {
+		return nil, nil
+	}
+	b.group.mu.Lock()
+	defer b.group.mu.Unlock()
+	group, err := b.groupIDLocked(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &group, nil
+}
+
+// rotated makes key_name resolve to kid, the key this node rotated to.
+func (b *dsmBackend) rotated(kid string) {
+	if b.group == nil {
+		return
+	}
+	b.group.mu.Lock()
+	defer b.group.mu.Unlock()
+	b.group.kid, b.group.resolved = kid, time.Now()
+	b.group.members[kid] = true
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/fortanix/k8s-sdkms-plugin/dsmtest"
+)
+
+// checkReason fails unless err classifies with reason.
+func checkReason(t *testing.T, err error, reason string) {
+	t.Helper()
+	if _, got, _ := classifyError(err); got != reason {
+		t.Fatalf("got %v with reason %v, want %v", err, got, reason)
+	}
+}
+
+// newGroupTest returns a server with a group named "k8s-group" holding a
+// key named "k8s", and a key of the same name outside the group.
+func newGroupTest(t *testing.T) (dsm *dsmtest.Server, group, inside, outside string) {
+	t.Helper()
+	dsm = dsmtest.NewServer(testAPIKey)
+	t.Cleanup(dsm.Close)
+	group = dsm.AddGroup("k8s-group")
+	outside = dsm.AddKey("k8s")
+	inside = dsm.AddKey("k8s")
+	dsm.SetGroup(inside, group)
+	return dsm, group, inside, outside
+}
+
+func TestGroupKeyResolution(t *testing.T) {
+	dsm, group, inside, _ := newGroupTest(t)
+	ctx := context.Background()
+	for name, configure := range map[string]func(*pluginConfig){
+		"group_id":   func(config *pluginConfig) { config.GroupID = &group },
+		"group_name": func(config *pluginConfig) { name := "k8s-group"; config.GroupName = &name },
+	} {
+		t.Run(name, func(t *testing.T) {
+			b := newTestDsmBackend(dsm, configure)
+			wrapped, err := b.Wrap(ctx, []byte("dek"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if wrapped.KID != inside {
+				t.Fatalf("wrapped with key %v, want %v in the group", wrapped.KID, inside)
+			}
+			plain, err := b.Unwrap(ctx, wrapped)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(plain, []byte("dek")) {
+				t.Fatalf("got %q", plain)
+			}
+		})
+	}
+}
+
+func TestGroupKeyAmbiguous(t *testing.T) {
+	dsm, group, _, _ := newGroupTest(t)
+	dsm.SetGroup(dsm.AddKey("k8s"), group)
+	b := newTestDsmBackend(dsm, func(config *pluginConfig) { config.GroupID = &group })
+	_, err := b.Wrap(context.Background(), []byte("dek"))
+	if err == nil || !strings.Contains(err.Error(), "2 keys are named") {
+		t.Fatalf("got %v, want an error about 2 keys named k8s", err)
+	}
+}
+
+func TestGroupKeyID(t *testing.T) {
+	dsm, group, inside, outside := newGroupTest(t)
+	ctx := context.Background()
+	configure := func(kid string) func(*pluginConfig) {
+		return func(config *pluginConfig) {
+			config.KeyName, config.KeyID, config.GroupID = nil, &kid, &group
+		}
+	}
+
+	wrapped, err := newTestDsmBackend(dsm, configure(inside)).Wrap(ctx, []byte("dek"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if wrapped.KID != inside {
+		t.Fatalf("wrapped with key %v, want %v", wrapped.KID, inside)
+	}
+	before := dsm.Requests("/crypto/v1/encrypt")
+	_, err = newTestDsmBackend(dsm, configure(outside)).Wrap(ctx, []byte("dek"))
+	checkReason(t, err, reasonKeyOutsideGroup)
+	if n := dsm.Requests("/crypto/v1/encrypt") - before; n != 0 {
+		t.Fatalf("%v encrypt requests with a key outside the group", n)
+	}
+}
+
+func TestGroupDecryptOutsideGroup(t *testing.T) {
+	dsm, group, _, outside := newGroupTest(t)
+	ctx := context.Background()
+	wrapped, err := newTestDsmBackend(dsm, func(config *pluginConfig) {
+		config.KeyName, config.KeyID = nil, &outside
+	}).Wrap(ctx, []byte("dek"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Even an allowlisted key is rejected if it is outside the group.
+	b := newTestDsmBackend(dsm, func(config *pluginConfig) {
+		config.GroupID = &group
+		config.AllowedKeyIDs = []string{outside}
+	})
+	_, err = b.Unwrap(ctx, wrapped)
+	checkReason(t, err, reasonKeyOutsideGroup)
+	if n := dsm.Requests("/crypto/v1/decrypt"); n != 0 {
+		t.Fatalf("%v decrypt requests with a key outside the group", n)
+	}
+}
+
+func TestGroupRotation(t *testing.T) {
+	dsm, group, inside, outside := newGroupTest(t)
+	ctx := context.Background()
+	configure := func(config *pluginConfig) { config.GroupID = &group }
+	b := newTestDsmBackend(dsm, configure)
+	old, err := b.Wrap(ctx, []byte("dek"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	kid, err := b.rotate(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if kid == inside || kid == outside {
+		t.Fatalf("rotation returned existing key %v", kid)
+	}
+	wrapped, err := b.Wrap(ctx, []byte("dek"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if wrapped.KID != kid {
+		t.Fatalf("wrapped with key %v after rotation, want %v", wrapped.KID, kid)
+	}
+
+	// Another node resolves the name to the new key, so it was created in
+	// the group, and still decrypts with the key it replaced.
+	other := newTestDsmBackend(dsm, configure)
+	if wrapped, err = other.Wrap(ctx, []byte("dek")); err != nil {
+		t.Fatal(err)
+	}
+	if wrapped.KID != kid {
+		t.Fatalf("another node wrapped with key %v, want %v", wrapped.KID, kid)
+	}
+	if _, err := other.Unwrap(ctx, old); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestGroupConfigHash(t *testing.T) {
+	endpoint, keyName, group := "https://dsm.example", "k8s", "group"
+	config := pluginConfig{SdkmsEndpoint: &endpoint, KeyName: &keyName}
+	withID, withName := config, config
+	withID.GroupID = &group
+	withName.GroupName = &group
+	if config.hash() == withID.hash() || config.hash() == withName.hash() {
+		t.Fatal("the group does not change the config hash")
+	}
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"path"
+	"runtime/debug"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+var (
+	requestsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "requests_total",
+		Help:      "gRPC requests served, by method and status code.",
+	}, []string{"method", "code"})
+	requestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "request_duration_seconds",
+		Help:      "Time taken to serve gRPC requests, by method.",
+		Buckets:   prometheus.ExponentialBuckets(0.005, 2, 12),
+	}, []string{"method"})
+)
+
+func init() {
+	prometheus.MustRegister(requestsTotal, requestDuration)
+}
+
+// unaryInterceptors is the chain applied to every RPC, outermost first.
+// Metrics come first so that they see the final status code, rejected
+// peers are logged, and panic recovery comes last so that a recovered
+// panic is still logged and converted like any other error.
+func unaryInterceptors(config pluginConfig) []grpc.UnaryServerInterceptor {
+	return []grpc.UnaryServerInterceptor{
+		metricsInterceptor,
+		loggingInterceptor,
+		authInterceptor(config.AllowedPeerUIDs),
+		deadlineInterceptor(config.Timeouts.safetyMargin()),
+		recoveryInterceptor,
+	}
+}
+
+// metricsInterceptor counts requests and records how long they take.
+func metricsInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	method := path.Base(info.FullMethod)
+	start := time.Now()
+	resp, err := handler(ctx, req)
+	requestDuration.WithLabelValues(method).Observe(time.Since(start).Seconds())
+	requestsTotal.WithLabelValues(method, status.Code(err).String()).Inc()
+	return resp, err
+}
+
+// deadlineInterceptor fails requests that arrive with less time left than
+// the safety margin, since the apiserver gives up on them before any
+// backend call could complete.
+func deadlineInterceptor(margin time.Duration) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) <= margin {
+			return nil, newPluginError(codes.DeadlineExceeded, reasonDeadlineExceeded, nil,
+				"request arrived %v before its deadline, within the safety margin of %v", time.Until(deadline).Round(time.Millisecond), margin)
+		}
+		return handler(ctx, req)
+	}
+}
+
+type logMessageKey struct{}
+
+// setLogMessage records msg to be logged along with the outcome of the
+// current request.
+func setLogMessage(ctx context.Context, msg string) {
+	if p, ok := ctx.Value(logMessageKey{}).(*string); ok {
+		*p = msg
+	}
+}
+
+// loggingInterceptor logs the outcome of every request and converts errors
+// returned by the handlers into gRPC status errors.
+func loggingInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	kind := path.Base(info.FullMethod)
+	var msg string
+	resp, err := handler(context.WithValue(ctx, logMessageKey{}, &msg), req)
+	logRequest(kind, msg, err)
+	return resp, toStatusError(kind, err)
+}
+
+// recoveryInterceptor turns a panic in a handler into an Internal error
+// instead of crashing the plugin, and with it every apiserver request.
+func recoveryInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (resp interface{}, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("Recovered from panic in %s: %v\n%s", info.FullMethod, r, debug.Stack())
+			resp = nil
+			err = newPluginError(codes.Internal, reasonInternal, nil, "internal error: %v", fmt.Sprint(r))
+		}
+	}()
+	return handler(ctx, req)
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/fortanix/k8s-sdkms-plugin/dsmtest"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func chainHandler(interceptors []grpc.UnaryServerInterceptor, handler grpc.UnaryHandler) grpc.UnaryHandler {
+	info := &grpc.UnaryServerInfo{FullMethod: "/v2.KeyManagementService/Test"}
+	for i := len(interceptors) - 1; i >= 0; i-- {
+		next, interceptor := handler, interceptors[i]
+		handler = func(ctx context.Context, req interface{}) (interface{}, error) {
+			return interceptor(ctx, req, info, next)
+		}
+	}
+	return handler
+}
+
+func TestInterceptorsRecoverPanics(t *testing.T) {
+	handler := chainHandler(unaryInterceptors(pluginConfig{}), func(ctx context.Context, req interface{}) (interface{}, error) {
+		panic("boom")
+	})
+	before := testutil.ToFloat64(requestsTotal.WithLabelValues("Test", codes.Internal.String()))
+	_, err := handler(context.Background(), nil)
+	if status.Code(err) != codes.Internal {
+		t.Fatalf("got %v", err)
+	}
+	if n := testutil.ToFloat64(requestsTotal.WithLabelValues("Test", codes.Internal.String())); n != before+1 {
+		t.Fatalf("requests_total is %v, want %v", n, before+1)
+	}
+}
+
+func TestInterceptorsRejectExpiringRequests(t *testing.T) {
+	called := false
+	handler := chainHandler(unaryInterceptors(pluginConfig{}), func(ctx context.Context, req interface{}) (interface{}, error) {
+		called = true
+		return nil, nil
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if _, err := handler(ctx, nil); status.Code(err) != codes.DeadlineExceeded || called {
+		t.Fatalf("got %v, handler called: %v", err, called)
+	}
+	ctx, cancel = context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if _, err := handler(ctx, nil); err != nil || !called {
+		t.Fatalf("got %v, handler called: %v", err, called)
+	}
+}
+
+func TestAuthInterceptorChecksPeerUID(t *testing.T) {
+	if !peerCredentialsSupported {
+		t.Skip("peer credentials are not supported on this platform")
+	}
+	dsm := dsmtest.NewServer(testAPIKey)
+	defer dsm.Close()
+	dsm.AddKey("k8s")
+	uid := uint32(os.Getuid())
+
+	client := startTestPlugin(t, dsm, func(config *pluginConfig) {
+		config.AllowedPeerUIDs = []uint32{uid}
+	})
+	if _, err := client.Status(requestContext(t), &StatusRequest{}); err != nil {
+		t.Fatalf("request from an allowed user ID: %v", err)
+	}
+
+	client = startTestPlugin(t, dsm, func(config *pluginConfig) {
+		config.AllowedPeerUIDs = []uint32{uid + 1}
+	})
+	_, err := client.Status(requestContext(t), &StatusRequest{})
+	checkError(t, err, codes.PermissionDenied, reasonPeerNotAllowed)
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// minKeySize is the smallest AES key the plugin accepts, in bits.
+const minKeySize = 256
+
+// keyOperations are the operations a key allows.
+type keyOperations struct {
+	Encrypt bool
+	Decrypt bool
+}
+
+// keyProblems lists everything that keeps key from being used by the
+// plugin at time now, each with what to do about it. Properties the
+// backend could not report are not checked.
+func keyProblems(key *KeyInfo, now time.Time) []string {
+	var problems []string
+	if key.Type != keyTypeAes {
+		problems = append(problems, fmt.Sprintf("key type is %v, configure an AES key", key.Type))
+	}
+	if key.Size != 0 && key.Size < minKeySize {
+		problems = append(problems, fmt.Sprintf("key size is %v bits, configure a %v-bit key", key.Size, minKeySize))
+	}
+	if !key.Enabled {
+		problems = append(problems, "key is disabled, enable it")
+	}
+	if ops := key.Operations; ops != nil {
+		if !ops.Encrypt {
+			problems = append(problems, "key does not allow ENCRYPT, add it to the permitted operations")
+		}
+		if !ops.Decrypt {
+			problems = append(problems, "key does not allow DECRYPT, add it to the permitted operations")
+		}
+	}
+	if !key.ActivationDate.IsZero() && now.Before(key.ActivationDate) {
+		problems = append(problems, fmt.Sprintf("key is not active until %v, wait or change its activation date",
+			key.ActivationDate.UTC().Format(time.RFC3339)))
+	}
+	if !key.DeactivationDate.IsZero() && !now.Before(key.DeactivationDate) {
+		problems = append(problems, fmt.Sprintf("key was deactivated on %v, rotate it or configure an active key",
+			key.DeactivationDate.UTC().Format(time.RFC3339)))
+	}
+	if key.Mode != "" && key.Mode != "GCM" {
+		problems = append(problems, fmt.Sprintf("key is restricted to cipher mode %v, allow GCM", key.Mode))
+	}
+	return problems
+}
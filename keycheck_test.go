@@ -0,0 +1,68 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestKeyProblems(t *testing.T) {
+	now := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name   string
+		modify func(key *KeyInfo)
+		// want holds a fragment of each problem expected, in order.
+		want []string
+	}{
+		{"usable", func(key *KeyInfo) {}, nil},
+		{"unknown properties", func(key *KeyInfo) {
+			key.Size, key.Operations = 0, nil
+		}, nil},
+		{"type", func(key *KeyInfo) { key.Type = "RSA" }, []string{"key type is RSA"}},
+		{"size", func(key *KeyInfo) { key.Size = 128 }, []string{"key size is 128 bits"}},
+		{"disabled", func(key *KeyInfo) { key.Enabled = false }, []string{"disabled"}},
+		{"no encrypt", func(key *KeyInfo) { key.Operations.Encrypt = false }, []string{"ENCRYPT"}},
+		{"no decrypt", func(key *KeyInfo) { key.Operations.Decrypt = false }, []string{"DECRYPT"}},
+		{"not yet active", func(key *KeyInfo) {
+			key.ActivationDate = now.Add(time.Hour)
+		}, []string{"not active until 2024-06-01T13:00:00Z"}},
+		{"activated now", func(key *KeyInfo) { key.ActivationDate = now }, nil},
+		{"deactivated", func(key *KeyInfo) {
+			key.DeactivationDate = now.Add(-time.Hour)
+		}, []string{"deactivated on 2024-06-01T11:00:00Z"}},
+		{"deactivated now", func(key *KeyInfo) {
+			key.DeactivationDate = now
+		}, []string{"deactivated on 2024-06-01T12:00:00Z"}},
+		{"deactivated later", func(key *KeyInfo) { key.DeactivationDate = now.Add(time.Hour) }, nil},
+		{"mode", func(key *KeyInfo) { key.Mode = "CBC" }, []string{"cipher mode CBC"}},
+		{"GCM mode", func(key *KeyInfo) { key.Mode = "GCM" }, nil},
+		{"several", func(key *KeyInfo) {
+			key.Size = 128
+			key.Enabled = false
+			key.Operations.Encrypt = false
+			key.DeactivationDate = now
+			key.Mode = "CBC"
+		}, []string{"key size is 128 bits", "disabled", "ENCRYPT", "deactivated", "cipher mode CBC"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			key := &KeyInfo{
+				KID:        "kid",
+				Type:       keyTypeAes,
+				Enabled:    true,
+				Size:       256,
+				Operations: &keyOperations{Encrypt: true, Decrypt: true},
+			}
+			test.modify(key)
+			problems := keyProblems(key, now)
+			if len(problems) != len(test.want) {
+				t.Fatalf("got %q, want %v problems", problems, len(test.want))
+			}
+			for i, want := range test.want {
+				if !strings.Contains(problems[i], want) {
+					t.Errorf("problem %v is %q, want it to mention %q", i, problems[i], want)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,231 @@
+package kmip
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// Client talks to a KMIP server over a single TLS connection, which is
+// re-established after any error. Requests are serialized on the
+// connection.
+type Client struct {
+	// Addr is the host:port of the KMIP server, usually port 5696.
+	Addr string
+	// TLSConfig carries the client certificate used to authenticate.
+	TLSConfig *tls.Config
+
+	mu   sync.Mutex
+	conn net.Conn
+}
+
+// EncryptResult is the outcome of an AES-GCM Encrypt operation.
+type EncryptResult struct {
+	UniqueIdentifier string
+	Data             []byte
+	IV               []byte
+	Tag              []byte
+}
+
+// Close closes the underlying connection.
+func (c *Client) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.conn == nil {
+		return nil
+	}
+	err := c.conn.Close()
+	c.conn = nil
+	return err
+}
+
+// Locate returns the unique identifiers of the symmetric keys named name.
+func (c *Client) Locate(ctx context.Context, name string) ([]string, error) {
+	payload, err := c.do(ctx, OperationLocate,
+		Structure(TagAttribute,
+			Text(TagAttributeName, AttributeNameObjectType),
+			Enum(TagAttributeValue, ObjectTypeSymmetricKey),
+		),
+		Structure(TagAttribute,
+			Text(TagAttributeName, AttributeNameName),
+			Structure(TagAttributeValue,
+				Text(TagNameValue, name),
+				Enum(TagNameType, NameTypeUninterpretedText),
+			),
+		),
+	)
+	if err != nil {
+		return nil, err
+	}
+	var ids []string
+	for _, child := range payload.Children() {
+		if id, ok := child.Value.(string); ok && child.Tag == TagUniqueIdentifier {
+			ids = append(ids, id)
+		}
+	}
+	return ids, nil
+}
+
+// GetAttributes returns the requested attributes of the object uid, keyed
+// by attribute name.
+func (c *Client) GetAttributes(ctx context.Context, uid string, names ...string) (map[string]Item, error) {
+	request := []Item{Text(TagUniqueIdentifier, uid)}
+	for _, name := range names {
+		request = append(request, Text(TagAttributeName, name))
+	}
+	payload, err := c.do(ctx, OperationGetAttributes, request...)
+	if err != nil {
+		return nil, err
+	}
+	attrs := make(map[string]Item)
+	for _, child := range payload.Children() {
+		if child.Tag != TagAttribute {
+			continue
+		}
+		name, _ := child.String(TagAttributeName)
+		if value, ok := child.Child(TagAttributeValue); ok {
+			attrs[name] = value
+		}
+	}
+	return attrs, nil
+}
+
+// Replaced returns the unique identifier of the object that uid replaced
+// through a re-key, or "" if it has no Replaced Object link. Unlike
+// GetAttributes it looks at every Link attribute, since an object may have
+// several.
+func (c *Client) Replaced(ctx context.Context, uid string) (string, error) {
+	payload, err := c.do(ctx, OperationGetAttributes,
+		Text(TagUniqueIdentifier, uid),
+		Text(TagAttributeName, AttributeNameLink),
+	)
+	if err != nil {
+		return "", err
+	}
+	for _, child := range payload.Children() {
+		if name, _ := child.String(TagAttributeName); child.Tag != TagAttribute || name != AttributeNameLink {
+			continue
+		}
+		link, _ := child.Child(TagAttributeValue)
+		if linkType, _ := link.Int32(TagLinkType); linkType == LinkTypeReplacedObject {
+			replaced, _ := link.String(TagLinkedObjectIdentifier)
+			return replaced, nil
+		}
+	}
+	return "", nil
+}
+
+// Encrypt encrypts data with AES-GCM under the key uid, letting the server
+// pick a random IV.
+func (c *Client) Encrypt(ctx context.Context, uid string, data []byte) (*EncryptResult, error) {
+	payload, err := c.do(ctx, OperationEncrypt,
+		Text(TagUniqueIdentifier, uid),
+		gcmParameters(true),
+		Bytes(TagData, data),
+	)
+	if err != nil {
+		return nil, err
+	}
+	result := &EncryptResult{}
+	var ok bool
+	if result.UniqueIdentifier, ok = payload.String(TagUniqueIdentifier); !ok {
+		return nil, errors.New("kmip: encrypt response has no unique identifier")
+	}
+	if result.Data, ok = payload.ByteString(TagData); !ok {
+		return nil, errors.New("kmip: encrypt response has no data")
+	}
+	if result.IV, ok = payload.ByteString(TagIVCounterNonce); !ok {
+		return nil, errors.New("kmip: encrypt response has no IV")
+	}
+	if result.Tag, ok = payload.ByteString(TagAuthenticatedEncryptionTag); !ok {
+		return nil, errors.New("kmip: encrypt response has no authentication tag")
+	}
+	return result, nil
+}
+
+// Decrypt decrypts data with AES-GCM under the key uid.
+func (c *Client) Decrypt(ctx context.Context, uid string, data, iv, tag []byte) ([]byte, error) {
+	payload, err := c.do(ctx, OperationDecrypt,
+		Text(TagUniqueIdentifier, uid),
+		gcmParameters(false),
+		Bytes(TagData, data),
+		Bytes(TagIVCounterNonce, iv),
+		Bytes(TagAuthenticatedEncryptionTag, tag),
+	)
+	if err != nil {
+		return nil, err
+	}
+	plain, ok := payload.ByteString(TagData)
+	if !ok {
+		return nil, errors.New("kmip: decrypt response has no data")
+	}
+	return plain, nil
+}
+
+// DiscoverVersions performs a round trip to the server without touching
+// any object, which makes it suitable as a health check.
+func (c *Client) DiscoverVersions(ctx context.Context) error {
+	_, err := c.do(ctx, OperationDiscoverVersions)
+	return err
+}
+
+func gcmParameters(randomIV bool) Item {
+	params := []Item{
+		Enum(TagBlockCipherMode, BlockCipherModeGCM),
+		Enum(TagCryptographicAlgorithm, CryptographicAlgorithmAES),
+		Integer(TagTagLength, 16),
+	}
+	if randomIV {
+		params = append(params, Bool(TagRandomIV, true))
+	}
+	return Structure(TagCryptographicParameters, params...)
+}
+
+func (c *Client) do(ctx context.Context, operation int32, payload ...Item) (Item, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	conn, err := c.connect(ctx)
+	if err != nil {
+		return Item{}, err
+	}
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Time{}
+	}
+	conn.SetDeadline(deadline)
+	response, err := c.roundTrip(conn, NewRequest(operation, payload...))
+	if err != nil {
+		conn.Close()
+		c.conn = nil
+		return Item{}, err
+	}
+	return ParseResponse(response, operation)
+}
+
+func (c *Client) roundTrip(conn net.Conn, request Item) (Item, error) {
+	if err := WriteMessage(conn, request); err != nil {
+		return Item{}, fmt.Errorf("kmip: failed to send request: %w", err)
+	}
+	response, err := ReadMessage(conn)
+	if err != nil {
+		return Item{}, fmt.Errorf("kmip: failed to read response: %w", err)
+	}
+	return response, nil
+}
+
+func (c *Client) connect(ctx context.Context) (net.Conn, error) {
+	if c.conn != nil {
+		return c.conn, nil
+	}
+	dialer := &tls.Dialer{Config: c.TLSConfig}
+	conn, err := dialer.DialContext(ctx, "tcp", c.Addr)
+	if err != nil {
+		return nil, fmt.Errorf("kmip: failed to connect to %v: %w", c.Addr, err)
+	}
+	c.conn = conn
+	return conn, nil
+}
@@ -0,0 +1,299 @@
+// Package kmiptest provides an in-process KMIP server that implements just
+// enough of the protocol to stand in for DSM when exercising the plugin's
+// KMIP backend.
+package kmiptest
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"sync"
+
+	"github.com/fortanix/k8s-sdkms-plugin/kmip"
+)
+
+type key struct {
+	name     string
+	value    []byte
+	state    int32
+	replaced string // Replaced Object link
+}
+
+// Server is a KMIP server holding AES keys in memory.
+type Server struct {
+	listener net.Listener
+	wg       sync.WaitGroup
+
+	mu       sync.Mutex
+	keys     map[string]*key
+	conns    map[net.Conn]struct{}
+	requests map[int32]int
+}
+
+// NewServer starts a server listening on a random local port. config must
+// carry the server certificate and may require client certificates.
+func NewServer(config *tls.Config) (*Server, error) {
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", config)
+	if err != nil {
+		return nil, err
+	}
+	s := &Server{
+		listener: listener,
+		keys:     make(map[string]*key),
+		conns:    make(map[net.Conn]struct{}),
+		requests: make(map[int32]int),
+	}
+	s.wg.Add(1)
+	go s.serve()
+	return s, nil
+}
+
+// Addr returns the host:port the server listens on.
+func (s *Server) Addr() string {
+	return s.listener.Addr().String()
+}
+
+// AddKey adds an active AES key.
+func (s *Server) AddKey(uid, name string, value []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.keys[uid] = &key{name: name, value: value, state: kmip.StateActive}
+}
+
+// SetState changes the lifecycle state of a key. Only active keys can
+// encrypt; active and deactivated keys can decrypt.
+func (s *Server) SetState(uid string, state int32) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if k, ok := s.keys[uid]; ok {
+		k.state = state
+	}
+}
+
+// ReKey replaces the key uid with an active key newUID, as the KMIP Re-key
+// operation does: the new key takes over the name of the old one and links
+// to it.
+func (s *Server) ReKey(uid, newUID string, value []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	old, ok := s.keys[uid]
+	if !ok {
+		return
+	}
+	s.keys[newUID] = &key{name: old.name, value: value, state: kmip.StateActive, replaced: uid}
+	old.name = ""
+}
+
+// RemoveKey deletes a key.
+func (s *Server) RemoveKey(uid string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.keys, uid)
+}
+
+// Requests returns how many requests for operation were served.
+func (s *Server) Requests(operation int32) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.requests[operation]
+}
+
+// Close stops the server and closes all open connections.
+func (s *Server) Close() error {
+	err := s.listener.Close()
+	s.mu.Lock()
+	for conn := range s.conns {
+		conn.Close()
+	}
+	s.mu.Unlock()
+	s.wg.Wait()
+	return err
+}
+
+func (s *Server) serve() {
+	defer s.wg.Done()
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		s.mu.Lock()
+		s.conns[conn] = struct{}{}
+		s.mu.Unlock()
+		s.wg.Add(1)
+		go s.handleConn(conn)
+	}
+}
+
+func (s *Server) handleConn(conn net.Conn) {
+	defer s.wg.Done()
+	defer func() {
+		conn.Close()
+		s.mu.Lock()
+		delete(s.conns, conn)
+		s.mu.Unlock()
+	}()
+	for {
+		request, err := kmip.ReadMessage(conn)
+		if err != nil {
+			return
+		}
+		if err := kmip.WriteMessage(conn, s.handle(request)); err != nil {
+			return
+		}
+	}
+}
+
+func (s *Server) handle(request kmip.Item) kmip.Item {
+	operation, payload, err := kmip.ParseRequest(request)
+	if err != nil {
+		return kmip.NewErrorResponse(operation, kmip.ResultReasonInvalidMessage, err.Error())
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.requests[operation]++
+	switch operation {
+	case kmip.OperationDiscoverVersions:
+		return kmip.NewResponse(operation, kmip.Structure(kmip.TagProtocolVersion,
+			kmip.Integer(kmip.TagProtocolVersionMajor, 1),
+			kmip.Integer(kmip.TagProtocolVersionMinor, 4),
+		))
+	case kmip.OperationLocate:
+		return s.locate(payload)
+	case kmip.OperationGetAttributes:
+		return s.getAttributes(payload)
+	case kmip.OperationEncrypt:
+		return s.encrypt(payload)
+	case kmip.OperationDecrypt:
+		return s.decrypt(payload)
+	}
+	return kmip.NewErrorResponse(operation, kmip.ResultReasonOperationNotSupported,
+		fmt.Sprintf("operation %#x is not supported", operation))
+}
+
+func (s *Server) locate(payload kmip.Item) kmip.Item {
+	var name string
+	for _, attr := range payload.Children() {
+		if n, _ := attr.String(kmip.TagAttributeName); n == kmip.AttributeNameName {
+			value, _ := attr.Child(kmip.TagAttributeValue)
+			name, _ = value.String(kmip.TagNameValue)
+		}
+	}
+	var ids []kmip.Item
+	for uid, k := range s.keys {
+		if name == "" || k.name == name {
+			ids = append(ids, kmip.Text(kmip.TagUniqueIdentifier, uid))
+		}
+	}
+	return kmip.NewResponse(kmip.OperationLocate, ids...)
+}
+
+func (s *Server) getAttributes(payload kmip.Item) kmip.Item {
+	uid, _ := payload.String(kmip.TagUniqueIdentifier)
+	k, ok := s.keys[uid]
+	if !ok {
+		return kmip.NewErrorResponse(kmip.OperationGetAttributes, kmip.ResultReasonItemNotFound, "object not found")
+	}
+	all := map[string]kmip.Item{
+		kmip.AttributeNameName: kmip.Structure(kmip.TagAttributeValue,
+			kmip.Text(kmip.TagNameValue, k.name),
+			kmip.Enum(kmip.TagNameType, kmip.NameTypeUninterpretedText),
+		),
+		kmip.AttributeNameObjectType:      kmip.Enum(kmip.TagAttributeValue, kmip.ObjectTypeSymmetricKey),
+		kmip.AttributeNameState:           kmip.Enum(kmip.TagAttributeValue, k.state),
+		kmip.AttributeNameCryptoAlgorithm: kmip.Enum(kmip.TagAttributeValue, kmip.CryptographicAlgorithmAES),
+		kmip.AttributeNameCryptoLength:    kmip.Integer(kmip.TagAttributeValue, int32(len(k.value)*8)),
+		kmip.AttributeNameUsageMask: kmip.Integer(kmip.TagAttributeValue,
+			kmip.CryptographicUsageMaskEncrypt|kmip.CryptographicUsageMaskDecrypt),
+	}
+	if k.replaced != "" {
+		all[kmip.AttributeNameLink] = kmip.Structure(kmip.TagAttributeValue,
+			kmip.Enum(kmip.TagLinkType, kmip.LinkTypeReplacedObject),
+			kmip.Text(kmip.TagLinkedObjectIdentifier, k.replaced),
+		)
+	}
+	response := []kmip.Item{kmip.Text(kmip.TagUniqueIdentifier, uid)}
+	for _, child := range payload.Children() {
+		if child.Tag != kmip.TagAttributeName {
+			continue
+		}
+		name, _ := child.Value.(string)
+		if value, ok := all[name]; ok {
+			response = append(response, kmip.Structure(kmip.TagAttribute,
+				kmip.Text(kmip.TagAttributeName, name),
+				value,
+			))
+		}
+	}
+	return kmip.NewResponse(kmip.OperationGetAttributes, response...)
+}
+
+func (s *Server) encrypt(payload kmip.Item) kmip.Item {
+	const op = kmip.OperationEncrypt
+	uid, _ := payload.String(kmip.TagUniqueIdentifier)
+	k, ok := s.keys[uid]
+	if !ok {
+		return kmip.NewErrorResponse(op, kmip.ResultReasonItemNotFound, "object not found")
+	}
+	if k.state != kmip.StateActive {
+		return kmip.NewErrorResponse(op, kmip.ResultReasonPermissionDenied, "object is not active")
+	}
+	aead, err := newGCM(k.value)
+	if err != nil {
+		return kmip.NewErrorResponse(op, kmip.ResultReasonCryptographicFailure, err.Error())
+	}
+	data, _ := payload.ByteString(kmip.TagData)
+	iv := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(iv); err != nil {
+		return kmip.NewErrorResponse(op, kmip.ResultReasonGeneralFailure, err.Error())
+	}
+	sealed := aead.Seal(nil, iv, data, nil)
+	split := len(sealed) - aead.Overhead()
+	return kmip.NewResponse(op,
+		kmip.Text(kmip.TagUniqueIdentifier, uid),
+		kmip.Bytes(kmip.TagData, sealed[:split]),
+		kmip.Bytes(kmip.TagIVCounterNonce, iv),
+		kmip.Bytes(kmip.TagAuthenticatedEncryptionTag, sealed[split:]),
+	)
+}
+
+func (s *Server) decrypt(payload kmip.Item) kmip.Item {
+	const op = kmip.OperationDecrypt
+	uid, _ := payload.String(kmip.TagUniqueIdentifier)
+	k, ok := s.keys[uid]
+	if !ok {
+		return kmip.NewErrorResponse(op, kmip.ResultReasonItemNotFound, "object not found")
+	}
+	if k.state != kmip.StateActive && k.state != kmip.StateDeactivated {
+		return kmip.NewErrorResponse(op, kmip.ResultReasonPermissionDenied, "object cannot be used for decryption")
+	}
+	aead, err := newGCM(k.value)
+	if err != nil {
+		return kmip.NewErrorResponse(op, kmip.ResultReasonCryptographicFailure, err.Error())
+	}
+	data, _ := payload.ByteString(kmip.TagData)
+	iv, _ := payload.ByteString(kmip.TagIVCounterNonce)
+	tag, _ := payload.ByteString(kmip.TagAuthenticatedEncryptionTag)
+	if len(iv) != aead.NonceSize() {
+		return kmip.NewErrorResponse(op, kmip.ResultReasonCryptographicFailure, "invalid IV length")
+	}
+	plain, err := aead.Open(nil, iv, append(append([]byte{}, data...), tag...), nil)
+	if err != nil {
+		return kmip.NewErrorResponse(op, kmip.ResultReasonCryptographicFailure, "authentication failed")
+	}
+	return kmip.NewResponse(op,
+		kmip.Text(kmip.TagUniqueIdentifier, uid),
+		kmip.Bytes(kmip.TagData, plain),
+	)
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
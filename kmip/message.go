@@ -0,0 +1,205 @@
+package kmip
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+// Operation values.
+const (
+	OperationLocate           int32 = 0x08
+	OperationGetAttributes    int32 = 0x0B
+	OperationDiscoverVersions int32 = 0x1E
+	OperationEncrypt          int32 = 0x1F
+	OperationDecrypt          int32 = 0x20
+)
+
+// Result Status values.
+const (
+	ResultStatusSuccess          int32 = 0x00
+	ResultStatusOperationFailed  int32 = 0x01
+	ResultStatusOperationPending int32 = 0x02
+)
+
+// Result Reason values.
+const (
+	ResultReasonItemNotFound          int32 = 0x01
+	ResultReasonAuthenticationFailed  int32 = 0x03
+	ResultReasonInvalidMessage        int32 = 0x04
+	ResultReasonOperationNotSupported int32 = 0x05
+	ResultReasonCryptographicFailure  int32 = 0x0A
+	ResultReasonIllegalOperation      int32 = 0x0B
+	ResultReasonPermissionDenied      int32 = 0x0C
+	ResultReasonGeneralFailure        int32 = 0x100
+)
+
+// Other enumeration values used by this package.
+const (
+	BlockCipherModeGCM        int32 = 0x09
+	CryptographicAlgorithmAES int32 = 0x03
+	LinkTypeReplacedObject    int32 = 0x107
+	NameTypeUninterpretedText int32 = 0x01
+	ObjectTypeSymmetricKey    int32 = 0x02
+	StatePreActive            int32 = 0x01
+	StateActive               int32 = 0x02
+	StateDeactivated          int32 = 0x03
+
+	CryptographicUsageMaskEncrypt int32 = 0x04
+	CryptographicUsageMaskDecrypt int32 = 0x08
+)
+
+// Attribute names.
+const (
+	AttributeNameName            = "Name"
+	AttributeNameObjectType      = "Object Type"
+	AttributeNameState           = "State"
+	AttributeNameCryptoAlgorithm = "Cryptographic Algorithm"
+	AttributeNameCryptoLength    = "Cryptographic Length"
+	AttributeNameUsageMask       = "Cryptographic Usage Mask"
+	AttributeNameActivation      = "Activation Date"
+	AttributeNameDeactivation    = "Deactivation Date"
+	AttributeNameLink            = "Link"
+)
+
+const (
+	protocolVersionMajor int32 = 1
+	protocolVersionMinor int32 = 4
+)
+
+// Error is a KMIP operation that completed with a non-success status.
+type Error struct {
+	Status  int32
+	Reason  int32
+	Message string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("kmip: operation failed with status %#x, reason %#x: %s", e.Status, e.Reason, e.Message)
+}
+
+// NewRequest builds a request message with a single batch item.
+func NewRequest(operation int32, payload ...Item) Item {
+	return Structure(TagRequestMessage,
+		Structure(TagRequestHeader,
+			protocolVersion(),
+			Integer(TagBatchCount, 1),
+		),
+		Structure(TagBatchItem,
+			Enum(TagOperation, operation),
+			Structure(TagRequestPayload, payload...),
+		),
+	)
+}
+
+// NewResponse builds a response message with a single successful batch
+// item.
+func NewResponse(operation int32, payload ...Item) Item {
+	return newResponse(Structure(TagBatchItem,
+		Enum(TagOperation, operation),
+		Enum(TagResultStatus, ResultStatusSuccess),
+		Structure(TagResponsePayload, payload...),
+	))
+}
+
+// NewErrorResponse builds a response message with a single failed batch
+// item.
+func NewErrorResponse(operation int32, reason int32, message string) Item {
+	return newResponse(Structure(TagBatchItem,
+		Enum(TagOperation, operation),
+		Enum(TagResultStatus, ResultStatusOperationFailed),
+		Enum(TagResultReason, reason),
+		Text(TagResultMessage, message),
+	))
+}
+
+func newResponse(batchItem Item) Item {
+	return Structure(TagResponseMessage,
+		Structure(TagResponseHeader,
+			protocolVersion(),
+			DateTime(TagTimeStamp, time.Now()),
+			Integer(TagBatchCount, 1),
+		),
+		batchItem,
+	)
+}
+
+func protocolVersion() Item {
+	return Structure(TagProtocolVersion,
+		Integer(TagProtocolVersionMajor, protocolVersionMajor),
+		Integer(TagProtocolVersionMinor, protocolVersionMinor),
+	)
+}
+
+// ParseRequest returns the operation and payload of a request message with
+// a single batch item.
+func ParseRequest(msg Item) (int32, Item, error) {
+	if msg.Tag != TagRequestMessage {
+		return 0, Item{}, errors.New("kmip: not a request message")
+	}
+	batchItem, ok := msg.Child(TagBatchItem)
+	if !ok {
+		return 0, Item{}, errors.New("kmip: request has no batch item")
+	}
+	operation, ok := batchItem.Int32(TagOperation)
+	if !ok {
+		return 0, Item{}, errors.New("kmip: request has no operation")
+	}
+	payload, _ := batchItem.Child(TagRequestPayload)
+	return operation, payload, nil
+}
+
+// ParseResponse returns the payload of a response message with a single
+// batch item, or an *Error if the operation failed.
+func ParseResponse(msg Item, operation int32) (Item, error) {
+	if msg.Tag != TagResponseMessage {
+		return Item{}, errors.New("kmip: not a response message")
+	}
+	batchItem, ok := msg.Child(TagBatchItem)
+	if !ok {
+		return Item{}, errors.New("kmip: response has no batch item")
+	}
+	if op, ok := batchItem.Int32(TagOperation); ok && op != operation {
+		return Item{}, fmt.Errorf("kmip: response is for operation %#x, expected %#x", op, operation)
+	}
+	status, ok := batchItem.Int32(TagResultStatus)
+	if !ok {
+		return Item{}, errors.New("kmip: response has no result status")
+	}
+	if status != ResultStatusSuccess {
+		reason, _ := batchItem.Int32(TagResultReason)
+		message, _ := batchItem.String(TagResultMessage)
+		return Item{}, &Error{Status: status, Reason: reason, Message: message}
+	}
+	payload, _ := batchItem.Child(TagResponsePayload)
+	return payload, nil
+}
+
+// ReadMessage reads a single TTLV message from r.
+func ReadMessage(r io.Reader) (Item, error) {
+	header := make([]byte, headerSize)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return Item{}, err
+	}
+	length, err := messageLength(header)
+	if err != nil {
+		return Item{}, err
+	}
+	data := make([]byte, length)
+	copy(data, header)
+	if _, err := io.ReadFull(r, data[headerSize:]); err != nil {
+		return Item{}, err
+	}
+	return Unmarshal(data)
+}
+
+// WriteMessage writes a single TTLV message to w.
+func WriteMessage(w io.Writer, msg Item) error {
+	data, err := Marshal(msg)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(data)
+	return err
+}
@@ -0,0 +1,295 @@
+// Package kmip implements the small subset of the KMIP protocol that the
+// plugin needs to wrap and unwrap DEKs with a key held by a KMIP server:
+// the TTLV encoding and the Locate, Get Attributes, Encrypt, Decrypt and
+// Discover Versions operations.
+package kmip
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Tag identifies a TTLV item.
+type Tag uint32
+
+// Tags used by this package, from the KMIP 1.4 specification.
+const (
+	TagAttribute                  Tag = 0x420008
+	TagAttributeName              Tag = 0x42000A
+	TagAttributeValue             Tag = 0x42000B
+	TagBatchCount                 Tag = 0x42000D
+	TagBatchItem                  Tag = 0x42000F
+	TagBlockCipherMode            Tag = 0x420011
+	TagCryptographicAlgorithm     Tag = 0x420028
+	TagCryptographicLength        Tag = 0x42002A
+	TagCryptographicParameters    Tag = 0x42002B
+	TagIVCounterNonce             Tag = 0x42003D
+	TagLinkType                   Tag = 0x42004B
+	TagLinkedObjectIdentifier     Tag = 0x42004C
+	TagName                       Tag = 0x420053
+	TagNameType                   Tag = 0x420054
+	TagNameValue                  Tag = 0x420055
+	TagObjectType                 Tag = 0x420057
+	TagOperation                  Tag = 0x42005C
+	TagProtocolVersion            Tag = 0x420069
+	TagProtocolVersionMajor       Tag = 0x42006A
+	TagProtocolVersionMinor       Tag = 0x42006B
+	TagRequestHeader              Tag = 0x420077
+	TagRequestMessage             Tag = 0x420078
+	TagRequestPayload             Tag = 0x420079
+	TagResponseHeader             Tag = 0x42007A
+	TagResponseMessage            Tag = 0x42007B
+	TagResponsePayload            Tag = 0x42007C
+	TagResultMessage              Tag = 0x42007D
+	TagResultReason               Tag = 0x42007E
+	TagResultStatus               Tag = 0x42007F
+	TagTimeStamp                  Tag = 0x420092
+	TagUniqueIdentifier           Tag = 0x420094
+	TagData                       Tag = 0x4200C2
+	TagRandomIV                   Tag = 0x4200C5
+	TagTagLength                  Tag = 0x4200C7
+	TagAuthenticatedEncryptionTag Tag = 0x4200FF
+)
+
+// Type is the type of a TTLV item.
+type Type byte
+
+const (
+	TypeStructure   Type = 0x01
+	TypeInteger     Type = 0x02
+	TypeLongInteger Type = 0x03
+	TypeEnumeration Type = 0x05
+	TypeBoolean     Type = 0x06
+	TypeTextString  Type = 0x07
+	TypeByteString  Type = 0x08
+	TypeDateTime    Type = 0x09
+	TypeInterval    Type = 0x0A
+)
+
+// MaxMessageSize bounds the size of messages read from the network.
+const MaxMessageSize = 1 << 20
+
+const headerSize = 8
+
+// Item is a single TTLV item. Value holds []Item for structures, int32 for
+// integers, enumerations and intervals, int64 for long integers, bool,
+// string, []byte, or time.Time for date-times.
+type Item struct {
+	Tag   Tag
+	Type  Type
+	Value interface{}
+}
+
+func Structure(tag Tag, items ...Item) Item { return Item{tag, TypeStructure, items} }
+func Integer(tag Tag, v int32) Item         { return Item{tag, TypeInteger, v} }
+func Enum(tag Tag, v int32) Item            { return Item{tag, TypeEnumeration, v} }
+func Bool(tag Tag, v bool) Item             { return Item{tag, TypeBoolean, v} }
+func Text(tag Tag, v string) Item           { return Item{tag, TypeTextString, v} }
+func Bytes(tag Tag, v []byte) Item          { return Item{tag, TypeByteString, v} }
+func DateTime(tag Tag, v time.Time) Item    { return Item{tag, TypeDateTime, v} }
+
+// Child returns the first direct child of a structure with the given tag.
+func (it Item) Child(tag Tag) (Item, bool) {
+	for _, child := range it.Children() {
+		if child.Tag == tag {
+			return child, true
+		}
+	}
+	return Item{}, false
+}
+
+// Children returns the items of a structure, or nil for other types.
+func (it Item) Children() []Item {
+	items, _ := it.Value.([]Item)
+	return items
+}
+
+// Int32 returns the value of an integer, enumeration or interval child.
+func (it Item) Int32(tag Tag) (int32, bool) {
+	child, ok := it.Child(tag)
+	if !ok {
+		return 0, false
+	}
+	v, ok := child.Value.(int32)
+	return v, ok
+}
+
+// String returns the value of a text string child.
+func (it Item) String(tag Tag) (string, bool) {
+	child, ok := it.Child(tag)
+	if !ok {
+		return "", false
+	}
+	v, ok := child.Value.(string)
+	return v, ok
+}
+
+// ByteString returns the value of a byte string child.
+func (it Item) ByteString(tag Tag) ([]byte, bool) {
+	child, ok := it.Child(tag)
+	if !ok {
+		return nil, false
+	}
+	v, ok := child.Value.([]byte)
+	return v, ok
+}
+
+// Marshal encodes it in TTLV.
+func Marshal(it Item) ([]byte, error) {
+	return appendItem(nil, it)
+}
+
+func appendItem(buf []byte, it Item) ([]byte, error) {
+	var value []byte
+	switch it.Type {
+	case TypeStructure:
+		items, ok := it.Value.([]Item)
+		if !ok && it.Value != nil {
+			return nil, typeMismatch(it)
+		}
+		for _, child := range items {
+			var err error
+			if value, err = appendItem(value, child); err != nil {
+				return nil, err
+			}
+		}
+	case TypeInteger, TypeEnumeration, TypeInterval:
+		v, ok := it.Value.(int32)
+		if !ok {
+			return nil, typeMismatch(it)
+		}
+		value = binary.BigEndian.AppendUint32(nil, uint32(v))
+	case TypeLongInteger:
+		v, ok := it.Value.(int64)
+		if !ok {
+			return nil, typeMismatch(it)
+		}
+		value = binary.BigEndian.AppendUint64(nil, uint64(v))
+	case TypeBoolean:
+		v, ok := it.Value.(bool)
+		if !ok {
+			return nil, typeMismatch(it)
+		}
+		value = make([]byte, 8)
+		if v {
+			value[7] = 1
+		}
+	case TypeTextString:
+		v, ok := it.Value.(string)
+		if !ok {
+			return nil, typeMismatch(it)
+		}
+		value = []byte(v)
+	case TypeByteString:
+		v, ok := it.Value.([]byte)
+		if !ok {
+			return nil, typeMismatch(it)
+		}
+		value = v
+	case TypeDateTime:
+		v, ok := it.Value.(time.Time)
+		if !ok {
+			return nil, typeMismatch(it)
+		}
+		value = binary.BigEndian.AppendUint64(nil, uint64(v.Unix()))
+	default:
+		return nil, fmt.Errorf("kmip: unsupported item type %#x", it.Type)
+	}
+	buf = append(buf, byte(it.Tag>>16), byte(it.Tag>>8), byte(it.Tag), byte(it.Type))
+	buf = binary.BigEndian.AppendUint32(buf, uint32(len(value)))
+	buf = append(buf, value...)
+	return append(buf, make([]byte, padding(len(value)))...), nil
+}
+
+// Unmarshal decodes a single TTLV item that spans all of data.
+func Unmarshal(data []byte) (Item, error) {
+	it, n, err := decodeItem(data)
+	if err != nil {
+		return Item{}, err
+	}
+	if n != len(data) {
+		return Item{}, errors.New("kmip: trailing data after item")
+	}
+	return it, nil
+}
+
+func decodeItem(data []byte) (Item, int, error) {
+	if len(data) < headerSize {
+		return Item{}, 0, errors.New("kmip: truncated item header")
+	}
+	it := Item{
+		Tag:  Tag(data[0])<<16 | Tag(data[1])<<8 | Tag(data[2]),
+		Type: Type(data[3]),
+	}
+	length := int(binary.BigEndian.Uint32(data[4:8]))
+	total := headerSize + length + padding(length)
+	if length > len(data)-headerSize || total > len(data) {
+		return Item{}, 0, errors.New("kmip: item length exceeds available data")
+	}
+	value := data[headerSize : headerSize+length]
+	switch it.Type {
+	case TypeStructure:
+		var items []Item
+		for len(value) > 0 {
+			child, n, err := decodeItem(value)
+			if err != nil {
+				return Item{}, 0, err
+			}
+			items = append(items, child)
+			value = value[n:]
+		}
+		it.Value = items
+	case TypeInteger, TypeEnumeration, TypeInterval:
+		if length != 4 {
+			return Item{}, 0, invalidLength(it, length)
+		}
+		it.Value = int32(binary.BigEndian.Uint32(value))
+	case TypeLongInteger, TypeDateTime, TypeBoolean:
+		if length != 8 {
+			return Item{}, 0, invalidLength(it, length)
+		}
+		v := binary.BigEndian.Uint64(value)
+		switch it.Type {
+		case TypeLongInteger:
+			it.Value = int64(v)
+		case TypeDateTime:
+			it.Value = time.Unix(int64(v), 0).UTC()
+		default:
+			it.Value = v != 0
+		}
+	case TypeTextString:
+		it.Value = string(value)
+	case TypeByteString:
+		it.Value = append([]byte{}, value...)
+	default:
+		return Item{}, 0, fmt.Errorf("kmip: unsupported item type %#x", it.Type)
+	}
+	return it, total, nil
+}
+
+// messageLength returns the total size of the message whose header is in
+// header.
+func messageLength(header []byte) (int, error) {
+	if Type(header[3]) != TypeStructure {
+		return 0, errors.New("kmip: message is not a structure")
+	}
+	length := int(binary.BigEndian.Uint32(header[4:8]))
+	if length > MaxMessageSize {
+		return 0, fmt.Errorf("kmip: message of %v bytes exceeds the maximum size", length)
+	}
+	return headerSize + length + padding(length), nil
+}
+
+func padding(n int) int {
+	return (8 - n%8) % 8
+}
+
+func typeMismatch(it Item) error {
+	return fmt.Errorf("kmip: value of type %T does not match item type %#x for tag %#x", it.Value, it.Type, it.Tag)
+}
+
+func invalidLength(it Item, length int) error {
+	return fmt.Errorf("kmip: invalid length %v for item type %#x", length, it.Type)
+}
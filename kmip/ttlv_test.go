@@ -0,0 +1,133 @@
+package kmip
+
+import (
+	"bytes"
+	"encoding/hex"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMarshalRoundTrip(t *testing.T) {
+	it := Structure(TagRequestMessage,
+		Integer(TagBatchCount, -7),
+		Enum(TagOperation, OperationEncrypt),
+		Item{TagTagLength, TypeLongInteger, int64(1) << 40},
+		Bool(TagRandomIV, true),
+		Text(TagUniqueIdentifier, "4e0a4e5c"),
+		Bytes(TagData, []byte{1, 2, 3}),
+		DateTime(TagTimeStamp, time.Unix(1700000000, 0).UTC()),
+		Structure(TagAttribute),
+		Item{TagAttributeValue, TypeInterval, int32(60)},
+	)
+	data, err := Marshal(it)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(data)%8 != 0 {
+		t.Fatalf("encoding of %v bytes is not padded to 8 bytes", len(data))
+	}
+	decoded, err := Unmarshal(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Empty structures decode to a nil slice.
+	it.Value.([]Item)[7].Value = []Item(nil)
+	if !reflect.DeepEqual(decoded, it) {
+		t.Fatalf("got %#v, want %#v", decoded, it)
+	}
+}
+
+// TestMarshalSpecExample checks the encoding against the examples in the
+// KMIP 1.4 specification, section 9.1.2.
+func TestMarshalSpecExample(t *testing.T) {
+	tests := []struct {
+		item Item
+		hex  string
+	}{
+		{Integer(0x420020, 8), "42002002000000040000000800000000"},
+		{Item{0x420020, TypeLongInteger, int64(123456789000000000)}, "420020030000000801b69b4ba5749200"},
+		{Enum(0x420020, 255), "4200200500000004000000ff00000000"},
+		{Bool(0x420020, true), "42002006000000080000000000000001"},
+		{Text(0x420020, "Hello World"), "420020070000000b48656c6c6f20576f726c640000000000"},
+		{Bytes(0x420020, []byte{1, 2, 3}), "42002008000000030102030000000000"},
+		{Structure(0x420020, Enum(0x420004, 254), Integer(0x420005, 255)),
+			"42002001000000204200040500000004000000fe000000004200050200000004000000ff00000000"},
+	}
+	for _, test := range tests {
+		data, err := Marshal(test.item)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := hex.EncodeToString(data); got != test.hex {
+			t.Errorf("%v: got %v, want %v", test.item, got, test.hex)
+		}
+	}
+}
+
+func TestUnmarshalErrors(t *testing.T) {
+	valid, _ := Marshal(Structure(TagBatchItem, Integer(TagBatchCount, 1)))
+	tests := []struct {
+		name string
+		data []byte
+		err  string
+	}{
+		{"empty", nil, "truncated item header"},
+		{"truncated", valid[:len(valid)-4], "exceeds available data"},
+		{"trailing data", append(append([]byte{}, valid...), make([]byte, 8)...), "trailing data"},
+		{"bad integer length", mustHex("4200200200000008000000000000000800000000"), "invalid length"},
+		{"unknown type", mustHex("4200200b0000000000000000"), "unsupported item type"},
+	}
+	for _, test := range tests {
+		if _, err := Unmarshal(test.data); err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("%v: got %v, want %q", test.name, err, test.err)
+		}
+	}
+}
+
+func TestMarshalTypeMismatch(t *testing.T) {
+	if _, err := Marshal(Item{TagData, TypeByteString, "not bytes"}); err == nil {
+		t.Fatal("value of the wrong type was encoded")
+	}
+}
+
+func TestMessageRoundTrip(t *testing.T) {
+	var buf bytes.Buffer
+	request := NewRequest(OperationLocate, Text(TagUniqueIdentifier, "id"))
+	if err := WriteMessage(&buf, request); err != nil {
+		t.Fatal(err)
+	}
+	read, err := ReadMessage(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	operation, payload, err := ParseRequest(read)
+	if err != nil || operation != OperationLocate {
+		t.Fatalf("got %v, %v", operation, err)
+	}
+	if id, _ := payload.String(TagUniqueIdentifier); id != "id" {
+		t.Fatalf("got %q", id)
+	}
+
+	_, err = ParseResponse(NewErrorResponse(OperationLocate, ResultReasonItemNotFound, "not found"), OperationLocate)
+	kmipErr, ok := err.(*Error)
+	if !ok || kmipErr.Reason != ResultReasonItemNotFound || kmipErr.Message != "not found" {
+		t.Fatalf("got %v", err)
+	}
+}
+
+func TestReadMessageSizeLimit(t *testing.T) {
+	header := mustHex("42007801" + "7fffffff")
+	if _, err := ReadMessage(bytes.NewReader(header)); err == nil {
+		t.Fatal("oversized message was read")
+	}
+}
+
+func mustHex(s string) []byte {
+	data, err := hex.DecodeString(s)
+	if err != nil {
+		panic(err)
+	}
+	return data
+}
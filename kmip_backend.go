@@ -0,0 +1,272 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/fortanix/k8s-sdkms-plugin/kmip"
+)
+
+// kmipConfig selects the KMIP backend, which reaches DSM over KMIP with
+// client certificate authentication instead of the REST API.
+type kmipConfig struct {
+	// Endpoint is the host:port of the KMIP server, e.g. "sdkms.fortanix.com:5696".
+	Endpoint   *string `json:"endpoint,omitempty"`
+	ClientCert *string `json:"client_cert,omitempty"`
+	ClientKey  *string `json:"client_key,omitempty"`
+	// CACert is used to verify the server. The system roots are used if it
+	// is not set.
+	CACert *string `json:"ca_cert,omitempty"`
+}
+
+func (c kmipConfig) validate() error {
+	if c.Endpoint == nil {
+		return errors.New("required field `kmip.endpoint` is missing")
+	}
+	if c.ClientCert == nil {
+		return errors.New("required field `kmip.client_cert` is missing")
+	}
+	if c.ClientKey == nil {
+		return errors.New("required field `kmip.client_key` is missing")
+	}
+	return nil
+}
+
+func (c kmipConfig) tlsConfig() (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(*c.ClientCert, *c.ClientKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load KMIP client certificate: %v", err)
+	}
+	config := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+	if c.CACert != nil {
+		pem, err := os.ReadFile(*c.CACert)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read KMIP CA certificate: %v", err)
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %v", *c.CACert)
+		}
+	}
+	return config, nil
+}
+
+// kmipBackend performs the same AES-GCM wrap as dsmBackend through KMIP
+// Encrypt and Decrypt operations.
+type kmipBackend struct {
+	config  pluginConfig
+	client  *kmip.Client
+	lineage *keyLineage
+
+	// uid is the key `key_name` resolved to, looked up again by the key
+	// monitor through DescribeKey and after Encrypt fails.
+	mu  sync.Mutex
+	uid string
+}
+
+func newKmipBackend(config pluginConfig) (Backend, error) {
+	tlsConfig, err := config.Kmip.tlsConfig()
+	if err != nil {
+		return nil, err
+	}
+	return &kmipBackend{
+		config:  config,
+		client:  &kmip.Client{Addr: *config.Kmip.Endpoint, TLSConfig: tlsConfig},
+		lineage: newKeyLineage(config.AllowedKeyIDs),
+	}, nil
+}
+
+func (b *kmipBackend) Wrap(ctx context.Context, plain []byte) (*wrappedData, error) {
+	uid, err := b.keyUID(ctx)
+	if err != nil {
+		return nil, err
+	}
+	result, err := b.encrypt(ctx, uid, plain)
+	if err != nil && b.config.KeyID == nil {
+		// The key may have been replaced under the same name.
+		b.forgetKey()
+		var kmipErr *kmip.Error
+		if errors.As(err, &kmipErr) && kmipErr.Reason == kmip.ResultReasonItemNotFound {
+			if uid, err = b.keyUID(ctx); err != nil {
+				return nil, err
+			}
+			result, err = b.encrypt(ctx, uid, plain)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &wrappedData{
+		KID:    result.UniqueIdentifier,
+		Cipher: result.Data,
+		IV:     result.IV,
+		Tag:    result.Tag,
+	}, nil
+}
+
+func (b *kmipBackend) encrypt(ctx context.Context, uid string, plain []byte) (*kmip.EncryptResult, error) {
+	var result *kmip.EncryptResult
+	err := b.config.withDsmContext(ctx, func(ctx context.Context) (err error) {
+		result, err = b.client.Encrypt(ctx, uid, plain)
+		return err
+	})
+	return result, err
+}
+
+func (b *kmipBackend) Unwrap(ctx context.Context, data *wrappedData) ([]byte, error) {
+	if err := b.lineage.check(ctx, data.KID, b.walkLineage); err != nil {
+		return nil, err
+	}
+	var plain []byte
+	err := b.config.withDsmContext(ctx, func(ctx context.Context) (err error) {
+		plain, err = b.client.Decrypt(ctx, data.KID, data.Cipher, data.IV, data.Tag)
+		return err
+	})
+	return plain, err
+}
+
+func (b *kmipBackend) DescribeKey(ctx context.Context) (*KeyInfo, error) {
+	uid, err := b.resolveKey(ctx)
+	if err != nil {
+		return nil, err
+	}
+	b.mu.Lock()
+	b.uid = uid
+	b.mu.Unlock()
+	var attrs map[string]kmip.Item
+	err = b.config.withDsmContext(ctx, func(ctx context.Context) (err error) {
+		attrs, err = b.client.GetAttributes(ctx, uid,
+			kmip.AttributeNameName, kmip.AttributeNameState, kmip.AttributeNameCryptoAlgorithm,
+			kmip.AttributeNameCryptoLength, kmip.AttributeNameUsageMask,
+			kmip.AttributeNameActivation, kmip.AttributeNameDeactivation)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	info := &KeyInfo{KID: uid}
+	if name, ok := attrs[kmip.AttributeNameName]; ok {
+		info.Name, _ = name.String(kmip.TagNameValue)
+	}
+	if state, ok := attrs[kmip.AttributeNameState].Value.(int32); ok {
+		info.Enabled = state == kmip.StateActive
+	}
+	if alg, ok := attrs[kmip.AttributeNameCryptoAlgorithm].Value.(int32); ok {
+		info.Type = fmt.Sprintf("KMIP algorithm %#x", alg)
+		if alg == kmip.CryptographicAlgorithmAES {
+			info.Type = keyTypeAes
+		}
+	}
+	if length, ok := attrs[kmip.AttributeNameCryptoLength].Value.(int32); ok {
+		info.Size = int(length)
+	}
+	if mask, ok := attrs[kmip.AttributeNameUsageMask].Value.(int32); ok {
+		info.Operations = &keyOperations{
+			Encrypt: mask&kmip.CryptographicUsageMaskEncrypt != 0,
+			Decrypt: mask&kmip.CryptographicUsageMaskDecrypt != 0,
+		}
+	}
+	if date, ok := attrs[kmip.AttributeNameActivation].Value.(time.Time); ok {
+		info.ActivationDate = date
+	}
+	if date, ok := attrs[kmip.AttributeNameDeactivation].Value.(time.Time); ok {
+		info.DeactivationDate = date
+	}
+	return info, nil
+}
+
+func (b *kmipBackend) Health(ctx context.Context) error {
+	err := b.config.withDsmContext(ctx, b.client.DiscoverVersions)
+	if err != nil {
+		return fmt.Errorf("KMIP server is not reachable: %v", err)
+	}
+	return nil
+}
+
+// keyUID returns the unique identifier of the configured key, looking it
+// up by name only if it is not known yet.
+func (b *kmipBackend) keyUID(ctx context.Context) (string, error) {
+	b.mu.Lock()
+	uid := b.uid
+	b.mu.Unlock()
+	if uid != "" {
+		return uid, nil
+	}
+	uid, err := b.resolveKey(ctx)
+	if err != nil {
+		return "", err
+	}
+	b.mu.Lock()
+	b.uid = uid
+	b.mu.Unlock()
+	return uid, nil
+}
+
+func (b *kmipBackend) forgetKey() {
+	b.mu.Lock()
+	b.uid = ""
+	b.mu.Unlock()
+}
+
+// resolveKey returns the unique identifier of the configured key, looking
+// it up by name if the key was not configured by ID.
+func (b *kmipBackend) resolveKey(ctx context.Context) (string, error) {
+	if b.config.KeyID != nil {
+		return *b.config.KeyID, nil
+	}
+	var ids []string
+	err := b.config.withDsmContext(ctx, func(ctx context.Context) (err error) {
+		ids, err = b.client.Locate(ctx, *b.config.KeyName)
+		return err
+	})
+	if err != nil {
+		return "", err
+	}
+	switch len(ids) {
+	case 0:
+		return "", &kmip.Error{Status: kmip.ResultStatusOperationFailed, Reason: kmip.ResultReasonItemNotFound,
+			Message: fmt.Sprintf("no key named %q", *b.config.KeyName)}
+	case 1:
+		return ids[0], nil
+	}
+	return "", fmt.Errorf("%v keys are named %q", len(ids), *b.config.KeyName)
+}
+
+// walkLineage follows the Replaced Object links from the configured key,
+// looked up afresh since another node may have re-keyed it. The walk ends
+// at a key whose links cannot be read, e.g. because it was destroyed.
+func (b *kmipBackend) walkLineage(ctx context.Context, visit func(kid string) bool) error {
+	uid, err := b.resolveKey(ctx)
+	if err != nil {
+		return err
+	}
+	seen := make(map[string]bool)
+	for depth := 0; depth < maxLineageDepth && uid != "" && !seen[uid]; depth++ {
+		seen[uid] = true
+		if visit(uid) {
+			return nil
+		}
+		var replaced string
+		err := b.config.withDsmContext(ctx, func(ctx context.Context) (err error) {
+			replaced, err = b.client.Replaced(ctx, uid)
+			return err
+		})
+		if err != nil {
+			if depth == 0 {
+				return err
+			}
+			return nil
+		}
+		uid = replaced
+	}
+	return nil
+}
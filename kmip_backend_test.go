@@ -0,0 +1,253 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/fortanix/k8s-sdkms-plugin/kmip"
+	"github.com/fortanix/k8s-sdkms-plugin/kmip/kmiptest"
+	"google.golang.org/grpc/codes"
+)
+
+// newKmipTestServer starts a kmiptest server that requires a client
+// certificate, and returns a config whose `kmip` section reaches it.
+func newKmipTestServer(t *testing.T) (*kmiptest.Server, pluginConfig) {
+	dir := t.TempDir()
+	caKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca, _ := x509.ParseCertificate(caDER)
+	issue := func(serial int64, usage x509.ExtKeyUsage) ([]byte, *ecdsa.PrivateKey) {
+		key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		template := &x509.Certificate{
+			SerialNumber: big.NewInt(serial),
+			Subject:      pkix.Name{CommonName: "localhost"},
+			NotBefore:    time.Now().Add(-time.Hour),
+			NotAfter:     time.Now().Add(time.Hour),
+			ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+			IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		}
+		der, err := x509.CreateCertificate(rand.Reader, template, ca, &key.PublicKey, caKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return der, key
+	}
+	writePEM := func(name, kind string, der []byte) string {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: kind, Bytes: der}), 0600); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+
+	serverDER, serverKey := issue(2, x509.ExtKeyUsageServerAuth)
+	clientDER, clientKey := issue(3, x509.ExtKeyUsageClientAuth)
+	clientKeyDER, _ := x509.MarshalECPrivateKey(clientKey)
+	roots := x509.NewCertPool()
+	roots.AddCert(ca)
+	server, err := kmiptest.NewServer(&tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{serverDER}, PrivateKey: serverKey}},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    roots,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { server.Close() })
+
+	endpoint := server.Addr()
+	certFile := writePEM("client.crt", "CERTIFICATE", clientDER)
+	keyFile := writePEM("client.key", "EC PRIVATE KEY", clientKeyDER)
+	caFile := writePEM("ca.crt", "CERTIFICATE", caDER)
+	return server, pluginConfig{Kmip: &kmipConfig{
+		Endpoint:   &endpoint,
+		ClientCert: &certFile,
+		ClientKey:  &keyFile,
+		CACert:     &caFile,
+	}}
+}
+
+func newTestKey() []byte {
+	key := make([]byte, 32)
+	rand.Read(key)
+	return key
+}
+
+func TestKmipBackendRoundTrip(t *testing.T) {
+	server, config := newKmipTestServer(t)
+	server.AddKey("uid-1", "kek", newTestKey())
+	server.AddKey("uid-other", "other", newTestKey())
+	name := "kek"
+	config.KeyName = &name
+	backend, err := newKmipBackend(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+
+	for i := 0; i < 3; i++ {
+		wrapped, err := backend.Wrap(ctx, []byte("dek"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if wrapped.KID != "uid-1" {
+			t.Fatalf("wrapped with %v", wrapped.KID)
+		}
+		plain, err := backend.Unwrap(ctx, wrapped)
+		if err != nil || !bytes.Equal(plain, []byte("dek")) {
+			t.Fatalf("got %q, %v", plain, err)
+		}
+	}
+	// Once for Wrap and once for the lineage on the first Unwrap.
+	if n := server.Requests(kmip.OperationLocate); n != 2 {
+		t.Fatalf("key located %v times, want twice", n)
+	}
+
+	info, err := backend.DescribeKey(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.KID != "uid-1" || info.Name != "kek" || info.Type != keyTypeAes || info.Size != 256 || !info.Enabled {
+		t.Fatalf("got %+v", info)
+	}
+	if err := backend.Health(ctx); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestKmipBackendKeyReplaced(t *testing.T) {
+	server, config := newKmipTestServer(t)
+	server.AddKey("uid-1", "kek", newTestKey())
+	name := "kek"
+	config.KeyName = &name
+	backend, err := newKmipBackend(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	if _, err := backend.Wrap(ctx, []byte("dek")); err != nil {
+		t.Fatal(err)
+	}
+
+	server.RemoveKey("uid-1")
+	server.AddKey("uid-2", "kek", newTestKey())
+	wrapped, err := backend.Wrap(ctx, []byte("dek"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if wrapped.KID != "uid-2" {
+		t.Fatalf("wrapped with %v after the key was replaced", wrapped.KID)
+	}
+}
+
+func TestKmipBackendLineage(t *testing.T) {
+	server, config := newKmipTestServer(t)
+	server.AddKey("uid-1", "kek", newTestKey())
+	server.AddKey("uid-other", "other", newTestKey())
+	server.AddKey("uid-allowed", "allowed", newTestKey())
+	name := "kek"
+	config.KeyName = &name
+	config.AllowedKeyIDs = []string{"uid-allowed"}
+	backend, err := newKmipBackend(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	old, err := backend.Wrap(ctx, []byte("dek"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := backend.Unwrap(ctx, old); err != nil {
+		t.Fatal(err)
+	}
+
+	// Another node re-keys right after the lineage was looked up: new
+	// ciphertext names the new key and old ciphertext the replaced one.
+	server.ReKey("uid-1", "uid-2", newTestKey())
+	other, _ := newKmipBackend(config)
+	wrapped, err := other.Wrap(ctx, []byte("dek"))
+	if err != nil || wrapped.KID != "uid-2" {
+		t.Fatalf("got %+v, %v", wrapped, err)
+	}
+	for _, data := range []*wrappedData{wrapped, old} {
+		if plain, err := backend.Unwrap(ctx, data); err != nil || !bytes.Equal(plain, []byte("dek")) {
+			t.Fatalf("key %v: got %q, %v", data.KID, plain, err)
+		}
+	}
+
+	for kid, allowed := range map[string]bool{"uid-other": false, "uid-allowed": true} {
+		data := *old
+		data.KID = kid
+		_, err := backend.Unwrap(ctx, &data)
+		if code, reason, _ := classifyError(err); allowed != (reason != reasonKeyNotAllowed) {
+			t.Fatalf("key %v: got %v, %v: %v", kid, code, reason, err)
+		}
+	}
+}
+
+func TestKmipBackendErrors(t *testing.T) {
+	server, config := newKmipTestServer(t)
+	server.AddKey("uid-1", "kek", newTestKey())
+	server.AddKey("uid-2", "twin", newTestKey())
+	server.AddKey("uid-3", "twin", newTestKey())
+	ctx := context.Background()
+
+	missing := "missing"
+	config.KeyName = &missing
+	backend, _ := newKmipBackend(config)
+	_, err := backend.Wrap(ctx, []byte("dek"))
+	if code, reason, _ := classifyError(err); code != codes.FailedPrecondition || reason != reasonDsmKeyNotFound {
+		t.Fatalf("missing key: got %v, %v: %v", code, reason, err)
+	}
+
+	twin := "twin"
+	config.KeyName = &twin
+	backend, _ = newKmipBackend(config)
+	if _, err := backend.Wrap(ctx, []byte("dek")); err == nil {
+		t.Fatal("ambiguous name was resolved")
+	}
+
+	name := "kek"
+	config.KeyName = &name
+	backend, _ = newKmipBackend(config)
+	wrapped, err := backend.Wrap(ctx, []byte("dek"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	wrapped.Tag[0] ^= 1
+	_, err = backend.Unwrap(ctx, wrapped)
+	if code, reason, _ := classifyError(err); code != codes.InvalidArgument || reason != reasonInvalidCiphertext {
+		t.Fatalf("tampered ciphertext: got %v, %v: %v", code, reason, err)
+	}
+
+	server.SetState("uid-1", kmip.StateDeactivated)
+	_, err = backend.Wrap(ctx, []byte("dek"))
+	if code, _, _ := classifyError(err); code != codes.PermissionDenied {
+		t.Fatalf("deactivated key: got %v: %v", code, err)
+	}
+}
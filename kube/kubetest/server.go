@@ -0,0 +1,250 @@
+// Package kubetest provides an in-process fake of the Kubernetes API server
+// that stores arbitrary JSON objects, enough to exercise the plugin's use
+// of leases and storage migration without a cluster.
+package kubetest
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// resources are the collection names the server recognizes at the end of
+// a request path.
+var resources = map[string]bool{
+	"leases":                   true,
+	"secrets":                  true,
+	"storageversionmigrations": true,
+}
+
+type object = map[string]interface{}
+
+// Server is a fake API server. Objects are kept per collection path, e.g.
+// "/apis/coordination.k8s.io/v1/namespaces/kube-system/leases", with
+// optimistic concurrency on metadata.resourceVersion like the real one.
+// Listing a namespaced resource without a namespace lists all namespaces,
+// in pages if the request sets limit.
+// Unlike the real one, it completes StorageVersionMigrations as soon as
+// they are created.
+type Server struct {
+	*httptest.Server
+
+	mu          sync.Mutex
+	collections map[string]map[string]object
+	version     int
+	requests    map[string]int
+}
+
+// NewServer starts a server that accepts any client.
+func NewServer() *Server {
+	s := &Server{
+		collections: make(map[string]map[string]object),
+		requests:    make(map[string]int),
+	}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.handle))
+	return s
+}
+
+// Create stores obj in collection, as if it had been POSTed.
+func (s *Server) Create(collection string, obj interface{}) error {
+	content, err := json.Marshal(obj)
+	if err != nil {
+		return err
+	}
+	var o object
+	if err := json.Unmarshal(content, &o); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, err = s.createLocked(collection, o)
+	return err
+}
+
+// Get returns the object at path, decoded into out.
+func (s *Server) Get(objectPath string, out interface{}) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	o, ok := s.collections[path.Dir(objectPath)][path.Base(objectPath)]
+	if !ok {
+		return false
+	}
+	content, _ := json.Marshal(o)
+	return json.Unmarshal(content, out) == nil
+}
+
+// Requests returns how many requests with method were made to path.
+func (s *Server) Requests(method, path string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.requests[method+" "+path]
+}
+
+func (s *Server) handle(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.requests[r.Method+" "+r.URL.Path]++
+
+	p := strings.TrimSuffix(r.URL.Path, "/")
+	isCollection := resources[path.Base(p)]
+	var body object
+	if r.Method == http.MethodPost || r.Method == http.MethodPut {
+		content, err := io.ReadAll(r.Body)
+		if err == nil {
+			err = json.Unmarshal(content, &body)
+		}
+		if err != nil {
+			writeStatus(w, http.StatusBadRequest, err.Error())
+			return
+		}
+	}
+
+	switch {
+	case isCollection && r.Method == http.MethodGet:
+		items := []object{}
+		for collection, objects := range s.collections {
+			if collection != p && !inAllNamespaces(collection, p) {
+				continue
+			}
+			for _, o := range objects {
+				items = append(items, o)
+			}
+		}
+		// Sort so that continue tokens, which are offsets, stay valid.
+		sort.Slice(items, func(i, j int) bool {
+			return objectKey(items[i]) < objectKey(items[j])
+		})
+		meta := object{}
+		query := r.URL.Query()
+		offset, _ := strconv.Atoi(query.Get("continue"))
+		if offset > len(items) {
+			offset = len(items)
+		}
+		items = items[offset:]
+		if limit, _ := strconv.Atoi(query.Get("limit")); limit > 0 && len(items) > limit {
+			items = items[:limit]
+			meta["continue"] = strconv.Itoa(offset + limit)
+		}
+		writeJSON(w, http.StatusOK, object{"kind": "List", "metadata": meta, "items": items})
+	case isCollection && r.Method == http.MethodPost:
+		if path.Base(p) == "storageversionmigrations" {
+			body["status"] = object{"conditions": []object{{"type": "Succeeded", "status": "True"}}}
+		}
+		o, err := s.createLocked(p, body)
+		if err != nil {
+			writeStatus(w, http.StatusConflict, err.Error())
+			return
+		}
+		writeJSON(w, http.StatusCreated, o)
+	case !isCollection && r.Method == http.MethodGet:
+		o, ok := s.collections[path.Dir(p)][path.Base(p)]
+		if !ok {
+			writeStatus(w, http.StatusNotFound, "not found")
+			return
+		}
+		writeJSON(w, http.StatusOK, o)
+	case !isCollection && r.Method == http.MethodPut:
+		s.update(w, path.Dir(p), path.Base(p), body)
+	case !isCollection && r.Method == http.MethodDelete:
+		if _, ok := s.collections[path.Dir(p)][path.Base(p)]; !ok {
+			writeStatus(w, http.StatusNotFound, "not found")
+			return
+		}
+		delete(s.collections[path.Dir(p)], path.Base(p))
+		writeStatus(w, http.StatusOK, "deleted")
+	default:
+		writeStatus(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
+
+func (s *Server) update(w http.ResponseWriter, collection, name string, body object) {
+	current, ok := s.collections[collection][name]
+	if !ok {
+		writeStatus(w, http.StatusNotFound, "not found")
+		return
+	}
+	if rv := resourceVersion(body); rv != "" && rv != resourceVersion(current) {
+		writeStatus(w, http.StatusConflict, "the object has been modified")
+		return
+	}
+	s.stamp(body, collection, name)
+	s.collections[collection][name] = body
+	writeJSON(w, http.StatusOK, body)
+}
+
+type conflictError string
+
+func (e conflictError) Error() string { return string(e) }
+
+func (s *Server) createLocked(collection string, o object) (object, error) {
+	meta, _ := o["metadata"].(map[string]interface{})
+	name, _ := meta["name"].(string)
+	if name == "" {
+		return nil, conflictError("metadata.name is required")
+	}
+	if s.collections[collection] == nil {
+		s.collections[collection] = make(map[string]object)
+	}
+	if _, exists := s.collections[collection][name]; exists {
+		return nil, conflictError("already exists")
+	}
+	s.stamp(o, collection, name)
+	s.collections[collection][name] = o
+	return o, nil
+}
+
+// stamp gives o a new resourceVersion.
+func (s *Server) stamp(o object, collection, name string) {
+	meta, ok := o["metadata"].(map[string]interface{})
+	if !ok {
+		meta = make(map[string]interface{})
+		o["metadata"] = meta
+	}
+	s.version++
+	meta["name"] = name
+	if i := strings.Index(collection, "/namespaces/"); i >= 0 {
+		meta["namespace"] = strings.SplitN(collection[i+len("/namespaces/"):], "/", 2)[0]
+	}
+	meta["resourceVersion"] = strconv.Itoa(s.version)
+}
+
+// inAllNamespaces reports whether collection is a namespace's part of the
+// cluster-wide collection all, e.g. "/api/v1/namespaces/default/secrets"
+// of "/api/v1/secrets".
+func inAllNamespaces(collection, all string) bool {
+	i := strings.Index(collection, "/namespaces/")
+	if i < 0 || collection[:i] != path.Dir(all) {
+		return false
+	}
+	return path.Base(collection) == path.Base(all) && strings.Count(collection[i:], "/") == 3
+}
+
+// objectKey orders objects by namespace and name.
+func objectKey(o object) string {
+	meta, _ := o["metadata"].(map[string]interface{})
+	namespace, _ := meta["namespace"].(string)
+	name, _ := meta["name"].(string)
+	return namespace + "/" + name
+}
+
+func resourceVersion(o object) string {
+	meta, _ := o["metadata"].(map[string]interface{})
+	rv, _ := meta["resourceVersion"].(string)
+	return rv
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeStatus(w http.ResponseWriter, code int, message string) {
+	writeJSON(w, code, object{"kind": "Status", "code": code, "message": message})
+}
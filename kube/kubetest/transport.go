@@ -0,0 +1,14 @@
+package kubetest
+
+import "net/http"
+
+// HookTransport calls Before with every request before sending it, e.g. to
+// have another client change the server in the middle of an operation.
+type HookTransport struct {
+	Before func(r *http.Request)
+}
+
+func (t HookTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	t.Before(r)
+	return http.DefaultTransport.RoundTrip(r)
+}
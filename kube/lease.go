@@ -0,0 +1,138 @@
+package kube
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// microTimeLayout is the format of MicroTime fields in the Kubernetes API.
+const microTimeLayout = "2006-01-02T15:04:05.000000Z07:00"
+
+// ObjectMeta holds the metadata fields the plugin uses.
+type ObjectMeta struct {
+	Name            string            `json:"name"`
+	Namespace       string            `json:"namespace,omitempty"`
+	ResourceVersion string            `json:"resourceVersion,omitempty"`
+	Labels          map[string]string `json:"labels,omitempty"`
+	Annotations     map[string]string `json:"annotations,omitempty"`
+}
+
+// Lease is a coordination.k8s.io/v1 Lease.
+type Lease struct {
+	APIVersion string     `json:"apiVersion"`
+	Kind       string     `json:"kind"`
+	Metadata   ObjectMeta `json:"metadata"`
+	Spec       LeaseSpec  `json:"spec"`
+}
+
+// LeaseSpec holds the fields of a Lease used for leader election.
+type LeaseSpec struct {
+	HolderIdentity       *string `json:"holderIdentity,omitempty"`
+	LeaseDurationSeconds *int32  `json:"leaseDurationSeconds,omitempty"`
+	AcquireTime          *string `json:"acquireTime,omitempty"`
+	RenewTime            *string `json:"renewTime,omitempty"`
+}
+
+func leasePath(namespace, name string) string {
+	path := fmt.Sprintf("/apis/coordination.k8s.io/v1/namespaces/%v/leases", namespace)
+	if name != "" {
+		path += "/" + name
+	}
+	return path
+}
+
+// heldBy returns the identity holding the lease at now, or "" if the lease
+// is free or expired.
+func (l *Lease) heldBy(now time.Time) string {
+	s := l.Spec
+	if s.HolderIdentity == nil || s.RenewTime == nil || s.LeaseDurationSeconds == nil {
+		return ""
+	}
+	renewed, err := time.Parse(microTimeLayout, *s.RenewTime)
+	if err != nil {
+		return ""
+	}
+	if now.After(renewed.Add(time.Duration(*s.LeaseDurationSeconds) * time.Second)) {
+		return ""
+	}
+	return *s.HolderIdentity
+}
+
+// TryAcquireLease takes the lease namespace/name for identity for the given
+// duration, creating it if needed. It returns false without error if
+// another identity holds the lease, or took it concurrently.
+func (c *Client) TryAcquireLease(ctx context.Context, namespace, name, identity string, duration time.Duration) (bool, error) {
+	now := time.Now()
+	stamp := now.UTC().Format(microTimeLayout)
+	seconds := int32(duration / time.Second)
+	spec := LeaseSpec{
+		HolderIdentity:       &identity,
+		LeaseDurationSeconds: &seconds,
+		AcquireTime:          &stamp,
+		RenewTime:            &stamp,
+	}
+
+	var lease Lease
+	err := c.Do(ctx, http.MethodGet, leasePath(namespace, name), nil, &lease)
+	if IsNotFound(err) {
+		lease = Lease{
+			APIVersion: "coordination.k8s.io/v1",
+			Kind:       "Lease",
+			Metadata:   ObjectMeta{Name: name, Namespace: namespace},
+			Spec:       spec,
+		}
+		err = c.Do(ctx, http.MethodPost, leasePath(namespace, ""), &lease, nil)
+		if IsConflict(err) {
+			return false, nil
+		}
+		return err == nil, err
+	}
+	if err != nil {
+		return false, err
+	}
+	holder := lease.heldBy(now)
+	if holder != "" && holder != identity {
+		return false, nil
+	}
+	if holder == identity {
+		spec.AcquireTime = lease.Spec.AcquireTime
+	}
+	// The resourceVersion read above makes the update fail if another
+	// identity changed the lease in the meantime.
+	lease.Spec = spec
+	err = c.Do(ctx, http.MethodPut, leasePath(namespace, name), &lease, nil)
+	if IsConflict(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// LeaseAnnotation returns the value of annotation key on the lease
+// namespace/name, or "" if the lease or annotation does not exist.
+func (c *Client) LeaseAnnotation(ctx context.Context, namespace, name, key string) (string, error) {
+	var lease Lease
+	err := c.Do(ctx, http.MethodGet, leasePath(namespace, name), nil, &lease)
+	if IsNotFound(err) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	return lease.Metadata.Annotations[key], nil
+}
+
+// SetLeaseAnnotation sets annotation key on the existing lease
+// namespace/name, leaving its holder alone.
+func (c *Client) SetLeaseAnnotation(ctx context.Context, namespace, name, key, value string) error {
+	var lease Lease
+	if err := c.Do(ctx, http.MethodGet, leasePath(namespace, name), nil, &lease); err != nil {
+		return err
+	}
+	if lease.Metadata.Annotations == nil {
+		lease.Metadata.Annotations = make(map[string]string)
+	}
+	lease.Metadata.Annotations[key] = value
+	return c.Do(ctx, http.MethodPut, leasePath(namespace, name), &lease, nil)
+}
@@ -0,0 +1,143 @@
+package kube
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/fortanix/k8s-sdkms-plugin/kube/kubetest"
+)
+
+const (
+	testLeaseNamespace = "kube-system"
+	testLeaseName      = "test-lease"
+)
+
+func testLeaseHolder(t *testing.T, server *kubetest.Server) string {
+	t.Helper()
+	var lease Lease
+	if !server.Get(leasePath(testLeaseNamespace, testLeaseName), &lease) {
+		t.Fatal("lease does not exist")
+	}
+	if lease.Spec.HolderIdentity == nil {
+		return ""
+	}
+	return *lease.Spec.HolderIdentity
+}
+
+// createExpiredLease creates the test lease, held by holder until a minute
+// ago.
+func createExpiredLease(t *testing.T, server *kubetest.Server, holder string) {
+	t.Helper()
+	seconds := int32(60)
+	renewed := time.Now().Add(-2 * time.Minute).UTC().Format(microTimeLayout)
+	err := server.Create(leasePath(testLeaseNamespace, ""), Lease{
+		APIVersion: "coordination.k8s.io/v1",
+		Kind:       "Lease",
+		Metadata:   ObjectMeta{Name: testLeaseName, Namespace: testLeaseNamespace},
+		Spec:       LeaseSpec{HolderIdentity: &holder, LeaseDurationSeconds: &seconds, AcquireTime: &renewed, RenewTime: &renewed},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func tryAcquire(t *testing.T, client *Client, identity string, duration time.Duration) bool {
+	t.Helper()
+	acquired, err := client.TryAcquireLease(context.Background(), testLeaseNamespace, testLeaseName, identity, duration)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return acquired
+}
+
+func TestTryAcquireLeaseContention(t *testing.T) {
+	server := kubetest.NewServer()
+	defer server.Close()
+	client := &Client{Server: server.URL}
+
+	if !tryAcquire(t, client, "a", time.Minute) {
+		t.Fatal("a did not acquire the free lease")
+	}
+	if tryAcquire(t, client, "b", time.Minute) {
+		t.Fatal("b acquired the lease held by a")
+	}
+	var before Lease
+	server.Get(leasePath(testLeaseNamespace, testLeaseName), &before)
+	if !tryAcquire(t, client, "a", time.Minute) {
+		t.Fatal("a did not renew its lease")
+	}
+	var after Lease
+	server.Get(leasePath(testLeaseNamespace, testLeaseName), &after)
+	if *after.Spec.AcquireTime != *before.Spec.AcquireTime {
+		t.Fatalf("renewal changed the acquire time from %v to %v", *before.Spec.AcquireTime, *after.Spec.AcquireTime)
+	}
+	if holder := testLeaseHolder(t, server); holder != "a" {
+		t.Fatalf("lease held by %q", holder)
+	}
+}
+
+func TestTryAcquireLeaseExpired(t *testing.T) {
+	server := kubetest.NewServer()
+	defer server.Close()
+	client := &Client{Server: server.URL}
+
+	createExpiredLease(t, server, "a")
+	if !tryAcquire(t, client, "b", time.Minute) {
+		t.Fatal("b did not acquire the expired lease")
+	}
+	if holder := testLeaseHolder(t, server); holder != "b" {
+		t.Fatalf("lease held by %q", holder)
+	}
+}
+
+// TestTryAcquireLeaseConflict makes b take the lease between a reading and
+// writing it, so that a's write fails on the resourceVersion or because
+// the lease already exists.
+func TestTryAcquireLeaseConflict(t *testing.T) {
+	for _, method := range []string{http.MethodPost, http.MethodPut} {
+		t.Run(method, func(t *testing.T) {
+			server := kubetest.NewServer()
+			defer server.Close()
+			b := &Client{Server: server.URL}
+			if method == http.MethodPut {
+				createExpiredLease(t, server, "c")
+			}
+			a := &Client{Server: server.URL, HTTPClient: &http.Client{Transport: kubetest.HookTransport{
+				Before: func(r *http.Request) {
+					if r.Method == method && !tryAcquire(t, b, "b", time.Minute) {
+						t.Error("b did not acquire the lease")
+					}
+				},
+			}}}
+			if tryAcquire(t, a, "a", time.Minute) {
+				t.Fatal("a acquired the lease after b took it")
+			}
+			if holder := testLeaseHolder(t, server); holder != "b" {
+				t.Fatalf("lease held by %q", holder)
+			}
+		})
+	}
+}
+
+func TestLeaseAnnotation(t *testing.T) {
+	server := kubetest.NewServer()
+	defer server.Close()
+	client := &Client{Server: server.URL}
+	ctx := context.Background()
+
+	if value, err := client.LeaseAnnotation(ctx, testLeaseNamespace, testLeaseName, "k"); err != nil || value != "" {
+		t.Fatalf("got %q, %v for a missing lease", value, err)
+	}
+	tryAcquire(t, client, "a", time.Minute)
+	if err := client.SetLeaseAnnotation(ctx, testLeaseNamespace, testLeaseName, "k", "v"); err != nil {
+		t.Fatal(err)
+	}
+	if value, err := client.LeaseAnnotation(ctx, testLeaseNamespace, testLeaseName, "k"); err != nil || value != "v" {
+		t.Fatalf("got %q, %v", value, err)
+	}
+	if holder := testLeaseHolder(t, server); holder != "a" {
+		t.Fatalf("setting an annotation changed the holder to %q", holder)
+	}
+}
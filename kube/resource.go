@@ -0,0 +1,75 @@
+package kube
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"strconv"
+)
+
+// Resource names a kind of object in the API, e.g. secrets in the core
+// group, version v1.
+type Resource struct {
+	Group    string
+	Version  string
+	Resource string
+}
+
+// Path returns the path of the object namespace/name, of the objects in
+// namespace if name is empty, or of the objects in all namespaces if
+// namespace is empty too.
+func (r Resource) Path(namespace, name string) string {
+	path := "/apis/" + r.Group + "/" + r.Version
+	if r.Group == "" {
+		path = "/api/" + r.Version
+	}
+	if namespace != "" {
+		path += "/namespaces/" + namespace
+	}
+	path += "/" + r.Resource
+	if name != "" {
+		path += "/" + name
+	}
+	return path
+}
+
+// Object is an object of any kind, as decoded from JSON.
+type Object map[string]interface{}
+
+// Metadata returns the name and namespace of o.
+func (o Object) Metadata() (namespace, name string) {
+	meta, _ := o["metadata"].(map[string]interface{})
+	namespace, _ = meta["namespace"].(string)
+	name, _ = meta["name"].(string)
+	return namespace, name
+}
+
+type objectList struct {
+	Items    []Object `json:"items"`
+	Metadata struct {
+		Continue string `json:"continue"`
+	} `json:"metadata"`
+}
+
+// List calls visit with every object of resource in all namespaces, in
+// pages of at most limit objects.
+func (c *Client) List(ctx context.Context, resource Resource, limit int, visit func(page []Object) error) error {
+	token := ""
+	for {
+		query := url.Values{"limit": {strconv.Itoa(limit)}}
+		if token != "" {
+			query.Set("continue", token)
+		}
+		var list objectList
+		if err := c.Do(ctx, http.MethodGet, resource.Path("", "")+"?"+query.Encode(), nil, &list); err != nil {
+			return err
+		}
+		if err := visit(list.Items); err != nil {
+			return err
+		}
+		if list.Metadata.Continue == "" {
+			return nil
+		}
+		token = list.Metadata.Continue
+	}
+}
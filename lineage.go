@@ -0,0 +1,169 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/fortanix/sdkms-client-go/sdkms"
+	"google.golang.org/grpc/codes"
+)
+
+const (
+	// maxLineageDepth bounds how many rotations back the lineage is walked.
+	maxLineageDepth = 64
+	// minLineageRefresh limits how often ciphertext naming an unknown key
+	// can make the plugin walk the whole lineage again.
+	minLineageRefresh = 10 * time.Second
+)
+
+// keyLineage restricts the keys that ciphertext may name on decrypt to the
+// configured key, the keys it replaced through rotation and the explicit
+// `allowed_key_ids`. Without it, anyone able to write to etcd could make
+// the plugin decrypt with any key the app has access to.
+type keyLineage struct {
+	allowlist map[string]bool
+
+	mu        sync.Mutex
+	lineage   map[string]bool
+	refreshed time.Time
+}
+
+func newKeyLineage(allowlist []string) *keyLineage {
+	l := &keyLineage{
+		allowlist: make(map[string]bool, len(allowlist)),
+		lineage:   make(map[string]bool),
+	}
+	for _, kid := range allowlist {
+		l.allowlist[kid] = true
+	}
+	return l
+}
+
+// add records kid, e.g. a key the plugin just rotated to.
+func (l *keyLineage) add(kid string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.lineage[kid] = true
+}
+
+// lineageWalker calls visit for the configured key and then for each key
+// it replaced, newest first, until visit returns true.
+type lineageWalker func(ctx context.Context, visit func(kid string) bool) error
+
+// check rejects kid unless it is allowlisted or belongs to the lineage that
+// walk reports. The lock is not held while walk calls the backend.
+func (l *keyLineage) check(ctx context.Context, kid string, walk lineageWalker) error {
+	if l.allowlist[kid] {
+		return nil
+	}
+	l.mu.Lock()
+	if l.lineage[kid] {
+		l.mu.Unlock()
+		return nil
+	}
+	last := l.refreshed
+	refresh := time.Since(last) >= minLineageRefresh
+	if refresh {
+		// Claim the full walk so that concurrent requests do not repeat it.
+		l.refreshed = time.Now()
+	}
+	l.mu.Unlock()
+	if !refresh {
+		// Full walks are rate-limited, but a key rotated in since the last
+		// one, e.g. by another node, is the configured key or the key it
+		// replaced, so look at just those two.
+		depth := 0
+		err := walk(ctx, func(current string) bool {
+			depth++
+			refresh = current == kid
+			return refresh || depth == 2
+		})
+		if err != nil {
+			return err
+		}
+	}
+	if refresh {
+		var lineage []string
+		err := walk(ctx, func(current string) bool {
+			lineage = append(lineage, current)
+			return false
+		})
+		if err != nil {
+			l.restoreRefreshed(last)
+			return err
+		}
+		l.mu.Lock()
+		for _, current := range lineage {
+			l.lineage[current] = true
+		}
+		l.refreshed = time.Now()
+		known := l.lineage[kid]
+		l.mu.Unlock()
+		if known {
+			return nil
+		}
+	}
+	log.Printf("AUDIT: rejected decrypt with key %v, which is neither the configured key, "+
+		"a key it replaced, nor in `allowed_key_ids`", kid)
+	return newPluginError(codes.PermissionDenied, reasonKeyNotAllowed,
+		map[string]string{metadataFoundKeyID: kid},
+		"ciphertext names key %v, which this plugin is not allowed to decrypt with", kid)
+}
+
+// restoreRefreshed gives back a claim on the full walk that was not made.
+func (l *keyLineage) restoreRefreshed(last time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.refreshed = last
+}
+
+// checkDecryptKey rejects kid unless it belongs to the lineage of the
+// configured key or is allowlisted.
+func (b *dsmBackend) checkDecryptKey(ctx context.Context, kid string) error {
+	return b.lineage.check(ctx, kid, func(ctx context.Context, visit func(kid string) bool) error {
+		return b.walkLineage(ctx, func(kid string, _ *sdkms.Sobject) bool {
+			return visit(kid)
+		})
+	})
+}
+
+// walkLineage calls visit for the configured key and then for each key it
+// replaced through rotation, newest first, until visit returns true. key
+// is nil for a replaced key that could not be fetched, e.g. because it was
+// deleted; the walk ends there.
+func (b *dsmBackend) walkLineage(ctx context.Context, visit func(kid string, key *sdkms.Sobject) bool) error {
+	key, err := b.getSobject(ctx)
+	if err != nil {
+		return err
+	}
+	if key.Kid == nil {
+		return errors.New("DSM returned a key without kid")
+	}
+	client := b.config.makeClient()
+	seen := make(map[string]bool)
+	for depth := 0; depth < maxLineageDepth; depth++ {
+		kid := *key.Kid
+		seen[kid] = true
+		if visit(kid, key) {
+			return nil
+		}
+		if key.Links == nil || key.Links.Replaced == nil || seen[*key.Links.Replaced] {
+			return nil
+		}
+		replaced := *key.Links.Replaced
+		var next *sdkms.Sobject
+		err := b.config.withDsmContext(ctx, func(ctx context.Context) (err error) {
+			next, err = client.GetSobject(ctx, nil, *sdkms.SobjectByID(replaced))
+			return err
+		})
+		if err != nil || next.Kid == nil {
+			visit(replaced, nil)
+			return nil
+		}
+		key = next
+	}
+	return nil
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestKeyLineageRefreshAfterRotation(t *testing.T) {
+	l := newKeyLineage([]string{"allowed"})
+	keys := []string{"k1"}
+	walks := 0
+	walk := func(ctx context.Context, visit func(kid string) bool) error {
+		walks++
+		for _, kid := range keys {
+			if visit(kid) {
+				return nil
+			}
+		}
+		return nil
+	}
+	ctx := context.Background()
+	if err := l.check(ctx, "k1", walk); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.check(ctx, "allowed", walk); err != nil {
+		t.Fatal(err)
+	}
+
+	// A rotation right after the lineage was walked is picked up despite
+	// the rate limit.
+	keys = []string{"k2", "k1"}
+	walks = 0
+	if err := l.check(ctx, "k2", walk); err != nil {
+		t.Fatal(err)
+	}
+	if walks != 2 {
+		t.Fatalf("lineage walked %v times, want a check and a full refresh", walks)
+	}
+
+	walks = 0
+	_, reason, _ := classifyError(l.check(ctx, "k0", walk))
+	if reason != reasonKeyNotAllowed {
+		t.Fatalf("got reason %v", reason)
+	}
+	if walks != 1 {
+		t.Fatalf("lineage walked %v times for an unknown key, want only the check", walks)
+	}
+}
+
+func TestKeyLineageWalkWithoutLock(t *testing.T) {
+	l := newKeyLineage(nil)
+	ctx := context.Background()
+	if err := l.check(ctx, "k1", func(ctx context.Context, visit func(kid string) bool) error {
+		visit("k1")
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	// A walk for an unknown key that hangs on the backend does not hold up
+	// checks of known keys.
+	started, release := make(chan struct{}), make(chan struct{})
+	go l.check(ctx, "unknown", func(ctx context.Context, visit func(kid string) bool) error {
+		close(started)
+		<-release
+		return nil
+	})
+	defer close(release)
+	<-started
+	done := make(chan error, 1)
+	go func() {
+		done <- l.check(ctx, "k1", func(ctx context.Context, visit func(kid string) bool) error {
+			t.Error("known key walked")
+			return nil
+		})
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("check of a known key waited for a walk in progress")
+	}
+}
@@ -0,0 +1,280 @@
+package main
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/scrypt"
+	"google.golang.org/grpc/codes"
+)
+
+const (
+	localKekSize = 32
+
+	// scrypt parameters for sealing a local KEK with a passphrase.
+	sealScryptN = 1 << 15
+	sealScryptR = 8
+	sealScryptP = 1
+)
+
+// localKekConfig selects the local KEK backend, which keeps the KEK in a
+// file on the node. It exists for development clusters that have no DSM
+// account and must not be used to protect production data.
+type localKekConfig struct {
+	KeyFile *string `json:"key_file,omitempty"`
+	// PassphraseFile holds the passphrase the key file is sealed with, if
+	// any.
+	PassphraseFile *string `json:"passphrase_file,omitempty"`
+}
+
+func (c localKekConfig) validate() error {
+	if c.KeyFile == nil {
+		return errors.New("required field `local_kek.key_file` is missing")
+	}
+	return nil
+}
+
+// sealedKek is the format of a passphrase-sealed key file.
+type sealedKek struct {
+	Kdf    string `json:"kdf"`
+	Salt   []byte `json:"salt"`
+	N      int    `json:"n"`
+	R      int    `json:"r"`
+	P      int    `json:"p"`
+	Nonce  []byte `json:"nonce"`
+	Sealed []byte `json:"sealed"`
+}
+
+// localKekBackend performs the same AES-GCM wrap as DSM with a KEK read
+// from a local file.
+type localKekBackend struct {
+	kid  string
+	aead cipher.AEAD
+}
+
+func newLocalKekBackend(config localKekConfig) (Backend, error) {
+	kek, err := loadLocalKek(config)
+	if err != nil {
+		return nil, err
+	}
+	defer zero(kek)
+	backend, err := newLocalKekBackendWithKey(kek)
+	if err != nil {
+		return nil, err
+	}
+	return backend, nil
+}
+
+func newLocalKekBackendWithKey(kek []byte) (*localKekBackend, error) {
+	block, err := aes.NewCipher(kek)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &localKekBackend{kid: localKeyID(kek), aead: aead}, nil
+}
+
+func (b *localKekBackend) Wrap(ctx context.Context, plain []byte) (*wrappedData, error) {
+	iv := make([]byte, b.aead.NonceSize())
+	if _, err := rand.Read(iv); err != nil {
+		return nil, fmt.Errorf("failed to generate IV: %v", err)
+	}
+	sealed := b.aead.Seal(nil, iv, plain, nil)
+	split := len(sealed) - b.aead.Overhead()
+	return &wrappedData{
+		KID:    b.kid,
+		Cipher: sealed[:split],
+		IV:     iv,
+		Tag:    sealed[split:],
+	}, nil
+}
+
+func (b *localKekBackend) Unwrap(ctx context.Context, data *wrappedData) ([]byte, error) {
+	if data.KID != b.kid {
+		return nil, newPluginError(codes.FailedPrecondition, reasonDsmKeyNotFound, nil,
+			"ciphertext was wrapped with key %v, the local KEK is %v", data.KID, b.kid)
+	}
+	if len(data.IV) != b.aead.NonceSize() || len(data.Tag) != b.aead.Overhead() {
+		return nil, newPluginError(codes.InvalidArgument, reasonInvalidCiphertext, nil, "invalid IV or tag length")
+	}
+	sealed := make([]byte, 0, len(data.Cipher)+len(data.Tag))
+	sealed = append(append(sealed, data.Cipher...), data.Tag...)
+	plain, err := b.aead.Open(nil, data.IV, sealed, nil)
+	if err != nil {
+		return nil, newPluginError(codes.InvalidArgument, reasonInvalidCiphertext, nil, "failed to decrypt: %v", err)
+	}
+	return plain, nil
+}
+
+func (b *localKekBackend) DescribeKey(ctx context.Context) (*KeyInfo, error) {
+	return &KeyInfo{
+		KID:        b.kid,
+		Name:       "local KEK",
+		Type:       keyTypeAes,
+		Enabled:    true,
+		Size:       localKekSize * 8,
+		Operations: &keyOperations{Encrypt: true, Decrypt: true},
+	}, nil
+}
+
+func (b *localKekBackend) Health(ctx context.Context) error {
+	return nil
+}
+
+func (b *localKekBackend) nonProductionWarning() string {
+	return "local KEK backend in use, this is not suitable for production"
+}
+
+// localKeyID derives a stable key ID in UUID form from the KEK, so that the
+// KID in wrappedData identifies the key without revealing it.
+func localKeyID(kek []byte) string {
+	sum := sha256.Sum256(append([]byte("k8s-sdkms-plugin local kek id\x00"), kek...))
+	id := sum[:16]
+	id[6] = id[6]&0x0f | 0x80 // version 8, custom
+	id[8] = id[8]&0x3f | 0x80 // RFC 4122 variant
+	return formatUUID(id)
+}
+
+func formatUUID(id []byte) string {
+	return fmt.Sprintf("%x-%x-%x-%x-%x", id[0:4], id[4:6], id[6:8], id[8:10], id[10:16])
+}
+
+func loadLocalKek(config localKekConfig) ([]byte, error) {
+	content, err := readPrivateFile(*config.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+	defer zero(content)
+	if config.PassphraseFile == nil {
+		kek, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(content)))
+		if err != nil {
+			return nil, fmt.Errorf("key file %v is not base64 encoded: %v", *config.KeyFile, err)
+		}
+		if len(kek) != localKekSize {
+			zero(kek)
+			return nil, fmt.Errorf("key file %v must contain a %v-byte key", *config.KeyFile, localKekSize)
+		}
+		return kek, nil
+	}
+	passphrase, err := readPrivateFile(*config.PassphraseFile)
+	if err != nil {
+		return nil, err
+	}
+	defer zero(passphrase)
+	var sealed sealedKek
+	if err := json.Unmarshal(content, &sealed); err != nil {
+		return nil, fmt.Errorf("failed to parse sealed key file %v: %v", *config.KeyFile, err)
+	}
+	return unsealKek(sealed, trimNewline(passphrase))
+}
+
+// readPrivateFile reads a file that must not be accessible to group or
+// others.
+func readPrivateFile(path string) ([]byte, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if perm := info.Mode().Perm(); perm&0o077 != 0 {
+		return nil, fmt.Errorf("%v has permissions %#o, it must not be accessible to group or others", path, perm)
+	}
+	return os.ReadFile(path)
+}
+
+func trimNewline(b []byte) []byte {
+	for len(b) > 0 && (b[len(b)-1] == '\n' || b[len(b)-1] == '\r') {
+		b = b[:len(b)-1]
+	}
+	return b
+}
+
+func sealingKey(passphrase, salt []byte, n, r, p int) (cipher.AEAD, error) {
+	key, err := scrypt.Key(passphrase, salt, n, r, p, localKekSize)
+	if err != nil {
+		return nil, err
+	}
+	defer zero(key)
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func unsealKek(sealed sealedKek, passphrase []byte) ([]byte, error) {
+	if sealed.Kdf != "scrypt" {
+		return nil, fmt.Errorf("unsupported kdf in sealed key file: %q", sealed.Kdf)
+	}
+	aead, err := sealingKey(passphrase, sealed.Salt, sealed.N, sealed.R, sealed.P)
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed.Nonce) != aead.NonceSize() {
+		return nil, errors.New("invalid nonce in sealed key file")
+	}
+	kek, err := aead.Open(nil, sealed.Nonce, sealed.Sealed, nil)
+	if err != nil {
+		return nil, errors.New("failed to unseal key file, wrong passphrase?")
+	}
+	if len(kek) != localKekSize {
+		zero(kek)
+		return nil, fmt.Errorf("sealed key file must contain a %v-byte key", localKekSize)
+	}
+	return kek, nil
+}
+
+// generateLocalKek writes a new random KEK to path, sealed with the
+// passphrase in passphraseFile unless it is empty.
+func generateLocalKek(path, passphraseFile string) error {
+	kek := make([]byte, localKekSize)
+	defer zero(kek)
+	if _, err := rand.Read(kek); err != nil {
+		return err
+	}
+	content := []byte(base64.StdEncoding.EncodeToString(kek) + "\n")
+	if passphraseFile != "" {
+		passphrase, err := readPrivateFile(passphraseFile)
+		if err != nil {
+			return err
+		}
+		defer zero(passphrase)
+		sealed := sealedKek{Kdf: "scrypt", N: sealScryptN, R: sealScryptR, P: sealScryptP}
+		sealed.Salt = make([]byte, 16)
+		if _, err := rand.Read(sealed.Salt); err != nil {
+			return err
+		}
+		aead, err := sealingKey(trimNewline(passphrase), sealed.Salt, sealed.N, sealed.R, sealed.P)
+		if err != nil {
+			return err
+		}
+		sealed.Nonce = make([]byte, aead.NonceSize())
+		if _, err := rand.Read(sealed.Nonce); err != nil {
+			return err
+		}
+		sealed.Sealed = aead.Seal(nil, sealed.Nonce, kek, nil)
+		if content, err = json.MarshalIndent(sealed, "", "  "); err != nil {
+			return err
+		}
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(content); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// writeFile writes content to name in dir with perm and returns its path.
+func writeFile(t *testing.T, dir, name, content string, perm os.FileMode) string {
+	t.Helper()
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, []byte(content), perm); err != nil {
+		t.Fatal(err)
+	}
+	// WriteFile leaves the permissions of an existing file alone and is
+	// subject to the umask.
+	if err := os.Chmod(path, perm); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestReadPrivateFile(t *testing.T) {
+	dir := t.TempDir()
+	for _, test := range []struct {
+		perm os.FileMode
+		ok   bool
+	}{
+		{0o600, true},
+		{0o400, true},
+		{0o640, false},
+		{0o604, false},
+		{0o660, false},
+	} {
+		path := writeFile(t, dir, "key", "secret", test.perm)
+		content, err := readPrivateFile(path)
+		if test.ok && (err != nil || string(content) != "secret") {
+			t.Errorf("%#o: got %q, %v", test.perm, content, err)
+		}
+		if !test.ok && (err == nil || !strings.Contains(err.Error(), "must not be accessible")) {
+			t.Errorf("%#o: got %v, want the file rejected", test.perm, err)
+		}
+	}
+}
+
+func TestLocalKekRoundTrip(t *testing.T) {
+	dir := t.TempDir()
+	passphrase := writeFile(t, dir, "passphrase", "correct horse\n", 0o600)
+	for name, passphraseFile := range map[string]string{"plain": "", "sealed": passphrase} {
+		t.Run(name, func(t *testing.T) {
+			path := filepath.Join(dir, name+".key")
+			if err := generateLocalKek(path, passphraseFile); err != nil {
+				t.Fatal(err)
+			}
+			if info, err := os.Stat(path); err != nil || info.Mode().Perm() != 0o600 {
+				t.Fatalf("key file: %v, %v", info, err)
+			}
+			if err := generateLocalKek(path, passphraseFile); err == nil {
+				t.Fatal("an existing key file was overwritten")
+			}
+			config := localKekConfig{KeyFile: &path}
+			if passphraseFile != "" {
+				config.PassphraseFile = &passphraseFile
+			}
+			first, err := newLocalKekBackend(config)
+			if err != nil {
+				t.Fatal(err)
+			}
+			wrapped, err := first.Wrap(context.Background(), []byte("dek"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			// A restart loads the same KEK.
+			second, err := newLocalKekBackend(config)
+			if err != nil {
+				t.Fatal(err)
+			}
+			plain, err := second.Unwrap(context.Background(), wrapped)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(plain, []byte("dek")) {
+				t.Fatalf("got %q", plain)
+			}
+		})
+	}
+}
+
+func TestLocalKekWrongPassphrase(t *testing.T) {
+	dir := t.TempDir()
+	passphrase := writeFile(t, dir, "passphrase", "correct horse", 0o600)
+	wrong := writeFile(t, dir, "wrong", "battery staple", 0o600)
+	path := filepath.Join(dir, "key")
+	if err := generateLocalKek(path, passphrase); err != nil {
+		t.Fatal(err)
+	}
+	_, err := loadLocalKek(localKekConfig{KeyFile: &path, PassphraseFile: &wrong})
+	if err == nil || !strings.Contains(err.Error(), "wrong passphrase") {
+		t.Fatalf("got %v, want a wrong passphrase error", err)
+	}
+}
+
+func TestLocalKekWrongSize(t *testing.T) {
+	dir := t.TempDir()
+	short := make([]byte, 16)
+	rand.Read(short)
+	path := writeFile(t, dir, "plain", base64.StdEncoding.EncodeToString(short)+"\n", 0o600)
+	if _, err := loadLocalKek(localKekConfig{KeyFile: &path}); err == nil {
+		t.Fatal("a 16-byte key was accepted")
+	}
+
+	passphrase := writeFile(t, dir, "passphrase", "correct horse", 0o600)
+	sealed := sealedKek{Kdf: "scrypt", Salt: make([]byte, 16), N: 1 << 10, R: sealScryptR, P: sealScryptP}
+	aead, err := sealingKey([]byte("correct horse"), sealed.Salt, sealed.N, sealed.R, sealed.P)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sealed.Nonce = make([]byte, aead.NonceSize())
+	sealed.Sealed = aead.Seal(nil, sealed.Nonce, short, nil)
+	content, err := json.Marshal(sealed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path = writeFile(t, dir, "sealed", string(content), 0o600)
+	_, err = loadLocalKek(localKekConfig{KeyFile: &path, PassphraseFile: &passphrase})
+	if err == nil || !strings.Contains(err.Error(), "32-byte key") {
+		t.Fatalf("got %v, want a key size error", err)
+	}
+}
@@ -13,11 +13,13 @@ import (
 	"net/http"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
+	"time"
 
 	"github.com/fortanix/sdkms-client-go/sdkms"
-	"github.com/fxamacker/cbor/v2"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
 )
 
 const (
@@ -31,8 +33,18 @@ const (
 
 func main() {
 	configFile := flag.String("config", defaultConfigPath, "config file location")
+	generateKek := flag.String("generate-local-kek", "", "write a new KEK for the `local_kek` backend to this file and exit")
+	kekPassphraseFile := flag.String("local-kek-passphrase-file", "", "seal the KEK written by -generate-local-kek with the passphrase in this file")
 	flag.Parse()
 
+	if *generateKek != "" {
+		if err := generateLocalKek(*generateKek, *kekPassphraseFile); err != nil {
+			log.Fatalf("Failed to generate local KEK: %v", err)
+		}
+		log.Printf("Local KEK written to %v", *generateKek)
+		return
+	}
+
 	log.Println("Reading config...")
 	config, err := readConfigFromFile(*configFile)
 	if err != nil {
@@ -41,9 +53,17 @@ func main() {
 	if err := config.validate(); err != nil {
 		log.Fatalf("Invalid config: %v", err)
 	}
+	backend, err := config.makeBackend()
+	if err != nil {
+		log.Fatalf("Failed to initialize backend: %v", err)
+	}
+	// verify configuration by checking the backend and the encryption key
+	if err := config.verifyBackend(backend); err != nil {
+		log.Fatalf("Invalid config: %v", err)
+	}
 
 	log.Println("Starting gRPC service...")
-	server, err := startServer(*config)
+	server, err := startServer(*config, backend)
 	if err != nil {
 		log.Fatalf("Failed to start gRPC server: %v", err)
 	}
@@ -57,6 +77,9 @@ func main() {
 	sig := <-sigChan
 	log.Printf("Signal: '%v', shutting down gRPC service...\n", sig)
 	server.server.GracefulStop()
+	if err := server.usage.save(); err != nil {
+		log.Printf("Failed to save key usage: %v", err)
+	}
 }
 
 type pluginConfig struct {
@@ -65,6 +88,74 @@ type pluginConfig struct {
 	KeyName       *string `json:"key_name,omitempty"`
 	KeyID         *string `json:"key_id,omitempty"`
 	SocketFile    *string `json:"socket_file,omitempty"`
+	// AllowedPeerUIDs restricts the processes that may call the plugin over
+	// `socket_file` to these user IDs.
+	AllowedPeerUIDs []uint32 `json:"allowed_peer_uids,omitempty"`
+	// GroupID or GroupName restricts the key to one DSM group, in which
+	// `key_name` is resolved.
+	GroupID   *string `json:"group_id,omitempty"`
+	GroupName *string `json:"group_name,omitempty"`
+
+	DecryptCache *cacheConfig    `json:"decrypt_cache,omitempty"`
+	Batch        *batchConfig    `json:"batch,omitempty"`
+	Timeouts     *timeoutConfig  `json:"timeouts,omitempty"`
+	Pkcs11       *pkcs11Config   `json:"pkcs11,omitempty"`
+	Kmip         *kmipConfig     `json:"kmip,omitempty"`
+	LocalKek     *localKekConfig `json:"local_kek,omitempty"`
+	LocalCrypto  *bool           `json:"local_crypto,omitempty"`
+	// AllowedKeyIDs lists keys besides the configured key and the keys it
+	// replaced that ciphertext may name on decrypt.
+	AllowedKeyIDs []string `json:"allowed_key_ids,omitempty"`
+	// DecryptApproval makes the plugin request approval to decrypt if the
+	// key is under a quorum approval policy.
+	DecryptApproval *approvalConfig `json:"decrypt_approval,omitempty"`
+	// KeyPin pins the identity of the configured key.
+	KeyPin *keyPinConfig `json:"key_pin,omitempty"`
+	// KeyCheckInterval is how often the key is checked in the background.
+	KeyCheckInterval *duration `json:"key_check_interval,omitempty"`
+	// ExpiryWarnings are lead times before the key's deactivation date at
+	// which the plugin warns.
+	ExpiryWarnings []duration `json:"expiry_warnings,omitempty"`
+	// MetricsAddress is where Prometheus metrics are served, e.g.
+	// "127.0.0.1:9090". Metrics are not served if it is not set.
+	MetricsAddress *string `json:"metrics_address,omitempty"`
+	// KeyUsageFile is where the keys the plugin decrypts with are recorded
+	// across restarts.
+	KeyUsageFile *string `json:"key_usage_file,omitempty"`
+	// EncryptLimit sets how many Encrypt requests the key may serve before
+	// the plugin warns or rotates it.
+	EncryptLimit *encryptLimitConfig `json:"encrypt_limit,omitempty"`
+	// Rotation makes the plugin rotate the key on a schedule.
+	Rotation *rotationConfig `json:"rotation,omitempty"`
+	// Kubeconfig gives the plugin access to the Kubernetes API, used to
+	// coordinate control plane nodes.
+	Kubeconfig *string `json:"kubeconfig,omitempty"`
+	// StorageMigration makes the plugin have stored data re-encrypted under
+	// the current key after rotation.
+	StorageMigration *storageMigrationConfig `json:"storage_migration,omitempty"`
+	// Secondary selects a second key that every DEK is also wrapped with,
+	// for disaster recovery.
+	Secondary *pluginConfig `json:"secondary,omitempty"`
+	// CompactEnvelope makes Encrypt write the compact envelope format,
+	// which older plugin versions cannot read.
+	CompactEnvelope *bool `json:"compact_envelope,omitempty"`
+}
+
+// duration is a time.Duration that is read from the config file as a
+// string such as "90s" or "10m".
+type duration time.Duration
+
+func (d *duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return fmt.Errorf("expected duration string, e.g. \"30s\": %v", err)
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = duration(v)
+	return nil
 }
 
 func readConfigFromFile(configFilePath string) (*pluginConfig, error) {
@@ -80,39 +171,152 @@ func readConfigFromFile(configFilePath string) (*pluginConfig, error) {
 }
 
 func (p pluginConfig) validate() error {
+	if p.SocketFile == nil {
+		return errors.New("required field `socket_file` is missing")
+	}
+	if err := p.validateBackend(); err != nil {
+		return err
+	}
+	if p.Secondary != nil {
+		if err := p.Secondary.validateSecondary(); err != nil {
+			return err
+		}
+	}
+	if p.DecryptCache != nil {
+		if err := p.DecryptCache.validate(); err != nil {
+			return err
+		}
+	}
+	if len(p.AllowedPeerUIDs) > 0 && !peerCredentialsSupported {
+		return errors.New("`allowed_peer_uids` is not supported on this platform")
+	}
+	if p.KeyCheckInterval != nil && *p.KeyCheckInterval <= 0 {
+		return errors.New("`key_check_interval` must be positive")
+	}
+	if p.Rotation != nil {
+		if p.backendCount() > 0 || p.KeyName == nil {
+			return errors.New("`rotation` requires the DSM REST API and `key_name`")
+		}
+		if err := p.Rotation.validate(); err != nil {
+			return err
+		}
+	}
+	if p.StorageMigration != nil {
+		if p.Rotation == nil || p.Kubeconfig == nil {
+			return errors.New("`storage_migration` requires `rotation` and `kubeconfig`")
+		}
+		if err := p.StorageMigration.validate(); err != nil {
+			return err
+		}
+	}
+	if p.EncryptLimit != nil {
+		if err := p.EncryptLimit.validate(); err != nil {
+			return err
+		}
+		if p.EncryptLimit.Rotate != nil && p.Rotation == nil {
+			return errors.New("`encrypt_limit.rotate` requires `rotation`")
+		}
+		if p.KeyUsageFile == nil {
+			return errors.New("`encrypt_limit` requires `key_usage_file`, or the counts reset on every restart")
+		}
+	}
+	for _, d := range p.ExpiryWarnings {
+		if d <= 0 {
+			return errors.New("`expiry_warnings` must be positive")
+		}
+	}
+	return nil
+}
+
+// validateBackend checks the settings that select the backend and key.
+func (p pluginConfig) validateBackend() error {
+	if p.backendCount() > 1 {
+		return errors.New("only one of `pkcs11`, `kmip` and `local_kek` may be specified")
+	}
+	switch {
+	case p.Pkcs11 != nil:
+		if p.KeyName != nil || p.KeyID != nil {
+			return errors.New("cannot specify `key_name` or `key_id` with `pkcs11`, use `pkcs11.key_label` instead")
+		}
+		if err := p.Pkcs11.validate(); err != nil {
+			return err
+		}
+	case p.Kmip != nil:
+		if err := p.Kmip.validate(); err != nil {
+			return err
+		}
+		if err := p.validateKeySelector(); err != nil {
+			return err
+		}
+	case p.LocalKek != nil:
+		if err := p.LocalKek.validate(); err != nil {
+			return err
+		}
+	default:
+		if err := p.validateDsm(); err != nil {
+			return err
+		}
+	}
+	if p.LocalCrypto != nil && *p.LocalCrypto && p.backendCount() > 0 {
+		return errors.New("`local_crypto` can only be used with the DSM REST API")
+	}
+	if len(p.AllowedKeyIDs) > 0 && p.LocalKek != nil {
+		return errors.New("`allowed_key_ids` cannot be used with `local_kek`")
+	}
+	if p.GroupID != nil || p.GroupName != nil {
+		if p.backendCount() > 0 {
+			return errors.New("`group_id` and `group_name` can only be used with the DSM REST API")
+		}
+		if p.GroupID != nil && p.GroupName != nil {
+			return errors.New("cannot specify `group_id` and `group_name` at the same time")
+		}
+	}
+	if p.DecryptApproval != nil {
+		if p.backendCount() > 0 {
+			return errors.New("`decrypt_approval` can only be used with the DSM REST API")
+		}
+		if err := p.DecryptApproval.validate(); err != nil {
+			return err
+		}
+	}
+	if p.KeyPin != nil {
+		if p.backendCount() > 0 {
+			return errors.New("`key_pin` can only be used with the DSM REST API")
+		}
+		if err := p.KeyPin.validate(); err != nil {
+			return err
+		}
+	}
+	if p.Batch != nil {
+		if err := p.Batch.validate(); err != nil {
+			return err
+		}
+	}
+	if p.Timeouts != nil {
+		if err := p.Timeouts.validate(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (p pluginConfig) validateDsm() error {
 	if p.SdkmsEndpoint == nil {
 		return errors.New("required field `sdkms_endpoint` is missing")
 	}
 	if p.ApiKey == nil {
 		return errors.New("required field `api_key` is missing")
 	}
-	if p.SocketFile == nil {
-		return errors.New("required field `socket_file` is missing")
-	}
+	return p.validateKeySelector()
+}
+
+func (p pluginConfig) validateKeySelector() error {
 	if p.KeyName == nil && p.KeyID == nil {
 		return errors.New("neither `key_name` nor `key_id` was specified")
 	}
 	if p.KeyName != nil && p.KeyID != nil {
 		return errors.New("cannot specify `key_name` and `key_id` at the same time")
 	}
-	// verify configuration by authenticating and getting the encryption key
-	ctx := context.Background()
-	client := p.makeClient()
-	_, err := client.AuthenticateWithAPIKey(ctx, *p.ApiKey)
-	if err != nil {
-		return fmt.Errorf("invalid `api_key`: %v", err)
-	}
-	defer client.TerminateSession(ctx)
-
-	descriptor := p.makeSobjectDescriptor()
-	encoding := sdkms.SobjectEncodingJson
-	key, err := client.GetSobject(ctx, &sdkms.GetSobjectParams{View: &encoding}, *descriptor)
-	if err != nil {
-		return fmt.Errorf("invalid key: %v", err)
-	}
-	if key.ObjType != sdkms.ObjectTypeAes {
-		return fmt.Errorf("invalid key type, expected AES, found: %v", key.ObjType)
-	}
 	return nil
 }
 
@@ -133,29 +337,56 @@ func (p pluginConfig) makeSobjectDescriptor() *sdkms.SobjectDescriptor {
 }
 
 type kmsServer struct {
-	server *grpc.Server
-	config pluginConfig
-	hash   string
+	server  *grpc.Server
+	backend Backend
+	hash    string
+	cache   *dekCache // nil unless `decrypt_cache` is configured
+	warning string    // set for backends that are not fit for production
+	monitor *keyMonitor
+	usage   *keyUsage
+	limits  *encryptLimits
+
+	// rotating is set if the plugin rotates the key, in which case the
+	// key_id it reports names the current key.
+	rotating bool
+
+	compactEnvelope bool
 }
 
-// Hash of endPoint, KeyID and KeyName
+// Hash of endPoint (REST or KMIP), KeyID, KeyName, GroupID, GroupName, the
+// PKCS#11 key label and the local KEK file
 func (p pluginConfig) hash() string {
 	h := sha256.New()
 
 	if p.SdkmsEndpoint != nil {
 		h.Write([]byte(*p.SdkmsEndpoint))
 	}
+	if p.Kmip != nil {
+		h.Write([]byte(*p.Kmip.Endpoint))
+	}
 	if p.KeyID != nil {
 		h.Write([]byte(*p.KeyID))
 	}
 	if p.KeyName != nil {
 		h.Write([]byte(*p.KeyName))
 	}
+	if p.GroupID != nil {
+		h.Write([]byte(*p.GroupID))
+	}
+	if p.GroupName != nil {
+		h.Write([]byte(*p.GroupName))
+	}
+	if p.Pkcs11 != nil {
+		h.Write([]byte(*p.Pkcs11.KeyLabel))
+	}
+	if p.LocalKek != nil {
+		h.Write([]byte(*p.LocalKek.KeyFile))
+	}
 
 	return fmt.Sprintf("%x", h.Sum(nil))
 }
 
-func startServer(config pluginConfig) (*kmsServer, error) {
+func startServer(config pluginConfig, backend Backend) (*kmsServer, error) {
 	if err := os.Remove(*config.SocketFile); err != nil && !os.IsNotExist(err) {
 		return nil, fmt.Errorf("failed to remove stale socket: %v", err)
 	}
@@ -165,12 +396,81 @@ func startServer(config pluginConfig) (*kmsServer, error) {
 		return nil, err
 	}
 
-	server := grpc.NewServer()
 	s := &kmsServer{
-		config: config,
-		server: server,
-		hash:   config.hash(),
+		backend:         backend,
+		hash:            config.hash(),
+		compactEnvelope: config.CompactEnvelope != nil && *config.CompactEnvelope,
 	}
+	if b, ok := backend.(nonProductionBackend); ok && b.nonProductionWarning() != "" {
+		s.warning = b.nonProductionWarning()
+		log.Printf("WARNING: %v", s.warning)
+	}
+	usageFile := ""
+	if config.KeyUsageFile != nil {
+		usageFile = *config.KeyUsageFile
+	}
+	if s.usage, err = loadKeyUsage(usageFile); err != nil {
+		return nil, err
+	}
+	registerKeyUsage(s.usage)
+	if usageFile != "" {
+		go s.usage.run()
+	} else {
+		log.Println("WARNING: `key_usage_file` is not set, so the encryptions counted against " +
+			"the per-key limit are lost on every restart")
+	}
+	s.limits = newEncryptLimits(config, s.usage)
+	if config.DecryptCache != nil {
+		s.cache = newDekCache(*config.DecryptCache)
+		go s.cache.run()
+	}
+	s.monitor = newKeyMonitor(config, backend)
+	dsm, _ := primaryBackend(backend).(*dsmBackend)
+	s.monitor.onKeyDisabled = func() {
+		s.purgeCache()
+		if dsm != nil {
+			dsm.keyDisabled()
+		}
+	}
+	migrateSoon := func(string) {}
+	if config.StorageMigration != nil {
+		migrator, err := newStorageMigrator(config, s.monitor.interval)
+		if err != nil {
+			return nil, err
+		}
+		migrateSoon = migrator.migrateSoon
+		go migrator.run()
+	}
+	s.monitor.onKeyChange = func(kid string) {
+		if dsm != nil {
+			dsm.keyChanged(kid)
+		}
+		migrateSoon(kid)
+	}
+	s.monitor.refreshKey()
+	go s.monitor.run()
+	if config.Rotation != nil {
+		if dsm == nil {
+			return nil, errors.New("`rotation` requires the DSM REST API")
+		}
+		rotator, err := newKeyRotator(config, dsm, func(string) { s.monitor.refreshKey() })
+		if err != nil {
+			return nil, err
+		}
+		rotator.overLimit = s.limits.overRotate
+		s.limits.rotateNow = rotator.rotateSoon
+		s.rotating = true
+		go rotator.run(s.monitor.interval)
+	}
+	if config.MetricsAddress != nil {
+		startMetricsServer(*config.MetricsAddress, s.usage)
+	}
+	options := []grpc.ServerOption{grpc.ChainUnaryInterceptor(unaryInterceptors(config)...)}
+	if len(config.AllowedPeerUIDs) > 0 {
+		options = append(options, grpc.Creds(peerCredentials{}))
+	}
+	server := grpc.NewServer(options...)
+	s.server = server
 	RegisterKeyManagementServiceServer(server, s)
 	go server.Serve(listener)
 	return s, nil
@@ -182,76 +482,134 @@ type wrappedData struct {
 	Cipher  []byte
 	IV      []byte
 	Tag     []byte
+	// Secondary is the DEK wrapped under the secondary key, if configured.
+	Secondary *wrappedData `cbor:",omitempty"`
+}
+
+// keyID is the key_id reported to the apiserver. It is the hash of the
+// key configuration, followed by the current KID if the plugin rotates the
+// key, so that the apiserver notices rotations.
+func (s *kmsServer) keyID() string {
+	if kid := s.monitor.currentKID(); s.rotating && kid != "" {
+		return s.hash + "-" + kid
+	}
+	return s.hash
 }
 
 func (s *kmsServer) Status(ctx context.Context, request *StatusRequest) (*StatusResponse, error) {
-	logRequest("Status", fmt.Sprintf("healtcheck status is %v", healthz), nil)
-	return &StatusResponse{Version: version, Healthz: healthz, KeyId: s.hash}, nil
+	status := healthz
+	if err := s.monitor.keyFailure(); err != nil {
+		status = err.Error()
+	}
+	msg := fmt.Sprintf("healtcheck status is %v", status)
+	if s.warning != "" {
+		msg += fmt.Sprintf(" (WARNING: %v)", s.warning)
+	}
+	if warning := s.monitor.keyWarning(); warning != "" {
+		msg += fmt.Sprintf(" (WARNING: %v)", warning)
+	}
+	if warning := s.limits.warning(s.monitor.currentKID()); warning != "" {
+		msg += fmt.Sprintf(" (WARNING: %v)", warning)
+	}
+	if b, ok := s.backend.(approvalBackend); ok && b.approvalStatus() != "" {
+		msg += fmt.Sprintf(" (WARNING: %v)", b.approvalStatus())
+	}
+	setLogMessage(ctx, msg)
+	return &StatusResponse{Version: version, Healthz: status, KeyId: s.keyID()}, nil
 }
 
 func (s *kmsServer) Encrypt(ctx context.Context, request *EncryptRequest) (*EncryptResponse, error) {
 	resp, msg, err := s.encrypt(ctx, request)
-	logRequest("Encrypt", msg, err)
+	setLogMessage(ctx, msg)
 	return resp, err
 }
 
 func (s *kmsServer) Decrypt(ctx context.Context, request *DecryptRequest) (*DecryptResponse, error) {
 	resp, msg, err := s.decrypt(ctx, request)
-	logRequest("Decrypt", msg, err)
+	setLogMessage(ctx, msg)
 	return resp, err
 }
 
 func (s *kmsServer) encrypt(ctx context.Context, request *EncryptRequest) (*EncryptResponse, string, error) {
-	client := s.config.makeClient()
-	tagLen := uint(128)
-	resp, err := client.Encrypt(ctx, sdkms.EncryptRequest{
-		Key:    s.config.makeSobjectDescriptor(),
-		Alg:    sdkms.AlgorithmAes,
-		Plain:  request.Plaintext,
-		Mode:   sdkms.CryptModeSymmetric(sdkms.CipherModeGcm),
-		TagLen: &tagLen,
-	})
+	if err := s.monitor.keyFailure(); err != nil {
+		return nil, "", newPluginError(codes.FailedPrecondition, reasonKeyPinMismatch, nil, "%v", err)
+	}
+	wrapped, err := s.backend.Wrap(ctx, request.Plaintext)
 	if err != nil {
+		s.checkKeyDisabled(err)
 		return nil, "", err
 	}
-	data, err := cbor.Marshal(wrappedData{
-		Version: 1, // signifies AES GCM without AAD
-		KID:     *resp.Kid,
-		Cipher:  resp.Cipher,
-		IV:      *resp.Iv,
-		Tag:     *resp.Tag,
-	})
+	err = s.limits.record(wrapped.KID)
+	if wrapped.Secondary != nil {
+		if secondaryErr := s.limits.record(wrapped.Secondary.KID); err == nil {
+			err = secondaryErr
+		}
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	data, err := marshalEnvelope(wrapped, s.compactEnvelope)
 	if err != nil {
-		return nil, "", fmt.Errorf("failed to serialize encrypt response: %v", err)
+		return nil, "", newPluginError(codes.Internal, reasonInternal, nil, "failed to serialize encrypt response: %v", err)
+	}
+	keyID := s.keyID()
+	if len(data) >= maxCiphertextSize || len(keyID) >= maxKeyIDSize {
+		return nil, "", newPluginError(codes.Internal, reasonCiphertextTooLarge, nil,
+			"ciphertext of %v bytes or key ID of %v bytes exceeds the KMS v2 limit", len(data), len(keyID))
 	}
-	return &EncryptResponse{Ciphertext: data, KeyId: s.hash}, fmt.Sprintf("plain: %v bytes, cipher: %v bytes", len(request.Plaintext), len(data)), nil
+	return &EncryptResponse{Ciphertext: data, KeyId: keyID}, fmt.Sprintf("plain: %v bytes, cipher: %v bytes", len(request.Plaintext), len(data)), nil
 }
 
 func (s *kmsServer) decrypt(ctx context.Context, request *DecryptRequest) (*DecryptResponse, string, error) {
-	var data wrappedData
-	if err := cbor.Unmarshal(request.Ciphertext, &data); err != nil {
-		return nil, "", fmt.Errorf("failed to deserialize wrapped cipher data: %v", err)
-	}
-	if data.Version != 1 {
-		return nil, "", fmt.Errorf("unknown version for wrapped cipher data: %v", data.Version)
-	}
-	if request.KeyId != s.hash {
-		return nil, "", fmt.Errorf("KeyId does not match. Expected: %v, found: %v", request.KeyId, s.hash)
-	}
-	client := s.config.makeClient()
-	alg := sdkms.AlgorithmAes
-	resp, err := client.Decrypt(ctx, sdkms.DecryptRequest{
-		Key:    sdkms.SobjectByID(data.KID),
-		Alg:    &alg,
-		Cipher: data.Cipher,
-		Mode:   sdkms.CryptModeSymmetric(sdkms.CipherModeGcm),
-		Iv:     &data.IV,
-		Tag:    &data.Tag,
-	})
+	data, err := unmarshalEnvelope(request.Ciphertext)
+	if err != nil {
+		return nil, "", err
+	}
+	if request.KeyId != s.hash && !strings.HasPrefix(request.KeyId, s.hash+"-") {
+		return nil, "", newPluginError(codes.FailedPrecondition, reasonKeyIDMismatch,
+			map[string]string{metadataExpectedKeyID: s.hash, metadataFoundKeyID: request.KeyId},
+			"KeyId does not match. Expected: %v, found: %v", s.hash, request.KeyId)
+	}
+	// kid stays data.KID if the cache answers without calling unwrap.
+	kid := data.KID
+	unwrap := func() (plain []byte, err error) {
+		plain, kid, err = unwrapWithKID(ctx, s.backend, data)
+		return plain, err
+	}
+	var plain []byte
+	cached := false
+	if s.cache != nil {
+		plain, cached, err = s.cache.load(ctx, request.Ciphertext, unwrap)
+	} else {
+		plain, err = unwrap()
+	}
 	if err != nil {
+		s.checkKeyDisabled(err)
 		return nil, "", err
 	}
-	return &DecryptResponse{Plaintext: resp.Plain}, fmt.Sprintf("cipher: %v bytes, plain: %v bytes", len(request.Ciphertext), len(resp.Plain)), nil
+	s.usage.recordDecrypt(kid)
+	if cached {
+		return &DecryptResponse{Plaintext: plain}, fmt.Sprintf("cipher: %v bytes, plain: %v bytes (cached)", len(request.Ciphertext), len(plain)), nil
+	}
+	return &DecryptResponse{Plaintext: plain}, fmt.Sprintf("cipher: %v bytes, plain: %v bytes", len(request.Ciphertext), len(plain)), nil
+}
+
+// checkKeyDisabled drops all cached DEKs if the backend reports that the key
+// is disabled, so that cached plaintext does not outlive access to the key.
+func (s *kmsServer) checkKeyDisabled(err error) {
+	if s.cache == nil || !isKeyDisabledError(err) {
+		return
+	}
+	s.purgeCache()
+}
+
+// purgeCache drops all cached DEKs because the key is disabled.
+func (s *kmsServer) purgeCache() {
+	if s.cache == nil {
+		return
+	}
+	log.Println("Key is disabled, purging decrypt cache")
+	s.cache.purge()
 }
 
 func logRequest(kind string, msg string, err error) {
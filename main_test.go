@@ -0,0 +1,258 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fortanix/k8s-sdkms-plugin/dsmtest"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+)
+
+const testAPIKey = "test-api-key"
+
+// startTestPlugin starts the plugin on a unix socket in a temporary
+// directory, with the key named "k8s" in dsm, after letting configure
+// adjust the config. It returns a client connected to the socket.
+func startTestPlugin(t *testing.T, dsm *dsmtest.Server, configure func(*pluginConfig)) KeyManagementServiceClient {
+	t.Helper()
+	endpoint, apiKey, keyName := dsm.URL, testAPIKey, "k8s"
+	socket := filepath.Join(t.TempDir(), "kms.sock")
+	config := pluginConfig{SdkmsEndpoint: &endpoint, ApiKey: &apiKey, KeyName: &keyName, SocketFile: &socket}
+	if configure != nil {
+		configure(&config)
+	}
+	if err := config.validate(); err != nil {
+		t.Fatal(err)
+	}
+	backend, err := config.makeBackend()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := config.verifyBackend(backend); err != nil {
+		t.Fatal(err)
+	}
+	server, err := startServer(config, backend)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(server.server.Stop)
+	conn, err := grpc.NewClient("unix://"+socket, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return NewKeyManagementServiceClient(conn)
+}
+
+func requestContext(t *testing.T) context.Context {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	t.Cleanup(cancel)
+	return ctx
+}
+
+// checkError fails unless err is a gRPC error with code and, if reason is
+// not empty, an ErrorInfo detail with reason.
+func checkError(t *testing.T, err error, code codes.Code, reason string) {
+	t.Helper()
+	st := status.Convert(err)
+	if st.Code() != code {
+		t.Fatalf("got %v, want code %v", err, code)
+	}
+	if reason == "" {
+		return
+	}
+	for _, detail := range st.Details() {
+		if info, ok := detail.(*errdetails.ErrorInfo); ok {
+			if info.Reason != reason {
+				t.Fatalf("got reason %v, want %v: %v", info.Reason, reason, err)
+			}
+			return
+		}
+	}
+	t.Fatalf("no ErrorInfo in %v", err)
+}
+
+func TestEncryptDecryptRoundTrip(t *testing.T) {
+	dsm := dsmtest.NewServer(testAPIKey)
+	defer dsm.Close()
+	kid := dsm.AddKey("k8s")
+	client := startTestPlugin(t, dsm, nil)
+	ctx := requestContext(t)
+
+	st, err := client.Status(ctx, &StatusRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.Healthz != healthz || st.Version != version || st.KeyId == "" {
+		t.Fatalf("got %+v", st)
+	}
+
+	encrypted, err := client.Encrypt(ctx, &EncryptRequest{Plaintext: []byte("dek"), Uid: "1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if encrypted.KeyId != st.KeyId {
+		t.Fatalf("Encrypt returned key_id %v, Status %v", encrypted.KeyId, st.KeyId)
+	}
+	if bytes.Contains(encrypted.Ciphertext, []byte("dek")) {
+		t.Fatal("ciphertext contains the plaintext")
+	}
+	decrypted, err := client.Decrypt(ctx, &DecryptRequest{Ciphertext: encrypted.Ciphertext, KeyId: encrypted.KeyId, Uid: "2"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(decrypted.Plaintext, []byte("dek")) {
+		t.Fatalf("got %q", decrypted.Plaintext)
+	}
+	if n := dsm.Requests("/crypto/v1/decrypt"); n != 1 {
+		t.Fatalf("%v decrypt requests to DSM, want 1", n)
+	}
+
+	// Ciphertext wrapped before a rotation still decrypts.
+	if _, err := dsm.Rotate("k8s"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.Decrypt(ctx, &DecryptRequest{Ciphertext: encrypted.Ciphertext, KeyId: encrypted.KeyId}); err != nil {
+		t.Fatalf("decrypt with the key %v after rotation: %v", kid, err)
+	}
+}
+
+func TestDecryptRejectsInvalidRequests(t *testing.T) {
+	dsm := dsmtest.NewServer(testAPIKey)
+	defer dsm.Close()
+	dsm.AddKey("k8s")
+	client := startTestPlugin(t, dsm, nil)
+	ctx := requestContext(t)
+
+	encrypted, err := client.Encrypt(ctx, &EncryptRequest{Plaintext: []byte("dek")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = client.Decrypt(ctx, &DecryptRequest{Ciphertext: encrypted.Ciphertext, KeyId: "another key"})
+	checkError(t, err, codes.FailedPrecondition, reasonKeyIDMismatch)
+
+	_, err = client.Decrypt(ctx, &DecryptRequest{Ciphertext: []byte("garbage"), KeyId: encrypted.KeyId})
+	checkError(t, err, codes.InvalidArgument, "")
+}
+
+func TestDsmFaults(t *testing.T) {
+	tests := []struct {
+		name   string
+		faults dsmtest.Faults
+		code   codes.Code
+		reason string
+	}{
+		{"unauthenticated", dsmtest.Faults{StatusCode: 401}, codes.Unauthenticated, reasonDsmUnauthenticated},
+		{"rate limited", dsmtest.Faults{StatusCode: 429}, codes.ResourceExhausted, reasonDsmRateLimited},
+		{"unavailable", dsmtest.Faults{StatusCode: 503}, codes.Unavailable, reasonDsmUnavailable},
+		{"internal error", dsmtest.Faults{StatusCode: 500}, codes.Unavailable, reasonDsmUnavailable},
+		{"slow", dsmtest.Faults{Latency: 5 * time.Second}, codes.DeadlineExceeded, reasonDeadlineExceeded},
+	}
+	dsm := dsmtest.NewServer(testAPIKey)
+	defer dsm.Close()
+	dsm.AddKey("k8s")
+	client := startTestPlugin(t, dsm, nil)
+	ctx := requestContext(t)
+	encrypted, err := client.Encrypt(ctx, &EncryptRequest{Plaintext: []byte("dek")})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dsm.SetFaults(test.faults)
+			defer dsm.SetFaults(dsmtest.Faults{})
+			ctx := requestContext(t)
+			_, err := client.Encrypt(ctx, &EncryptRequest{Plaintext: []byte("dek")})
+			checkError(t, err, test.code, test.reason)
+			_, err = client.Decrypt(ctx, &DecryptRequest{Ciphertext: encrypted.Ciphertext, KeyId: encrypted.KeyId})
+			checkError(t, err, test.code, test.reason)
+		})
+	}
+
+	// The plugin recovers once DSM does.
+	if _, err := client.Encrypt(requestContext(t), &EncryptRequest{Plaintext: []byte("dek")}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDisabledKey(t *testing.T) {
+	dsm := dsmtest.NewServer(testAPIKey)
+	defer dsm.Close()
+	kid := dsm.AddKey("k8s")
+	ttl := duration(time.Minute)
+	client := startTestPlugin(t, dsm, func(config *pluginConfig) {
+		config.DecryptCache = &cacheConfig{TTL: &ttl}
+	})
+	ctx := requestContext(t)
+	encrypted, err := client.Encrypt(ctx, &EncryptRequest{Plaintext: []byte("dek")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.Decrypt(ctx, &DecryptRequest{Ciphertext: encrypted.Ciphertext, KeyId: encrypted.KeyId}); err != nil {
+		t.Fatal(err)
+	}
+
+	dsm.SetEnabled(kid, false)
+	_, err = client.Encrypt(ctx, &EncryptRequest{Plaintext: []byte("dek")})
+	checkError(t, err, codes.FailedPrecondition, reasonDsmRejected)
+	// The failed Encrypt purged the cached DEK, so Decrypt reaches DSM.
+	_, err = client.Decrypt(ctx, &DecryptRequest{Ciphertext: encrypted.Ciphertext, KeyId: encrypted.KeyId})
+	checkError(t, err, codes.FailedPrecondition, reasonDsmRejected)
+}
+
+func TestEncryptLimitRequiresUsageFile(t *testing.T) {
+	endpoint, apiKey, keyName := "https://dsm.example", testAPIKey, "k8s"
+	socket := filepath.Join(t.TempDir(), "kms.sock")
+	config := pluginConfig{SdkmsEndpoint: &endpoint, ApiKey: &apiKey, KeyName: &keyName, SocketFile: &socket}
+	warn := uint64(1000)
+	config.EncryptLimit = &encryptLimitConfig{Warn: &warn}
+	if err := config.validate(); err == nil || !strings.Contains(err.Error(), "`key_usage_file`") {
+		t.Fatalf("got %v", err)
+	}
+	usageFile := filepath.Join(t.TempDir(), "usage.json")
+	config.KeyUsageFile = &usageFile
+	if err := config.validate(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestEncryptLimit checks the limit against the key that wrapped the DEK,
+// not the one the key monitor saw last.
+func TestEncryptLimit(t *testing.T) {
+	dsm := dsmtest.NewServer(testAPIKey)
+	defer dsm.Close()
+	kid := dsm.AddKey("k8s")
+	usageFile := filepath.Join(t.TempDir(), "usage.json")
+	content := fmt.Sprintf(`{%q: {"decrypts": 0, "encrypts": %v}}`, kid, maxKeyEncrypts-1)
+	if err := os.WriteFile(usageFile, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	client := startTestPlugin(t, dsm, func(config *pluginConfig) {
+		config.KeyUsageFile = &usageFile
+	})
+	ctx := requestContext(t)
+
+	if _, err := client.Encrypt(ctx, &EncryptRequest{Plaintext: []byte("dek")}); err != nil {
+		t.Fatalf("last encryption allowed under the key: %v", err)
+	}
+	_, err := client.Encrypt(ctx, &EncryptRequest{Plaintext: []byte("dek")})
+	checkError(t, err, codes.FailedPrecondition, reasonKeyUsageLimit)
+
+	if _, err := dsm.Rotate("k8s"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.Encrypt(ctx, &EncryptRequest{Plaintext: []byte("dek")}); err != nil {
+		t.Fatalf("encryption with the rotated key: %v", err)
+	}
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"log"
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const metricsNamespace = "k8s_sdkms_plugin"
+
+var (
+	keyExpirySeconds = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "key_deactivation_seconds",
+		Help:      "Seconds until the configured key is deactivated, negative once it is, 0 if it has no deactivation date.",
+	})
+	keyExpiryWarning = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "key_deactivation_warning",
+		Help:      "1 while the configured key is within an expiry warning lead time of its deactivation date.",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(keyExpirySeconds, keyExpiryWarning)
+}
+
+// registeredUsage is the key usage exported as metrics.
+var registeredUsage *keyUsage
+
+// registerKeyUsage exports usage as metrics in place of any usage
+// registered before.
+func registerKeyUsage(usage *keyUsage) {
+	if registeredUsage != nil {
+		prometheus.Unregister(registeredUsage)
+	}
+	prometheus.MustRegister(usage)
+	registeredUsage = usage
+}
+
+// startMetricsServer serves Prometheus metrics on address, along with the
+// admin endpoint listing key usage.
+func startMetricsServer(address string, usage *keyUsage) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	mux.Handle("/keys/usage", usage)
+	go func() {
+		if err := http.ListenAndServe(address, mux); err != nil {
+			log.Printf("Metrics server stopped: %v", err)
+		}
+	}()
+}
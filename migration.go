@@ -0,0 +1,401 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/fortanix/k8s-sdkms-plugin/kube"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	migrationMethodRewrite                 = "rewrite"
+	migrationMethodStorageVersionMigration = "storage_version_migration"
+
+	defaultMigrationLeaseName = "k8s-sdkms-plugin-migration"
+	defaultMigrationRate      = 10
+	// migrationLeaseDuration is how long a node may go without renewing
+	// the lease before another node takes over the migration.
+	migrationLeaseDuration = 10 * time.Minute
+	// migratedAnnotation on the lease records the key_id data was last
+	// migrated to.
+	migratedAnnotation = "k8s-sdkms-plugin.fortanix.com/migrated-key-id"
+	migrationPageSize  = 500
+	// migrationPollInterval is how often StorageVersionMigrations are
+	// checked for completion.
+	migrationPollInterval = 10 * time.Second
+)
+
+// storageVersionMigrations are the objects created with the
+// "storage_version_migration" method.
+var storageVersionMigrations = kube.Resource{Group: "storagemigration.k8s.io", Version: "v1alpha1", Resource: "storageversionmigrations"}
+
+var (
+	migrationInProgress = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "storage_migration_in_progress",
+		Help:      "1 while this plugin is migrating stored data to the current key.",
+	})
+	migrationObjects = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "storage_migration_objects",
+		Help:      "Objects rewritten by the current or last storage migration.",
+	}, []string{"resource"})
+)
+
+func init() {
+	prometheus.MustRegister(migrationInProgress, migrationObjects)
+}
+
+// storageMigrationConfig makes the plugin have stored data re-encrypted
+// under the current key after the key_id changes.
+type storageMigrationConfig struct {
+	// Method is "rewrite" to write every object back through the API, or
+	// "storage_version_migration" to create StorageVersionMigrations.
+	Method    *string             `json:"method,omitempty"`
+	Resources []migrationResource `json:"resources,omitempty"`
+	// Rate is how many objects per second are rewritten.
+	Rate *float64 `json:"rate,omitempty"`
+	// Delay is how long to wait after the key_id changes, so that every
+	// apiserver uses the new key before data is rewritten.
+	Delay *duration `json:"delay,omitempty"`
+	// The Lease used to elect the node that migrates.
+	LeaseNamespace *string `json:"lease_namespace,omitempty"`
+	LeaseName      *string `json:"lease_name,omitempty"`
+}
+
+// migrationResource selects the objects to migrate, secrets by default.
+type migrationResource struct {
+	Group    *string `json:"group,omitempty"`
+	Version  *string `json:"version,omitempty"`
+	Resource *string `json:"resource,omitempty"`
+}
+
+func (c storageMigrationConfig) validate() error {
+	if c.Method != nil && *c.Method != migrationMethodRewrite && *c.Method != migrationMethodStorageVersionMigration {
+		return fmt.Errorf("`storage_migration.method` must be %q or %q", migrationMethodRewrite, migrationMethodStorageVersionMigration)
+	}
+	for _, r := range c.Resources {
+		if r.Resource == nil || *r.Resource == "" {
+			return errors.New("required field `storage_migration.resources.resource` is missing")
+		}
+	}
+	if c.Rate != nil && *c.Rate <= 0 {
+		return errors.New("`storage_migration.rate` must be positive")
+	}
+	if c.Delay != nil && *c.Delay < 0 {
+		return errors.New("`storage_migration.delay` must not be negative")
+	}
+	return nil
+}
+
+func (r migrationResource) resource() kube.Resource {
+	resource := kube.Resource{Version: "v1", Resource: *r.Resource}
+	if r.Group != nil {
+		resource.Group = *r.Group
+	}
+	if r.Version != nil {
+		resource.Version = *r.Version
+	}
+	return resource
+}
+
+func (r migrationResource) String() string {
+	if r.Group == nil || *r.Group == "" {
+		return *r.Resource
+	}
+	return *r.Resource + "." + *r.Group
+}
+
+// storageMigrator migrates stored data to the current key after the
+// key_id changes. The node that migrates is elected through a Lease, which
+// also records the last key_id migrated to.
+type storageMigrator struct {
+	kube      *kube.Client
+	identity  string
+	hash      string
+	method    string
+	resources []migrationResource
+	interval  time.Duration // between two rewrites
+	delay     time.Duration
+	pageSize  int
+
+	leaseNamespace string
+	leaseName      string
+
+	pending chan string // KIDs to migrate to
+}
+
+func newStorageMigrator(config pluginConfig, checkInterval time.Duration) (*storageMigrator, error) {
+	c := config.StorageMigration
+	m := &storageMigrator{
+		hash:           config.hash(),
+		method:         migrationMethodRewrite,
+		resources:      c.Resources,
+		interval:       time.Duration(float64(time.Second) / defaultMigrationRate),
+		delay:          checkInterval + 2*time.Minute,
+		pageSize:       migrationPageSize,
+		leaseNamespace: defaultLeaseNamespace,
+		leaseName:      defaultMigrationLeaseName,
+		pending:        make(chan string, 1),
+	}
+	if c.Method != nil {
+		m.method = *c.Method
+	}
+	if len(m.resources) == 0 {
+		secrets := "secrets"
+		m.resources = []migrationResource{{Resource: &secrets}}
+	}
+	if c.Rate != nil {
+		m.interval = time.Duration(float64(time.Second) / *c.Rate)
+	}
+	if c.Delay != nil {
+		m.delay = time.Duration(*c.Delay)
+	}
+	if c.LeaseNamespace != nil {
+		m.leaseNamespace = *c.LeaseNamespace
+	}
+	if c.LeaseName != nil {
+		m.leaseName = *c.LeaseName
+	}
+	client, err := kube.LoadKubeconfig(*config.Kubeconfig)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load `kubeconfig`: %v", err)
+	}
+	m.kube = client
+	if m.identity, err = os.Hostname(); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// migrateSoon asks for data to be migrated to kid, replacing any earlier
+// request that has not started yet.
+func (m *storageMigrator) migrateSoon(kid string) {
+	select {
+	case <-m.pending:
+	default:
+	}
+	m.pending <- kid
+}
+
+// run migrates once the delay has passed after the key is first seen or
+// changes, and retries failed migrations after the delay until the key
+// changes again. migrate does nothing if the data was already migrated.
+func (m *storageMigrator) run() {
+	kid := <-m.pending
+	for {
+		select {
+		case kid = <-m.pending:
+			continue
+		case <-time.After(m.delay):
+		}
+		if err := m.migrate(context.Background(), kid); err != nil {
+			log.Printf("Failed to migrate stored data to key %v, retrying in %v: %v", kid, m.delay, err)
+			continue
+		}
+		kid = <-m.pending
+	}
+}
+
+func (m *storageMigrator) migrate(ctx context.Context, kid string) error {
+	keyID := m.hash + "-" + kid
+	if done, err := m.migrated(ctx, keyID); err != nil || done {
+		return err
+	}
+	// If another node holds the lease, retry so that the migration is
+	// taken over should that node stop before it is done.
+	if acquired, err := m.renewLease(ctx); err != nil || !acquired {
+		if err == nil {
+			err = fmt.Errorf("lease %v/%v is held by another node", m.leaseNamespace, m.leaseName)
+		}
+		return err
+	}
+	// Another node may have finished just before the lease was free.
+	if done, err := m.migrated(ctx, keyID); err != nil || done {
+		return err
+	}
+
+	migrationInProgress.Set(1)
+	defer migrationInProgress.Set(0)
+	migrationObjects.Reset()
+	log.Printf("Migrating stored data to key %v", kid)
+	for _, r := range m.resources {
+		var err error
+		if m.method == migrationMethodStorageVersionMigration {
+			err = m.createMigration(ctx, r, kid)
+		} else {
+			err = m.rewrite(ctx, r)
+		}
+		if err != nil {
+			return fmt.Errorf("%v: %v", r, err)
+		}
+	}
+	if err := m.kube.SetLeaseAnnotation(ctx, m.leaseNamespace, m.leaseName, migratedAnnotation, keyID); err != nil {
+		return fmt.Errorf("failed to record migration: %v", err)
+	}
+	log.Printf("Migrated stored data to key %v", kid)
+	return nil
+}
+
+func (m *storageMigrator) migrated(ctx context.Context, keyID string) (bool, error) {
+	migrated, err := m.kube.LeaseAnnotation(ctx, m.leaseNamespace, m.leaseName, migratedAnnotation)
+	if err != nil {
+		return false, fmt.Errorf("failed to read lease %v/%v: %v", m.leaseNamespace, m.leaseName, err)
+	}
+	return migrated == keyID, nil
+}
+
+// renewLease takes or renews the lease, and returns false if another node
+// holds it.
+func (m *storageMigrator) renewLease(ctx context.Context) (bool, error) {
+	acquired, err := m.kube.TryAcquireLease(ctx, m.leaseNamespace, m.leaseName, m.identity, migrationLeaseDuration)
+	if err != nil {
+		return false, fmt.Errorf("failed to acquire lease %v/%v: %v", m.leaseNamespace, m.leaseName, err)
+	}
+	return acquired, nil
+}
+
+// keepLease renews the lease while migrating.
+func (m *storageMigrator) keepLease(ctx context.Context) error {
+	acquired, err := m.renewLease(ctx)
+	if err == nil && !acquired {
+		err = fmt.Errorf("lost lease %v/%v to another node", m.leaseNamespace, m.leaseName)
+	}
+	return err
+}
+
+// rewrite writes every object of r back unchanged, which makes the
+// apiserver store it encrypted under the current key.
+func (m *storageMigrator) rewrite(ctx context.Context, r migrationResource) error {
+	resource := r.resource()
+	limiter := time.NewTicker(m.interval)
+	defer limiter.Stop()
+	rewritten, skipped := 0, 0
+	return m.kube.List(ctx, resource, m.pageSize, func(page []kube.Object) error {
+		for _, o := range page {
+			<-limiter.C
+			namespace, name := o.Metadata()
+			err := m.kube.Do(ctx, http.MethodPut, resource.Path(namespace, name), o, nil)
+			switch {
+			case kube.IsConflict(err) || kube.IsNotFound(err):
+				// Written or deleted since it was listed.
+				skipped++
+			case err != nil:
+				return fmt.Errorf("failed to rewrite %v/%v: %v", namespace, name, err)
+			default:
+				rewritten++
+				migrationObjects.WithLabelValues(r.String()).Inc()
+			}
+		}
+		log.Printf("Migrating %v: %v rewritten, %v changed concurrently", r, rewritten, skipped)
+		if err := m.keepLease(ctx); err != nil {
+			return err
+		}
+		return nil
+	})
+}
+
+// createMigration creates a StorageVersionMigration for r and waits for
+// the apiserver to complete it. The name is derived from kid, so a failed
+// migration is deleted for the next attempt to create it again.
+func (m *storageMigrator) createMigration(ctx context.Context, r migrationResource, kid string) error {
+	resource := r.resource()
+	name := fmt.Sprintf("k8s-sdkms-plugin-%v-%v", kid, r)
+	migration := kube.Object{
+		"apiVersion": "storagemigration.k8s.io/v1alpha1",
+		"kind":       "StorageVersionMigration",
+		"metadata":   map[string]interface{}{"name": name},
+		"spec": map[string]interface{}{
+			"resource": map[string]interface{}{
+				"group":    resource.Group,
+				"version":  resource.Version,
+				"resource": resource.Resource,
+			},
+		},
+	}
+	err := m.kube.Do(ctx, http.MethodPost, storageVersionMigrations.Path("", ""), migration, nil)
+	if kube.IsConflict(err) {
+		// Left by an earlier attempt, which may have failed.
+		var failure string
+		if _, failure, err = m.migrationStatus(ctx, name); err != nil {
+			return err
+		}
+		if failure != "" {
+			log.Printf("StorageVersionMigration %v failed earlier, recreating it: %v", name, failure)
+			if err := m.deleteMigration(ctx, name); err != nil {
+				return err
+			}
+			err = m.kube.Do(ctx, http.MethodPost, storageVersionMigrations.Path("", ""), migration, nil)
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("failed to create StorageVersionMigration %v: %v", name, err)
+	}
+	log.Printf("Created StorageVersionMigration %v", name)
+	for {
+		succeeded, failure, err := m.migrationStatus(ctx, name)
+		if err != nil {
+			return err
+		}
+		if succeeded {
+			return nil
+		}
+		if failure != "" {
+			if err := m.deleteMigration(ctx, name); err != nil {
+				log.Printf("%v", err)
+			}
+			return fmt.Errorf("StorageVersionMigration %v failed: %v", name, failure)
+		}
+		log.Printf("Waiting for StorageVersionMigration %v", name)
+		if err := m.keepLease(ctx); err != nil {
+			return err
+		}
+		time.Sleep(migrationPollInterval)
+	}
+}
+
+// migrationStatus reads whether the StorageVersionMigration name
+// succeeded, or the message it failed with.
+func (m *storageMigrator) migrationStatus(ctx context.Context, name string) (bool, string, error) {
+	var status struct {
+		Status struct {
+			Conditions []struct {
+				Type    string `json:"type"`
+				Status  string `json:"status"`
+				Message string `json:"message"`
+			} `json:"conditions"`
+		} `json:"status"`
+	}
+	if err := m.kube.Do(ctx, http.MethodGet, storageVersionMigrations.Path("", name), nil, &status); err != nil {
+		return false, "", fmt.Errorf("failed to read StorageVersionMigration %v: %v", name, err)
+	}
+	for _, c := range status.Status.Conditions {
+		if c.Status != "True" {
+			continue
+		}
+		switch c.Type {
+		case "Succeeded":
+			return true, "", nil
+		case "Failed":
+			if c.Message == "" {
+				return false, "no message", nil
+			}
+			return false, c.Message, nil
+		}
+	}
+	return false, "", nil
+}
+
+func (m *storageMigrator) deleteMigration(ctx context.Context, name string) error {
+	err := m.kube.Do(ctx, http.MethodDelete, storageVersionMigrations.Path("", name), nil, nil)
+	if err != nil && !kube.IsNotFound(err) {
+		return fmt.Errorf("failed to delete StorageVersionMigration %v: %v", name, err)
+	}
+	return nil
+}
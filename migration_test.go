@@ -0,0 +1,314 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fortanix/k8s-sdkms-plugin/dsmtest"
+	"github.com/fortanix/k8s-sdkms-plugin/kube"
+	"github.com/fortanix/k8s-sdkms-plugin/kube/kubetest"
+)
+
+const testSecretCount = 5
+
+func newTestMigrator(server *kubetest.Server, identity, method string) *storageMigrator {
+	secrets := "secrets"
+	return &storageMigrator{
+		kube:           &kube.Client{Server: server.URL},
+		identity:       identity,
+		hash:           "hash",
+		method:         method,
+		resources:      []migrationResource{{Resource: &secrets}},
+		interval:       time.Millisecond,
+		pageSize:       2,
+		leaseNamespace: defaultLeaseNamespace,
+		leaseName:      defaultMigrationLeaseName,
+		pending:        make(chan string, 1),
+	}
+}
+
+// createTestSecrets creates secrets in two namespaces and returns their
+// paths.
+func createTestSecrets(t *testing.T, server *kubetest.Server) []string {
+	var paths []string
+	for i := 0; i < testSecretCount; i++ {
+		namespace, name := fmt.Sprintf("ns%v", i%2), fmt.Sprintf("secret-%v", i)
+		collection := fmt.Sprintf("/api/v1/namespaces/%v/secrets", namespace)
+		err := server.Create(collection, map[string]interface{}{
+			"metadata": map[string]interface{}{"name": name},
+			"data":     map[string]interface{}{"key": "dmFsdWU="},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		paths = append(paths, collection+"/"+name)
+	}
+	return paths
+}
+
+func resourceVersions(server *kubetest.Server, paths []string) map[string]string {
+	versions := make(map[string]string)
+	for _, path := range paths {
+		var o struct {
+			Metadata kube.ObjectMeta `json:"metadata"`
+		}
+		if server.Get(path, &o) {
+			versions[path] = o.Metadata.ResourceVersion
+		}
+	}
+	return versions
+}
+
+func migratedKeyID(t *testing.T, m *storageMigrator) string {
+	t.Helper()
+	keyID, err := m.kube.LeaseAnnotation(context.Background(), m.leaseNamespace, m.leaseName, migratedAnnotation)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return keyID
+}
+
+func TestMigrationRewrite(t *testing.T) {
+	server := kubetest.NewServer()
+	defer server.Close()
+	paths := createTestSecrets(t, server)
+	before := resourceVersions(server, paths)
+	m := newTestMigrator(server, "a", migrationMethodRewrite)
+	ctx := context.Background()
+
+	if err := m.migrate(ctx, "kid1"); err != nil {
+		t.Fatal(err)
+	}
+	after := resourceVersions(server, paths)
+	for _, path := range paths {
+		if after[path] == before[path] {
+			t.Errorf("%v was not rewritten", path)
+		}
+		if n := server.Requests(http.MethodPut, path); n != 1 {
+			t.Errorf("%v was written %v times", path, n)
+		}
+	}
+	// Pages of 2 objects.
+	if n := server.Requests(http.MethodGet, "/api/v1/secrets"); n != (testSecretCount+1)/2 {
+		t.Errorf("listed %v pages", n)
+	}
+	if keyID := migratedKeyID(t, m); keyID != "hash-kid1" {
+		t.Fatalf("migration recorded as %q", keyID)
+	}
+
+	// Nothing is left to do for the same key.
+	if err := m.migrate(ctx, "kid1"); err != nil {
+		t.Fatal(err)
+	}
+	if n := server.Requests(http.MethodPut, paths[0]); n != 1 {
+		t.Fatalf("%v was written again", paths[0])
+	}
+}
+
+// TestMigrationRewriteConflicts changes one secret and deletes another
+// between the list and the rewrite.
+func TestMigrationRewriteConflicts(t *testing.T) {
+	server := kubetest.NewServer()
+	defer server.Close()
+	paths := createTestSecrets(t, server)
+	other := &kube.Client{Server: server.URL}
+	changed, deleted := paths[0], paths[1]
+	m := newTestMigrator(server, "a", migrationMethodRewrite)
+	m.kube.HTTPClient = &http.Client{Transport: kubetest.HookTransport{
+		Before: func(r *http.Request) {
+			if r.Method != http.MethodPut {
+				return
+			}
+			ctx := context.Background()
+			switch r.URL.Path {
+			case changed:
+				update := map[string]interface{}{"metadata": map[string]interface{}{}, "data": map[string]interface{}{}}
+				if err := other.Do(ctx, http.MethodPut, changed, update, nil); err != nil {
+					t.Error(err)
+				}
+			case deleted:
+				if err := other.Do(ctx, http.MethodDelete, deleted, nil, nil); err != nil {
+					t.Error(err)
+				}
+			}
+		},
+	}}
+
+	if err := m.migrate(context.Background(), "kid1"); err != nil {
+		t.Fatal(err)
+	}
+	if keyID := migratedKeyID(t, m); keyID != "hash-kid1" {
+		t.Fatalf("migration recorded as %q", keyID)
+	}
+	var secret map[string]interface{}
+	server.Get(changed, &secret)
+	if data := secret["data"].(map[string]interface{}); len(data) != 0 {
+		t.Fatalf("rewrite overwrote the concurrent change of %v", changed)
+	}
+}
+
+func TestMigrationStorageVersionMigration(t *testing.T) {
+	server := kubetest.NewServer()
+	defer server.Close()
+	paths := createTestSecrets(t, server)
+	m := newTestMigrator(server, "a", migrationMethodStorageVersionMigration)
+
+	if err := m.migrate(context.Background(), "kid1"); err != nil {
+		t.Fatal(err)
+	}
+	var migration struct {
+		Spec struct {
+			Resource map[string]string `json:"resource"`
+		} `json:"spec"`
+	}
+	path := "/apis/storagemigration.k8s.io/v1alpha1/storageversionmigrations/k8s-sdkms-plugin-kid1-secrets"
+	if !server.Get(path, &migration) {
+		t.Fatal("no StorageVersionMigration was created")
+	}
+	if r := migration.Spec.Resource; r["resource"] != "secrets" || r["version"] != "v1" || r["group"] != "" {
+		t.Fatalf("migration of %v", r)
+	}
+	if n := server.Requests(http.MethodPut, paths[0]); n != 0 {
+		t.Fatalf("%v was rewritten by the plugin", paths[0])
+	}
+	if keyID := migratedKeyID(t, m); keyID != "hash-kid1" {
+		t.Fatalf("migration recorded as %q", keyID)
+	}
+}
+
+// failedMigration is a StorageVersionMigration of secrets that failed.
+func failedMigration(name string) map[string]interface{} {
+	return map[string]interface{}{
+		"metadata": map[string]interface{}{"name": name},
+		"spec":     map[string]interface{}{"resource": map[string]interface{}{"version": "v1", "resource": "secrets"}},
+		"status": map[string]interface{}{"conditions": []interface{}{
+			map[string]interface{}{"type": "Failed", "status": "True", "message": "timed out"},
+		}},
+	}
+}
+
+// TestMigrationRecreatesFailedMigration finds the StorageVersionMigration
+// of an earlier attempt that failed, and replaces it.
+func TestMigrationRecreatesFailedMigration(t *testing.T) {
+	server := kubetest.NewServer()
+	defer server.Close()
+	createTestSecrets(t, server)
+	m := newTestMigrator(server, "a", migrationMethodStorageVersionMigration)
+	name := "k8s-sdkms-plugin-kid1-secrets"
+	if err := server.Create(storageVersionMigrations.Path("", ""), failedMigration(name)); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := m.migrate(context.Background(), "kid1"); err != nil {
+		t.Fatal(err)
+	}
+	if n := server.Requests(http.MethodDelete, storageVersionMigrations.Path("", name)); n != 1 {
+		t.Fatalf("failed StorageVersionMigration deleted %v times, want once", n)
+	}
+	if keyID := migratedKeyID(t, m); keyID != "hash-kid1" {
+		t.Fatalf("migration recorded as %q", keyID)
+	}
+}
+
+// TestMigrationDeletesFailedMigration makes the StorageVersionMigration
+// fail while the plugin waits for it, and checks that the next attempt
+// creates it again.
+func TestMigrationDeletesFailedMigration(t *testing.T) {
+	server := kubetest.NewServer()
+	defer server.Close()
+	createTestSecrets(t, server)
+	other := &kube.Client{Server: server.URL}
+	m := newTestMigrator(server, "a", migrationMethodStorageVersionMigration)
+	name := "k8s-sdkms-plugin-kid1-secrets"
+	path := storageVersionMigrations.Path("", name)
+	m.kube.HTTPClient = &http.Client{Transport: kubetest.HookTransport{
+		Before: func(r *http.Request) {
+			if r.Method == http.MethodGet && r.URL.Path == path {
+				if err := other.Do(context.Background(), http.MethodPut, path, failedMigration(name), nil); err != nil {
+					t.Error(err)
+				}
+			}
+		},
+	}}
+	ctx := context.Background()
+
+	err := m.migrate(ctx, "kid1")
+	if err == nil || !strings.Contains(err.Error(), "timed out") {
+		t.Fatalf("got %v for a failed StorageVersionMigration", err)
+	}
+	if server.Get(path, &struct{}{}) {
+		t.Fatal("failed StorageVersionMigration was not deleted")
+	}
+	m.kube.HTTPClient = nil
+	if err := m.migrate(ctx, "kid1"); err != nil {
+		t.Fatal(err)
+	}
+	if keyID := migratedKeyID(t, m); keyID != "hash-kid1" {
+		t.Fatalf("migration recorded as %q", keyID)
+	}
+}
+
+// TestMigrationLeaseHandoff has b wait while a holds the lease, and take
+// the migration over once a stops renewing it.
+func TestMigrationLeaseHandoff(t *testing.T) {
+	server := kubetest.NewServer()
+	defer server.Close()
+	paths := createTestSecrets(t, server)
+	a := newTestMigrator(server, "a", migrationMethodRewrite)
+	b := newTestMigrator(server, "b", migrationMethodRewrite)
+	ctx := context.Background()
+
+	if acquired, err := a.renewLease(ctx); err != nil || !acquired {
+		t.Fatalf("a did not acquire the lease: %v", err)
+	}
+	err := b.migrate(ctx, "kid1")
+	if err == nil || !strings.Contains(err.Error(), "held by another node") {
+		t.Fatalf("got %v while a held the lease", err)
+	}
+	if n := server.Requests(http.MethodPut, paths[0]); n != 0 {
+		t.Fatal("b rewrote data while a held the lease")
+	}
+
+	// a stops renewing the lease.
+	leasePath := "/apis/coordination.k8s.io/v1/namespaces/" + defaultLeaseNamespace + "/leases/" + defaultMigrationLeaseName
+	var lease kube.Lease
+	server.Get(leasePath, &lease)
+	expired := time.Now().Add(-2 * migrationLeaseDuration).UTC().Format("2006-01-02T15:04:05.000000Z07:00")
+	lease.Spec.RenewTime = &expired
+	if err := a.kube.Do(ctx, http.MethodPut, leasePath, &lease, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.migrate(ctx, "kid1"); err != nil {
+		t.Fatal(err)
+	}
+	if keyID := migratedKeyID(t, b); keyID != "hash-kid1" {
+		t.Fatalf("migration recorded as %q", keyID)
+	}
+}
+
+// TestKeyMonitorReportsFirstKey checks that the migrator learns the key at
+// startup, so that a migration interrupted by a restart is resumed.
+func TestKeyMonitorReportsFirstKey(t *testing.T) {
+	dsm := dsmtest.NewServer(testAPIKey)
+	defer dsm.Close()
+	kid := dsm.AddKey("k8s")
+	backend := newTestDsmBackend(dsm, nil)
+	monitor := newKeyMonitor(backend.config, backend)
+	var changes []string
+	monitor.onKeyChange = func(kid string) { changes = append(changes, kid) }
+
+	monitor.refreshKey()
+	monitor.refreshKey()
+	rotated, err := dsm.Rotate("k8s")
+	if err != nil {
+		t.Fatal(err)
+	}
+	monitor.refreshKey()
+	if len(changes) != 2 || changes[0] != kid || changes[1] != rotated {
+		t.Fatalf("got changes %v, want %v then %v", changes, kid, rotated)
+	}
+}
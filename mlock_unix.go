@@ -0,0 +1,15 @@
+//go:build unix
+
+package main
+
+import "golang.org/x/sys/unix"
+
+// mlock keeps b out of swap.
+func mlock(b []byte) error {
+	return unix.Mlock(b)
+}
+
+// munlock undoes mlock.
+func munlock(b []byte) error {
+	return unix.Munlock(b)
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"time"
+)
+
+const defaultKeyCheckInterval = 5 * time.Minute
+
+// defaultExpiryWarnings are the lead times before the key's deactivation
+// date at which the plugin starts warning.
+var defaultExpiryWarnings = []time.Duration{30 * 24 * time.Hour, 7 * 24 * time.Hour, 24 * time.Hour}
+
+// keyMonitor checks the configured key in the background and keeps track
+// of problems that make the plugin unhealthy or that it should warn about.
+type keyMonitor struct {
+	backend        Backend
+	interval       time.Duration
+	expiryWarnings []time.Duration // longest first
+	// onKeyChange is called with the KID of the configured key when it is
+	// first seen and whenever it changes, if set.
+	onKeyChange func(kid string)
+	// onKeyDisabled is called whenever the configured key is found
+	// disabled, if set.
+	onKeyDisabled func()
+
+	mu          sync.Mutex
+	failure     error         // set while the key fails a check
+	expiryLead  time.Duration // smallest lead time crossed, 0 if none
+	expiryNotes string        // set while the key is close to deactivation
+	kid         string        // current KID of the configured key
+	disabled    bool          // whether the key was disabled at the last check
+}
+
+func newKeyMonitor(config pluginConfig, backend Backend) *keyMonitor {
+	interval := defaultKeyCheckInterval
+	if config.KeyCheckInterval != nil {
+		interval = time.Duration(*config.KeyCheckInterval)
+	}
+	warnings := defaultExpiryWarnings
+	if config.ExpiryWarnings != nil {
+		warnings = make([]time.Duration, len(config.ExpiryWarnings))
+		for i, d := range config.ExpiryWarnings {
+			warnings[i] = time.Duration(d)
+		}
+	}
+	sort.Slice(warnings, func(i, j int) bool { return warnings[i] > warnings[j] })
+	return &keyMonitor{backend: backend, interval: interval, expiryWarnings: warnings}
+}
+
+func (m *keyMonitor) run() {
+	for range time.Tick(m.interval) {
+		m.check()
+		m.refreshKey()
+	}
+}
+
+func (m *keyMonitor) check() {
+	ctx, cancel := context.WithTimeout(context.Background(), m.interval)
+	defer cancel()
+	pinned, ok := m.backend.(pinnedBackend)
+	if !ok {
+		return
+	}
+	err := pinned.verifyPin(ctx)
+	if err != nil && !isKeyPinError(err) {
+		// Leave the state alone if DSM could not be asked.
+		log.Printf("Failed to check the key: %v", err)
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	switch {
+	case err != nil && m.failure == nil:
+		log.Printf("ERROR: %v, refusing to encrypt", err)
+	case err == nil && m.failure != nil:
+		log.Println("Key matches `key_pin` again")
+	}
+	m.failure = err
+}
+
+// refreshKey records the current KID, reports a disabled key and warns
+// once per configured lead time as the deactivation date of the key
+// approaches.
+func (m *keyMonitor) refreshKey() {
+	ctx, cancel := context.WithTimeout(context.Background(), m.interval)
+	defer cancel()
+	key, err := m.backend.DescribeKey(ctx)
+	if err != nil {
+		log.Printf("Failed to check the key: %v", err)
+		return
+	}
+	changed := false
+	defer func() {
+		if changed && m.onKeyChange != nil {
+			m.onKeyChange(key.KID)
+		}
+		if !key.Enabled && m.onKeyDisabled != nil {
+			m.onKeyDisabled()
+		}
+	}()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if key.KID != m.kid {
+		if m.kid != "" {
+			log.Printf("Configured key is now %v", key.KID)
+		}
+		changed = true
+	}
+	if !key.Enabled && (changed || !m.disabled) {
+		log.Printf("WARNING: key %v is disabled", key.KID)
+	}
+	m.kid, m.disabled = key.KID, !key.Enabled
+	if key.DeactivationDate.IsZero() {
+		keyExpirySeconds.Set(0)
+		keyExpiryWarning.Set(0)
+		m.expiryLead, m.expiryNotes = 0, ""
+		return
+	}
+	remaining := time.Until(key.DeactivationDate)
+	keyExpirySeconds.Set(remaining.Seconds())
+	var lead time.Duration
+	for _, w := range m.expiryWarnings {
+		if remaining <= w {
+			lead = w
+		}
+	}
+	if lead == 0 {
+		keyExpiryWarning.Set(0)
+		m.expiryLead, m.expiryNotes = 0, ""
+		return
+	}
+	keyExpiryWarning.Set(1)
+	date := key.DeactivationDate.UTC().Format(time.RFC3339)
+	if remaining <= 0 {
+		m.expiryNotes = fmt.Sprintf("key %v was deactivated on %v", key.KID, date)
+	} else {
+		m.expiryNotes = fmt.Sprintf("key %v will be deactivated on %v, in %v", key.KID, date, remaining.Round(time.Minute))
+	}
+	if lead != m.expiryLead {
+		log.Printf("WARNING: %v, rotate it before then", m.expiryNotes)
+		m.expiryLead = lead
+	}
+}
+
+// keyFailure returns the error that makes the plugin unhealthy, if any.
+func (m *keyMonitor) keyFailure() error {
+	if m == nil {
+		return nil
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.failure
+}
+
+// keyWarning returns a note on the key that does not make the plugin
+// unhealthy, such as an approaching deactivation date.
+func (m *keyMonitor) keyWarning() string {
+	if m == nil {
+		return ""
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.expiryNotes
+}
+
+// currentKID returns the KID of the configured key as of the last check.
+func (m *keyMonitor) currentKID() string {
+	if m == nil {
+		return ""
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.kid
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// fakeBackend describes the key set by the test and fails every
+// operation.
+type fakeBackend struct {
+	mu  sync.Mutex
+	key KeyInfo
+}
+
+func (b *fakeBackend) Wrap(ctx context.Context, plain []byte) (*wrappedData, error) {
+	return nil, errors.New("not implemented")
+}
+
+func (b *fakeBackend) Unwrap(ctx context.Context, data *wrappedData) ([]byte, error) {
+	return nil, errors.New("not implemented")
+}
+
+func (b *fakeBackend) DescribeKey(ctx context.Context) (*KeyInfo, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	key := b.key
+	return &key, nil
+}
+
+func (b *fakeBackend) Health(ctx context.Context) error { return nil }
+
+func (b *fakeBackend) setKey(key KeyInfo) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.key = key
+}
+
+func newTestMonitor(backend Backend) *keyMonitor {
+	interval := duration(time.Second)
+	return newKeyMonitor(pluginConfig{KeyCheckInterval: &interval}, backend)
+}
+
+func TestKeyMonitorReportsDisabledKey(t *testing.T) {
+	backend := &fakeBackend{key: KeyInfo{KID: "k1", Enabled: true}}
+	m := newTestMonitor(backend)
+	disabled := 0
+	m.onKeyDisabled = func() { disabled++ }
+
+	m.refreshKey()
+	if disabled != 0 {
+		t.Fatal("an enabled key was reported disabled")
+	}
+	backend.setKey(KeyInfo{KID: "k1"})
+	m.refreshKey()
+	m.refreshKey()
+	if disabled != 2 {
+		t.Fatalf("a disabled key was reported %v times in 2 checks", disabled)
+	}
+}
+
+// TestKeyMonitorExpiryWarnings moves the deactivation date of the key
+// across the default lead times and checks the warning, the gauges and
+// that each lead time is logged once.
+func TestKeyMonitorExpiryWarnings(t *testing.T) {
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+	defer log.SetOutput(os.Stderr)
+	backend := &fakeBackend{}
+	m := newTestMonitor(backend)
+	day := 24 * time.Hour
+
+	steps := []struct {
+		name      string
+		remaining time.Duration // 0 for no deactivation date
+		lead      time.Duration
+		note      string
+		logged    bool
+	}{
+		{"no date", 0, 0, "", false},
+		{"far off", 40 * day, 0, "", false},
+		{"30 days", 30*day - time.Hour, 30 * day, "will be deactivated", true},
+		{"30 days again", 30*day - 2*time.Hour, 30 * day, "will be deactivated", false},
+		{"7 days", 7*day - time.Hour, 7 * day, "will be deactivated", true},
+		{"1 day", day - time.Hour, day, "will be deactivated", true},
+		{"deactivated", -time.Hour, day, "was deactivated", false},
+		{"date removed", 0, 0, "", false},
+		{"30 days after removal", 30*day - time.Hour, 30 * day, "will be deactivated", true},
+	}
+	for _, step := range steps {
+		key := KeyInfo{KID: "k1", Enabled: true}
+		if step.remaining != 0 {
+			key.DeactivationDate = time.Now().Add(step.remaining)
+		}
+		backend.setKey(key)
+		logs.Reset()
+		m.refreshKey()
+
+		if m.expiryLead != step.lead {
+			t.Errorf("%v: lead time is %v, want %v", step.name, m.expiryLead, step.lead)
+		}
+		if note := m.keyWarning(); !strings.Contains(note, step.note) || (step.note == "") != (note == "") {
+			t.Errorf("%v: warning is %q, want it to mention %q", step.name, note, step.note)
+		}
+		if logged := strings.Contains(logs.String(), "rotate it before then"); logged != step.logged {
+			t.Errorf("%v: logged %q", step.name, logs.String())
+		}
+		warning := 0.0
+		if step.lead != 0 {
+			warning = 1
+		}
+		if got := testutil.ToFloat64(keyExpiryWarning); got != warning {
+			t.Errorf("%v: warning gauge is %v, want %v", step.name, got, warning)
+		}
+		seconds := testutil.ToFloat64(keyExpirySeconds)
+		if diff := seconds - step.remaining.Seconds(); diff > 0 || diff < -60 {
+			t.Errorf("%v: deactivation gauge is %v, want %v", step.name, seconds, step.remaining.Seconds())
+		}
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/peer"
+)
+
+// peerCredentials reads the user ID of the process on the other end of the
+// unix socket when a connection is accepted, so that authInterceptor can
+// check it. It performs no handshake and does not encrypt anything.
+type peerCredentials struct{}
+
+// peerAuthInfo is the result of reading the peer credentials of a
+// connection.
+type peerAuthInfo struct {
+	credentials.CommonAuthInfo
+	uid uint32
+	err error // set if the credentials could not be read
+}
+
+func (peerAuthInfo) AuthType() string { return "peercred" }
+
+func (peerCredentials) ClientHandshake(ctx context.Context, authority string, conn net.Conn) (net.Conn, credentials.AuthInfo, error) {
+	return nil, nil, errors.New("peer credentials are only checked by the server")
+}
+
+func (peerCredentials) ServerHandshake(conn net.Conn) (net.Conn, credentials.AuthInfo, error) {
+	uid, err := peerUID(conn)
+	return conn, peerAuthInfo{
+		CommonAuthInfo: credentials.CommonAuthInfo{SecurityLevel: credentials.NoSecurity},
+		uid:            uid,
+		err:            err,
+	}, nil
+}
+
+func (peerCredentials) Info() credentials.ProtocolInfo {
+	return credentials.ProtocolInfo{SecurityProtocol: "peercred"}
+}
+
+func (c peerCredentials) Clone() credentials.TransportCredentials { return c }
+
+func (peerCredentials) OverrideServerName(string) error { return nil }
+
+// authInterceptor rejects requests from processes whose user ID is not in
+// uids, read through the peer credentials of the unix socket. Every
+// request is allowed if uids is empty, leaving access to the permissions
+// of `socket_file`.
+func authInterceptor(uids []uint32) grpc.UnaryServerInterceptor {
+	allowed := make(map[uint32]bool, len(uids))
+	for _, uid := range uids {
+		allowed[uid] = true
+	}
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		if len(allowed) == 0 {
+			return handler(ctx, req)
+		}
+		p, ok := peer.FromContext(ctx)
+		if !ok {
+			return nil, newPluginError(codes.Unauthenticated, reasonPeerNotAllowed, nil, "request has no peer")
+		}
+		auth, ok := p.AuthInfo.(peerAuthInfo)
+		if !ok {
+			return nil, newPluginError(codes.Unauthenticated, reasonPeerNotAllowed, nil, "peer credentials were not read")
+		}
+		if auth.err != nil {
+			return nil, newPluginError(codes.Unauthenticated, reasonPeerNotAllowed, nil, "failed to read peer credentials: %v", auth.err)
+		}
+		if !allowed[auth.uid] {
+			return nil, newPluginError(codes.PermissionDenied, reasonPeerNotAllowed, nil,
+				"peer with user ID %v is not in `allowed_peer_uids`", auth.uid)
+		}
+		return handler(ctx, req)
+	}
+}
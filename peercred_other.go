@@ -0,0 +1,14 @@
+//go:build !linux
+
+package main
+
+import (
+	"errors"
+	"net"
+)
+
+const peerCredentialsSupported = false
+
+func peerUID(conn net.Conn) (uint32, error) {
+	return 0, errors.New("reading peer credentials is not supported on this platform")
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/fortanix/sdkms-client-go/sdkms"
+)
+
+// dsmTimeLayout is the format of timestamps in the DSM API.
+const dsmTimeLayout = "20060102T150405Z"
+
+// keyPinConfig pins the identity of the configured key, so that a key that
+// was deleted and recreated under the same name is not used silently. The
+// pin matches the configured key or any key it replaced through rotation.
+type keyPinConfig struct {
+	// Kcv is the key check value shown for the key in DSM.
+	Kcv *string `json:"kcv,omitempty"`
+	// CreatedAt is the creation time of the key, e.g. "20240131T120000Z".
+	CreatedAt *string `json:"created_at,omitempty"`
+}
+
+func (c keyPinConfig) validate() error {
+	if c.Kcv == nil && c.CreatedAt == nil {
+		return errors.New("`key_pin` needs `kcv` or `created_at`")
+	}
+	if c.CreatedAt != nil {
+		if _, err := time.Parse(dsmTimeLayout, *c.CreatedAt); err != nil {
+			return fmt.Errorf("invalid `key_pin.created_at`: %v", err)
+		}
+	}
+	return nil
+}
+
+func (c keyPinConfig) matches(key *sdkms.Sobject) bool {
+	if c.Kcv != nil && (key.Kcv == nil || !strings.EqualFold(*key.Kcv, *c.Kcv)) {
+		return false
+	}
+	if c.CreatedAt != nil {
+		pinned, _ := time.Parse(dsmTimeLayout, *c.CreatedAt)
+		created, err := key.CreatedAt.Std()
+		if err != nil || !created.Equal(pinned) {
+			return false
+		}
+	}
+	return true
+}
+
+// keyPinError reports that the configured key does not match `key_pin`.
+type keyPinError struct {
+	err error
+}
+
+func (e *keyPinError) Error() string { return e.err.Error() }
+func (e *keyPinError) Unwrap() error { return e.err }
+
+func isKeyPinError(err error) bool {
+	var pinErr *keyPinError
+	return errors.As(err, &pinErr)
+}
+
+// pinnedBackend is implemented by backends that can verify `key_pin`.
+type pinnedBackend interface {
+	verifyPin(ctx context.Context) error
+}
+
+// verifyPin checks that the configured key, or a key it replaced, matches
+// `key_pin`. DSM errors are returned as is, a mismatch as a keyPinError.
+func (b *dsmBackend) verifyPin(ctx context.Context) error {
+	pin := b.config.KeyPin
+	if pin == nil {
+		return nil
+	}
+	var current string
+	matched := false
+	err := b.walkLineage(ctx, func(kid string, key *sdkms.Sobject) bool {
+		if current == "" {
+			current = kid
+		}
+		matched = key != nil && pin.matches(key)
+		return matched
+	})
+	if err != nil {
+		return err
+	}
+	if !matched {
+		return &keyPinError{fmt.Errorf("key %v does not match `key_pin`, "+
+			"it is not the pinned key or a rotation of it", current)}
+	}
+	return nil
+}
+
+func (b *dualBackend) verifyPin(ctx context.Context) error {
+	for _, backend := range []Backend{b.primary, b.secondary} {
+		if pinned, ok := backend.(pinnedBackend); ok {
+			if err := pinned.verifyPin(ctx); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fortanix/k8s-sdkms-plugin/dsmtest"
+	"github.com/fortanix/sdkms-client-go/sdkms"
+	"google.golang.org/grpc/codes"
+)
+
+// recreateKey replaces the key kid with an unrelated key of the same name,
+// as deleting it and creating a new one in DSM would.
+func recreateKey(dsm *dsmtest.Server, kid string) string {
+	dsm.UpdateKey(kid, func(sobject *sdkms.Sobject) {
+		deleted := *sobject.Name + " (deleted)"
+		sobject.Name = &deleted
+	})
+	return dsm.AddKey("k8s")
+}
+
+func keyKcv(dsm *dsmtest.Server, kid string) string {
+	var kcv string
+	dsm.UpdateKey(kid, func(sobject *sdkms.Sobject) { kcv = *sobject.Kcv })
+	return kcv
+}
+
+func TestVerifyPin(t *testing.T) {
+	dsm := dsmtest.NewServer(testAPIKey)
+	defer dsm.Close()
+	kid := dsm.AddKey("k8s")
+	kcv := keyKcv(dsm, kid)
+	created := "20240131T120000Z"
+	dsm.UpdateKey(kid, func(sobject *sdkms.Sobject) { sobject.CreatedAt = sdkms.Time(created) })
+	ctx := context.Background()
+
+	pins := map[string]keyPinConfig{
+		"kcv":        {Kcv: &kcv},
+		"created_at": {CreatedAt: &created},
+		"both":       {Kcv: &kcv, CreatedAt: &created},
+	}
+	for name, pin := range pins {
+		pin := pin
+		b := newTestDsmBackend(dsm, func(config *pluginConfig) { config.KeyPin = &pin })
+		if err := b.verifyPin(ctx); err != nil {
+			t.Fatalf("%v: %v", name, err)
+		}
+	}
+
+	if _, err := dsm.Rotate("k8s"); err != nil {
+		t.Fatal(err)
+	}
+	for name, pin := range pins {
+		pin := pin
+		b := newTestDsmBackend(dsm, func(config *pluginConfig) { config.KeyPin = &pin })
+		if err := b.verifyPin(ctx); err != nil {
+			t.Fatalf("%v after rotation: %v", name, err)
+		}
+	}
+
+	other := dsmtest.NewServer(testAPIKey)
+	defer other.Close()
+	recreateKey(other, other.AddKey("k8s"))
+	pin := keyPinConfig{Kcv: &kcv}
+	b := newTestDsmBackend(other, func(config *pluginConfig) { config.KeyPin = &pin })
+	if err := b.verifyPin(ctx); !isKeyPinError(err) {
+		t.Fatalf("got %v for an unrelated key", err)
+	}
+}
+
+func TestKeyPinRecreatedKey(t *testing.T) {
+	dsm := dsmtest.NewServer(testAPIKey)
+	defer dsm.Close()
+	kid := dsm.AddKey("k8s")
+	kcv := keyKcv(dsm, kid)
+	// The interval also bounds each check, so it must leave room for the
+	// deadline safety margin.
+	interval := duration(300 * time.Millisecond)
+	client := startTestPlugin(t, dsm, func(config *pluginConfig) {
+		config.KeyPin = &keyPinConfig{Kcv: &kcv}
+		config.KeyCheckInterval = &interval
+	})
+	ctx := requestContext(t)
+
+	rotated, err := dsm.Rotate("k8s")
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(2 * time.Duration(interval))
+	st, err := client.Status(ctx, &StatusRequest{})
+	if err != nil || st.Healthz != healthz {
+		t.Fatalf("got %+v, %v after rotation", st, err)
+	}
+	if _, err := client.Encrypt(ctx, &EncryptRequest{Plaintext: []byte("dek"), Uid: "1"}); err != nil {
+		t.Fatal(err)
+	}
+
+	recreateKey(dsm, rotated)
+	for {
+		st, err = client.Status(ctx, &StatusRequest{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if st.Healthz != healthz {
+			break
+		}
+		select {
+		case <-ctx.Done():
+			t.Fatal("still healthy after the key was recreated")
+		case <-time.After(time.Duration(interval)):
+		}
+	}
+	if !strings.Contains(st.Healthz, "`key_pin`") {
+		t.Fatalf("got %q", st.Healthz)
+	}
+	_, err = client.Encrypt(ctx, &EncryptRequest{Plaintext: []byte("dek"), Uid: "2"})
+	checkError(t, err, codes.FailedPrecondition, reasonKeyPinMismatch)
+}
@@ -0,0 +1,29 @@
+package main
+
+import "errors"
+
+// pkcs11Config selects the PKCS#11 backend, which reaches the key through
+// the DSM PKCS#11 library (or any other PKCS#11 module) instead of the
+// REST API. It requires a build with cgo enabled.
+type pkcs11Config struct {
+	ModulePath *string `json:"module_path,omitempty"`
+	Slot       *uint   `json:"slot,omitempty"`
+	Pin        *string `json:"pin,omitempty"`
+	KeyLabel   *string `json:"key_label,omitempty"`
+}
+
+func (c pkcs11Config) validate() error {
+	if c.ModulePath == nil {
+		return errors.New("required field `pkcs11.module_path` is missing")
+	}
+	if c.Slot == nil {
+		return errors.New("required field `pkcs11.slot` is missing")
+	}
+	if c.Pin == nil {
+		return errors.New("required field `pkcs11.pin` is missing")
+	}
+	if c.KeyLabel == nil {
+		return errors.New("required field `pkcs11.key_label` is missing")
+	}
+	return nil
+}
@@ -0,0 +1,354 @@
+//go:build cgo
+
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+
+	"github.com/miekg/pkcs11"
+	"google.golang.org/grpc/codes"
+)
+
+const (
+	gcmIVSize  = 12
+	gcmTagSize = 16
+)
+
+// pkcs11Backend performs the same AES-GCM wrap as dsmBackend through a
+// PKCS#11 module. The PKCS#11 API is not safe for concurrent use of a
+// single session, so all operations are serialized on one logged-in
+// session.
+type pkcs11Backend struct {
+	config  pkcs11Config
+	lineage *keyLineage
+
+	mu      sync.Mutex
+	ctx     *pkcs11.Ctx
+	session pkcs11.SessionHandle
+}
+
+func init() {
+	classifyModuleError = classifyPkcs11Error
+}
+
+func newPkcs11Backend(config pkcs11Config, allowedKeyIDs []string) (Backend, error) {
+	ctx := pkcs11.New(*config.ModulePath)
+	if ctx == nil {
+		return nil, fmt.Errorf("failed to load PKCS#11 module %v", *config.ModulePath)
+	}
+	if err := ctx.Initialize(); err != nil {
+		ctx.Destroy()
+		return nil, fmt.Errorf("failed to initialize PKCS#11 module: %v", err)
+	}
+	b := &pkcs11Backend{config: config, lineage: newKeyLineage(allowedKeyIDs), ctx: ctx}
+	if err := b.openSession(); err != nil {
+		ctx.Finalize()
+		ctx.Destroy()
+		return nil, err
+	}
+	return b, nil
+}
+
+// openSession opens a new session and logs in, closing the old session if
+// there was one.
+func (b *pkcs11Backend) openSession() error {
+	if b.session != 0 {
+		b.ctx.CloseSession(b.session)
+		b.session = 0
+	}
+	session, err := b.ctx.OpenSession(*b.config.Slot, pkcs11.CKF_SERIAL_SESSION)
+	if err != nil {
+		return fmt.Errorf("failed to open PKCS#11 session on slot %v: %w", *b.config.Slot, err)
+	}
+	err = b.ctx.Login(session, pkcs11.CKU_USER, *b.config.Pin)
+	if err != nil && !errors.Is(err, pkcs11.Error(pkcs11.CKR_USER_ALREADY_LOGGED_IN)) {
+		b.ctx.CloseSession(session)
+		return fmt.Errorf("PKCS#11 login failed: %w", err)
+	}
+	b.session = session
+	return nil
+}
+
+// withSession runs f, and runs it again on a new session if the module
+// reports that the session was lost, e.g. after the token was reset.
+func (b *pkcs11Backend) withSession(f func() error) error {
+	err := f()
+	if !isSessionLost(err) {
+		return err
+	}
+	log.Printf("PKCS#11 session lost, logging in again: %v", err)
+	if err := b.openSession(); err != nil {
+		return err
+	}
+	return f()
+}
+
+func isSessionLost(err error) bool {
+	var p11Err pkcs11.Error
+	if !errors.As(err, &p11Err) {
+		return false
+	}
+	switch p11Err {
+	case pkcs11.CKR_SESSION_HANDLE_INVALID, pkcs11.CKR_SESSION_CLOSED, pkcs11.CKR_USER_NOT_LOGGED_IN,
+		pkcs11.CKR_DEVICE_REMOVED, pkcs11.CKR_TOKEN_NOT_PRESENT:
+		return true
+	}
+	return false
+}
+
+// classifyPkcs11Error maps PKCS#11 return values to gRPC codes.
+func classifyPkcs11Error(err error) (codes.Code, string, map[string]string, bool) {
+	var p11Err pkcs11.Error
+	if !errors.As(err, &p11Err) {
+		return 0, "", nil, false
+	}
+	metadata := map[string]string{metadataPkcs11Code: fmt.Sprintf("%#x", uint(p11Err))}
+	switch p11Err {
+	case pkcs11.CKR_KEY_HANDLE_INVALID, pkcs11.CKR_OBJECT_HANDLE_INVALID:
+		return codes.FailedPrecondition, reasonDsmKeyNotFound, metadata, true
+	case pkcs11.CKR_ENCRYPTED_DATA_INVALID, pkcs11.CKR_ENCRYPTED_DATA_LEN_RANGE:
+		return codes.InvalidArgument, reasonInvalidCiphertext, metadata, true
+	case pkcs11.CKR_PIN_INCORRECT, pkcs11.CKR_PIN_EXPIRED, pkcs11.CKR_PIN_LOCKED, pkcs11.CKR_USER_NOT_LOGGED_IN:
+		return codes.Unauthenticated, reasonDsmUnauthenticated, metadata, true
+	case pkcs11.CKR_KEY_FUNCTION_NOT_PERMITTED, pkcs11.CKR_KEY_TYPE_INCONSISTENT:
+		return codes.PermissionDenied, reasonDsmPermissionDenied, metadata, true
+	case pkcs11.CKR_SESSION_HANDLE_INVALID, pkcs11.CKR_SESSION_CLOSED, pkcs11.CKR_DEVICE_ERROR,
+		pkcs11.CKR_DEVICE_REMOVED, pkcs11.CKR_TOKEN_NOT_PRESENT:
+		return codes.Unavailable, reasonDsmUnavailable, metadata, true
+	}
+	return codes.FailedPrecondition, reasonDsmRejected, metadata, true
+}
+
+func (b *pkcs11Backend) Wrap(ctx context.Context, plain []byte) (*wrappedData, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var wrapped *wrappedData
+	err := b.withSession(func() (err error) {
+		wrapped, err = b.wrap(plain)
+		return err
+	})
+	return wrapped, err
+}
+
+func (b *pkcs11Backend) wrap(plain []byte) (*wrappedData, error) {
+	key, err := b.findKey(pkcs11.NewAttribute(pkcs11.CKA_LABEL, *b.config.KeyLabel))
+	if err != nil {
+		return nil, err
+	}
+	kid, err := b.keyID(key)
+	if err != nil {
+		return nil, err
+	}
+	iv := make([]byte, gcmIVSize)
+	if _, err := rand.Read(iv); err != nil {
+		return nil, fmt.Errorf("failed to generate IV: %v", err)
+	}
+	params := pkcs11.NewGCMParams(iv, nil, gcmTagSize*8)
+	defer params.Free()
+	mechanism := []*pkcs11.Mechanism{pkcs11.NewMechanism(pkcs11.CKM_AES_GCM, params)}
+	if err := b.ctx.EncryptInit(b.session, mechanism, key); err != nil {
+		return nil, fmt.Errorf("PKCS#11 encrypt failed: %w", err)
+	}
+	out, err := b.ctx.Encrypt(b.session, plain)
+	if err != nil {
+		return nil, fmt.Errorf("PKCS#11 encrypt failed: %w", err)
+	}
+	if len(out) < gcmTagSize {
+		return nil, newPluginError(codes.Internal, reasonInternal, nil, "PKCS#11 encrypt returned a truncated ciphertext")
+	}
+	// Some modules ignore the IV passed in and generate their own.
+	if actual := params.IV(); len(actual) > 0 {
+		iv = actual
+	}
+	split := len(out) - gcmTagSize
+	return &wrappedData{
+		KID:    kid,
+		Cipher: out[:split],
+		IV:     iv,
+		Tag:    out[split:],
+	}, nil
+}
+
+func (b *pkcs11Backend) Unwrap(ctx context.Context, data *wrappedData) ([]byte, error) {
+	if err := b.lineage.check(ctx, data.KID, b.walkLineage); err != nil {
+		return nil, err
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	id, err := parseKeyID(data.KID)
+	if err != nil {
+		return nil, err
+	}
+	var plain []byte
+	err = b.withSession(func() (err error) {
+		plain, err = b.unwrap(id, data)
+		return err
+	})
+	return plain, err
+}
+
+func (b *pkcs11Backend) unwrap(id []byte, data *wrappedData) ([]byte, error) {
+	key, err := b.findKey(pkcs11.NewAttribute(pkcs11.CKA_ID, id))
+	if err != nil {
+		return nil, err
+	}
+	params := pkcs11.NewGCMParams(data.IV, nil, len(data.Tag)*8)
+	defer params.Free()
+	mechanism := []*pkcs11.Mechanism{pkcs11.NewMechanism(pkcs11.CKM_AES_GCM, params)}
+	if err := b.ctx.DecryptInit(b.session, mechanism, key); err != nil {
+		return nil, fmt.Errorf("PKCS#11 decrypt failed: %w", err)
+	}
+	in := make([]byte, 0, len(data.Cipher)+len(data.Tag))
+	in = append(append(in, data.Cipher...), data.Tag...)
+	plain, err := b.ctx.Decrypt(b.session, in)
+	if err != nil {
+		return nil, fmt.Errorf("PKCS#11 decrypt failed: %w", err)
+	}
+	return plain, nil
+}
+
+// walkLineage visits the key `key_label` names. PKCS#11 has no notion of
+// rotation, so the lineage is just the keys the label named while the
+// plugin was running.
+func (b *pkcs11Backend) walkLineage(ctx context.Context, visit func(kid string) bool) error {
+	info, err := b.DescribeKey(ctx)
+	if err != nil {
+		return err
+	}
+	visit(info.KID)
+	return nil
+}
+
+func (b *pkcs11Backend) DescribeKey(ctx context.Context) (*KeyInfo, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var info *KeyInfo
+	err := b.withSession(func() (err error) {
+		info, err = b.describeKey()
+		return err
+	})
+	return info, err
+}
+
+func (b *pkcs11Backend) describeKey() (*KeyInfo, error) {
+	key, err := b.findKey(pkcs11.NewAttribute(pkcs11.CKA_LABEL, *b.config.KeyLabel))
+	if err != nil {
+		return nil, err
+	}
+	attrs, err := b.ctx.GetAttributeValue(b.session, key, []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_KEY_TYPE, nil),
+		pkcs11.NewAttribute(pkcs11.CKA_ID, nil),
+		pkcs11.NewAttribute(pkcs11.CKA_VALUE_LEN, nil),
+		pkcs11.NewAttribute(pkcs11.CKA_ENCRYPT, nil),
+		pkcs11.NewAttribute(pkcs11.CKA_DECRYPT, nil),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read PKCS#11 key attributes: %w", err)
+	}
+	info := &KeyInfo{Name: *b.config.KeyLabel, Enabled: true, Operations: &keyOperations{}}
+	for _, attr := range attrs {
+		switch attr.Type {
+		case pkcs11.CKA_KEY_TYPE:
+			if len(attr.Value) > 0 && attr.Value[0] == pkcs11.CKK_AES {
+				info.Type = keyTypeAes
+			} else {
+				info.Type = fmt.Sprintf("PKCS#11 key type %x", attr.Value)
+			}
+		case pkcs11.CKA_ID:
+			info.KID = formatKeyID(attr.Value)
+		case pkcs11.CKA_VALUE_LEN:
+			info.Size = int(ulong(attr.Value)) * 8
+		case pkcs11.CKA_ENCRYPT:
+			info.Operations.Encrypt = ulong(attr.Value) != 0
+		case pkcs11.CKA_DECRYPT:
+			info.Operations.Decrypt = ulong(attr.Value) != 0
+		}
+	}
+	return info, nil
+}
+
+func (b *pkcs11Backend) Health(ctx context.Context) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.withSession(func() error {
+		if _, err := b.ctx.GetSessionInfo(b.session); err != nil {
+			return fmt.Errorf("PKCS#11 session is not usable: %w", err)
+		}
+		return nil
+	})
+}
+
+// findKey returns the single secret key matching attr.
+func (b *pkcs11Backend) findKey(attr *pkcs11.Attribute) (pkcs11.ObjectHandle, error) {
+	template := []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_CLASS, pkcs11.CKO_SECRET_KEY),
+		attr,
+	}
+	if err := b.ctx.FindObjectsInit(b.session, template); err != nil {
+		return 0, fmt.Errorf("PKCS#11 key lookup failed: %w", err)
+	}
+	defer b.ctx.FindObjectsFinal(b.session)
+	handles, _, err := b.ctx.FindObjects(b.session, 2)
+	if err != nil {
+		return 0, fmt.Errorf("PKCS#11 key lookup failed: %w", err)
+	}
+	switch len(handles) {
+	case 0:
+		return 0, newPluginError(codes.FailedPrecondition, reasonDsmKeyNotFound, nil, "PKCS#11 key not found")
+	case 1:
+		return handles[0], nil
+	}
+	return 0, newPluginError(codes.FailedPrecondition, reasonDsmKeyNotFound, nil, "more than one PKCS#11 key matches")
+}
+
+func (b *pkcs11Backend) keyID(key pkcs11.ObjectHandle) (string, error) {
+	attrs, err := b.ctx.GetAttributeValue(b.session, key, []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_ID, nil),
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to read PKCS#11 key ID: %w", err)
+	}
+	if len(attrs) == 0 || len(attrs[0].Value) == 0 {
+		return "", errors.New("PKCS#11 key has no CKA_ID")
+	}
+	return formatKeyID(attrs[0].Value), nil
+}
+
+// formatKeyID turns a CKA_ID into the KID stored in wrappedData. A 16-byte
+// CKA_ID is formatted as a UUID, the form DSM key IDs take in the REST API.
+func formatKeyID(id []byte) string {
+	if len(id) != 16 {
+		return hex.EncodeToString(id)
+	}
+	h := hex.EncodeToString(id)
+	return h[0:8] + "-" + h[8:12] + "-" + h[12:16] + "-" + h[16:20] + "-" + h[20:32]
+}
+
+// parseKeyID is the inverse of formatKeyID.
+func parseKeyID(kid string) ([]byte, error) {
+	h := kid
+	if len(kid) == 36 {
+		h = kid[0:8] + kid[9:13] + kid[14:18] + kid[19:23] + kid[24:36]
+	}
+	id, err := hex.DecodeString(h)
+	if err != nil {
+		return nil, newPluginError(codes.InvalidArgument, reasonInvalidCiphertext, nil, "invalid key ID in wrapped cipher data: %v", kid)
+	}
+	return id, nil
+}
+
+// ulong decodes a CK_ULONG or CK_BBOOL attribute value, which the module
+// returns in native byte order, little-endian on the supported platforms.
+func ulong(value []byte) uint64 {
+	var v uint64
+	for i := len(value) - 1; i >= 0; i-- {
+		v = v<<8 | uint64(value[i])
+	}
+	return v
+}
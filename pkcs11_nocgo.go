@@ -0,0 +1,9 @@
+//go:build !cgo
+
+package main
+
+import "errors"
+
+func newPkcs11Backend(config pkcs11Config, allowedKeyIDs []string) (Backend, error) {
+	return nil, errors.New("the PKCS#11 backend is not available in builds without cgo")
+}
@@ -0,0 +1,226 @@
+//go:build cgo
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/miekg/pkcs11"
+	"google.golang.org/grpc/codes"
+)
+
+const (
+	softHSMPin   = "1234"
+	softHSMLabel = "Kubernetes Secret Encryption Key"
+)
+
+// softHSMModule returns the SoftHSM module to test against, skipping the
+// test unless SOFTHSM2_CONF points at a SoftHSM configuration.
+func softHSMModule(t *testing.T) string {
+	if os.Getenv("SOFTHSM2_CONF") == "" {
+		t.Skip("SOFTHSM2_CONF is not set")
+	}
+	if module := os.Getenv("SOFTHSM2_MODULE"); module != "" {
+		return module
+	}
+	return "/usr/lib/softhsm/libsofthsm2.so"
+}
+
+// initSoftHSMToken initializes a token on a free slot with an AES key
+// labelled softHSMLabel, and returns the slot.
+func initSoftHSMToken(t *testing.T, module string) uint {
+	p := pkcs11.New(module)
+	if p == nil {
+		t.Fatalf("failed to load %v", module)
+	}
+	defer p.Destroy()
+	if err := p.Initialize(); err != nil {
+		t.Fatal(err)
+	}
+	defer p.Finalize()
+
+	slots, err := p.GetSlotList(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	free := -1
+	for _, slot := range slots {
+		info, err := p.GetTokenInfo(slot)
+		if err == nil && info.Flags&pkcs11.CKF_TOKEN_INITIALIZED == 0 {
+			free = int(slot)
+			break
+		}
+	}
+	if free < 0 {
+		t.Fatal("no free SoftHSM slot")
+	}
+	suffix := make([]byte, 4)
+	rand.Read(suffix)
+	tokenLabel := fmt.Sprintf("k8s-test-%x", suffix)
+	if err := p.InitToken(uint(free), softHSMPin, tokenLabel); err != nil {
+		t.Fatal(err)
+	}
+	// SoftHSM renumbers the slot once its token is initialized.
+	slots, err = p.GetSlotList(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	slot := -1
+	for _, s := range slots {
+		info, err := p.GetTokenInfo(s)
+		if err == nil && strings.TrimSpace(info.Label) == tokenLabel {
+			slot = int(s)
+		}
+	}
+	if slot < 0 {
+		t.Fatalf("token %v not found after initialization", tokenLabel)
+	}
+
+	session, err := p.OpenSession(uint(slot), pkcs11.CKF_SERIAL_SESSION|pkcs11.CKF_RW_SESSION)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.CloseSession(session)
+	if err := p.Login(session, pkcs11.CKU_SO, softHSMPin); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.InitPIN(session, softHSMPin); err != nil {
+		t.Fatal(err)
+	}
+	p.Logout(session)
+	if err := p.Login(session, pkcs11.CKU_USER, softHSMPin); err != nil {
+		t.Fatal(err)
+	}
+	id := make([]byte, 16)
+	rand.Read(id)
+	_, err = p.GenerateKey(session, []*pkcs11.Mechanism{pkcs11.NewMechanism(pkcs11.CKM_AES_KEY_GEN, nil)}, []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_CLASS, pkcs11.CKO_SECRET_KEY),
+		pkcs11.NewAttribute(pkcs11.CKA_KEY_TYPE, pkcs11.CKK_AES),
+		pkcs11.NewAttribute(pkcs11.CKA_TOKEN, true),
+		pkcs11.NewAttribute(pkcs11.CKA_LABEL, softHSMLabel),
+		pkcs11.NewAttribute(pkcs11.CKA_ID, id),
+		pkcs11.NewAttribute(pkcs11.CKA_VALUE_LEN, 32),
+		pkcs11.NewAttribute(pkcs11.CKA_ENCRYPT, true),
+		pkcs11.NewAttribute(pkcs11.CKA_DECRYPT, true),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return uint(slot)
+}
+
+// TestPkcs11SoftHSM runs against a single backend, since a PKCS#11 module
+// can only be initialized once per process.
+func TestPkcs11SoftHSM(t *testing.T) {
+	module := softHSMModule(t)
+	slot := initSoftHSMToken(t, module)
+	pin, label := softHSMPin, softHSMLabel
+	config := pkcs11Config{ModulePath: &module, Slot: &slot, Pin: &pin, KeyLabel: &label}
+	unknown := "00000000-0000-4000-8000-000000000000"
+	backend, err := newPkcs11Backend(config, []string{unknown})
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := backend.(*pkcs11Backend)
+	ctx := context.Background()
+
+	t.Run("round trip", func(t *testing.T) {
+		wrapped, err := b.Wrap(ctx, []byte("dek"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		plain, err := b.Unwrap(ctx, wrapped)
+		if err != nil || !bytes.Equal(plain, []byte("dek")) {
+			t.Fatalf("got %q, %v", plain, err)
+		}
+		info, err := b.DescribeKey(ctx)
+		if err != nil || info.KID != wrapped.KID || info.Type != keyTypeAes || info.Size != 256 {
+			t.Fatalf("got %+v, %v", info, err)
+		}
+	})
+
+	t.Run("tampered ciphertext", func(t *testing.T) {
+		wrapped, err := b.Wrap(ctx, []byte("dek"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		wrapped.Tag[0] ^= 1
+		if _, err := b.Unwrap(ctx, wrapped); err == nil {
+			t.Fatal("tampered ciphertext was decrypted")
+		}
+	})
+
+	t.Run("unknown key", func(t *testing.T) {
+		wrapped, err := b.Wrap(ctx, []byte("dek"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		wrapped.KID = unknown
+		_, err = b.Unwrap(ctx, wrapped)
+		if code, reason, _ := classifyError(err); code != codes.FailedPrecondition || reason != reasonDsmKeyNotFound {
+			t.Fatalf("got %v, %v: %v", code, reason, err)
+		}
+	})
+
+	t.Run("key not allowed", func(t *testing.T) {
+		wrapped, err := b.Wrap(ctx, []byte("dek"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		wrapped.KID = "00000000-0000-4000-8000-000000000001"
+		_, err = b.Unwrap(ctx, wrapped)
+		if code, reason, _ := classifyError(err); code != codes.PermissionDenied || reason != reasonKeyNotAllowed {
+			t.Fatalf("got %v, %v: %v", code, reason, err)
+		}
+	})
+
+	t.Run("missing label", func(t *testing.T) {
+		missing := "no such key"
+		other := &pkcs11Backend{config: config, ctx: b.ctx}
+		other.config.KeyLabel = &missing
+		if err := other.openSession(); err != nil {
+			t.Fatal(err)
+		}
+		defer b.ctx.CloseSession(other.session)
+		_, err := other.Wrap(ctx, []byte("dek"))
+		if code, reason, _ := classifyError(err); code != codes.FailedPrecondition || reason != reasonDsmKeyNotFound {
+			t.Fatalf("got %v, %v: %v", code, reason, err)
+		}
+	})
+
+	t.Run("lost session", func(t *testing.T) {
+		if err := b.ctx.CloseSession(b.session); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := b.Wrap(ctx, []byte("dek")); err != nil {
+			t.Fatalf("Wrap did not log in again: %v", err)
+		}
+	})
+}
+
+func TestClassifyPkcs11Error(t *testing.T) {
+	tests := []struct {
+		err    error
+		code   codes.Code
+		reason string
+	}{
+		{pkcs11.Error(pkcs11.CKR_KEY_HANDLE_INVALID), codes.FailedPrecondition, reasonDsmKeyNotFound},
+		{pkcs11.Error(pkcs11.CKR_ENCRYPTED_DATA_INVALID), codes.InvalidArgument, reasonInvalidCiphertext},
+		{pkcs11.Error(pkcs11.CKR_PIN_INCORRECT), codes.Unauthenticated, reasonDsmUnauthenticated},
+		{pkcs11.Error(pkcs11.CKR_DEVICE_REMOVED), codes.Unavailable, reasonDsmUnavailable},
+		{fmt.Errorf("PKCS#11 decrypt failed: %w", pkcs11.Error(pkcs11.CKR_ENCRYPTED_DATA_INVALID)), codes.InvalidArgument, reasonInvalidCiphertext},
+		{pkcs11.Error(pkcs11.CKR_FUNCTION_FAILED), codes.FailedPrecondition, reasonDsmRejected},
+	}
+	for _, test := range tests {
+		code, reason, metadata := classifyError(test.err)
+		if code != test.code || reason != test.reason || metadata[metadataPkcs11Code] == "" {
+			t.Errorf("%v: got %v, %v, %v", test.err, code, reason, metadata)
+		}
+	}
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"github.com/fortanix/k8s-sdkms-plugin/kube"
+	"github.com/fortanix/sdkms-client-go/sdkms"
+)
+
+const (
+	defaultLeaseNamespace = "kube-system"
+	defaultLeaseName      = "k8s-sdkms-plugin-rotation"
+	// rotationLeaseDuration is how long the node that rotated keeps other
+	// nodes from rotating, long enough for all of them to see the new key.
+	rotationLeaseDuration = 10 * time.Minute
+	// minRotationCheckInterval limits how often a request to rotate early
+	// makes the rotator check the key.
+	minRotationCheckInterval = time.Minute
+)
+
+// rotationConfig makes the plugin rotate the key named by `key_name` in
+// DSM once it is older than Interval.
+type rotationConfig struct {
+	Interval *duration `json:"interval,omitempty"`
+	// The Lease used to elect the node that rotates, if `kubeconfig` is set.
+	LeaseNamespace *string `json:"lease_namespace,omitempty"`
+	LeaseName      *string `json:"lease_name,omitempty"`
+}
+
+func (c rotationConfig) validate() error {
+	if c.Interval == nil {
+		return errors.New("required field `rotation.interval` is missing")
+	}
+	if *c.Interval < duration(24*time.Hour) {
+		return errors.New("`rotation.interval` must be at least 24h")
+	}
+	return nil
+}
+
+// keyRotator rotates the key when it is due. With a Kubernetes client, the
+// node that rotates is elected through a Lease so that control plane nodes
+// checking at the same time do not all rotate.
+type keyRotator struct {
+	backend  *dsmBackend
+	interval time.Duration
+	kube     *kube.Client // nil if rotation is not coordinated
+	identity string
+
+	leaseNamespace string
+	leaseName      string
+
+	// onRotate is called with the new KID after this node rotated the key.
+	onRotate func(kid string)
+	// overLimit reports whether a key is due for rotation regardless of
+	// its age, if set.
+	overLimit func(kid string) bool
+	soon      chan struct{}
+}
+
+func newKeyRotator(config pluginConfig, backend *dsmBackend, onRotate func(kid string)) (*keyRotator, error) {
+	r := &keyRotator{
+		backend:        backend,
+		interval:       time.Duration(*config.Rotation.Interval),
+		leaseNamespace: defaultLeaseNamespace,
+		leaseName:      defaultLeaseName,
+		onRotate:       onRotate,
+		soon:           make(chan struct{}, 1),
+	}
+	if config.Rotation.LeaseNamespace != nil {
+		r.leaseNamespace = *config.Rotation.LeaseNamespace
+	}
+	if config.Rotation.LeaseName != nil {
+		r.leaseName = *config.Rotation.LeaseName
+	}
+	if config.Kubeconfig == nil {
+		log.Println("WARNING: `rotation` is enabled without `kubeconfig`, enable it on one control plane node only")
+		return r, nil
+	}
+	client, err := kube.LoadKubeconfig(*config.Kubeconfig)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load `kubeconfig`: %v", err)
+	}
+	r.kube = client
+	if r.identity, err = os.Hostname(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *keyRotator) run(checkInterval time.Duration) {
+	ticker := time.NewTicker(checkInterval)
+	var checked time.Time
+	for {
+		select {
+		case <-ticker.C:
+		case <-r.soon:
+			if time.Since(checked) < minRotationCheckInterval {
+				continue
+			}
+		}
+		checked = time.Now()
+		ctx, cancel := context.WithTimeout(context.Background(), checkInterval)
+		if err := r.rotateIfDue(ctx); err != nil {
+			log.Printf("Failed to rotate the key: %v", err)
+		}
+		cancel()
+	}
+}
+
+// rotateSoon makes the rotator check the key without waiting for the next
+// check interval.
+func (r *keyRotator) rotateSoon() {
+	select {
+	case r.soon <- struct{}{}:
+	default:
+	}
+}
+
+func (r *keyRotator) rotateIfDue(ctx context.Context) error {
+	due, err := r.due(ctx)
+	if err != nil || !due {
+		return err
+	}
+	if r.kube != nil {
+		acquired, err := r.kube.TryAcquireLease(ctx, r.leaseNamespace, r.leaseName, r.identity, rotationLeaseDuration)
+		if err != nil {
+			return fmt.Errorf("failed to acquire lease %v/%v: %v", r.leaseNamespace, r.leaseName, err)
+		}
+		if !acquired {
+			return nil
+		}
+		// Another node may have rotated just before the lease was free.
+		if due, err = r.due(ctx); err != nil || !due {
+			return err
+		}
+	}
+	kid, err := r.backend.rotate(ctx)
+	if err != nil {
+		return err
+	}
+	log.Printf("Rotated key %v, the new key is %v", *r.backend.config.KeyName, kid)
+	r.onRotate(kid)
+	return nil
+}
+
+func (r *keyRotator) due(ctx context.Context) (bool, error) {
+	key, err := r.backend.getSobject(ctx)
+	if err != nil {
+		return false, err
+	}
+	created, err := key.CreatedAt.Std()
+	if err != nil {
+		return false, fmt.Errorf("invalid key creation time: %v", err)
+	}
+	if r.overLimit != nil && key.Kid != nil && r.overLimit(*key.Kid) {
+		return true, nil
+	}
+	return time.Since(created) >= r.interval, nil
+}
+
+// rotate rekeys the key named by `key_name` and returns the new KID.
+func (b *dsmBackend) rotate(ctx context.Context) (string, error) {
+	group, err := b.rotationGroup(ctx)
+	if err != nil {
+		return "", err
+	}
+	client := b.config.makeClient()
+	var key *sdkms.Sobject
+	err = b.config.withDsmContext(ctx, func(ctx context.Context) (err error) {
+		key, err = client.RotateSobject(ctx, sdkms.SobjectRekeyRequest{
+			Dest: sdkms.SobjectRequest{Name: b.config.KeyName, GroupID: group},
+		})
+		return err
+	})
+	if err != nil {
+		return "", err
+	}
+	if key.Kid == nil {
+		return "", errors.New("DSM returned a key without kid")
+	}
+	b.lineage.add(*key.Kid)
+	b.rotated(*key.Kid)
+	if b.local != nil {
+		b.local.reset()
+	}
+	return *key.Kid, nil
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/fortanix/k8s-sdkms-plugin/dsmtest"
+	"github.com/fortanix/k8s-sdkms-plugin/kube"
+	"github.com/fortanix/k8s-sdkms-plugin/kube/kubetest"
+)
+
+func newTestDsmBackend(dsm *dsmtest.Server, configure func(*pluginConfig)) *dsmBackend {
+	endpoint, apiKey, keyName := dsm.URL, testAPIKey, "k8s"
+	config := pluginConfig{SdkmsEndpoint: &endpoint, ApiKey: &apiKey, KeyName: &keyName}
+	if configure != nil {
+		configure(&config)
+	}
+	return newDsmBackend(config)
+}
+
+// newTestRotator returns a rotator for the key "k8s" that considers every
+// key in overLimit due, and coordinates through the lease in server.
+func newTestRotator(dsm *dsmtest.Server, server *kubetest.Server, identity string, overLimit map[string]bool) (*keyRotator, *[]string) {
+	var rotated []string
+	return &keyRotator{
+		backend:        newTestDsmBackend(dsm, nil),
+		interval:       time.Hour,
+		kube:           &kube.Client{Server: server.URL},
+		identity:       identity,
+		leaseNamespace: defaultLeaseNamespace,
+		leaseName:      defaultLeaseName,
+		onRotate:       func(kid string) { rotated = append(rotated, kid) },
+		overLimit:      func(kid string) bool { return overLimit[kid] },
+		soon:           make(chan struct{}, 1),
+	}, &rotated
+}
+
+func TestRotationLease(t *testing.T) {
+	dsm := dsmtest.NewServer(testAPIKey)
+	defer dsm.Close()
+	kid := dsm.AddKey("k8s")
+	server := kubetest.NewServer()
+	defer server.Close()
+	overLimit := map[string]bool{kid: true}
+	a, rotatedA := newTestRotator(dsm, server, "a", overLimit)
+	b, rotatedB := newTestRotator(dsm, server, "b", overLimit)
+	ctx := context.Background()
+
+	if err := a.rotateIfDue(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if len(*rotatedA) != 1 {
+		t.Fatalf("a rotated %v", *rotatedA)
+	}
+	// The new key is due as well, but a holds the lease.
+	overLimit[(*rotatedA)[0]] = true
+	if err := b.rotateIfDue(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if len(*rotatedB) != 0 {
+		t.Fatalf("b rotated %v while a held the lease", *rotatedB)
+	}
+	if n := dsm.Requests("/crypto/v1/keys/rekey"); n != 1 {
+		t.Fatalf("key rotated %v times, want once", n)
+	}
+}
+
+// TestRotationDueAfterLease makes another node rotate the key while this
+// one acquires the lease, which must then find the key no longer due.
+func TestRotationDueAfterLease(t *testing.T) {
+	dsm := dsmtest.NewServer(testAPIKey)
+	defer dsm.Close()
+	kid := dsm.AddKey("k8s")
+	server := kubetest.NewServer()
+	defer server.Close()
+	r, rotated := newTestRotator(dsm, server, "a", map[string]bool{kid: true})
+	r.kube.HTTPClient = &http.Client{Transport: kubetest.HookTransport{
+		Before: func(req *http.Request) {
+			if req.Method == http.MethodPost {
+				if _, err := dsm.Rotate("k8s"); err != nil {
+					t.Error(err)
+				}
+			}
+		},
+	}}
+
+	if err := r.rotateIfDue(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if len(*rotated) != 0 {
+		t.Fatalf("rotated %v again after another node rotated", *rotated)
+	}
+	if n := dsm.Requests("/crypto/v1/keys/rekey"); n != 0 {
+		t.Fatalf("key rotated %v times through the API", n)
+	}
+}
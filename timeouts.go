@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"google.golang.org/grpc/codes"
+)
+
+const (
+	defaultDsmRequestTimeout = 2 * time.Second
+	defaultSafetyMargin      = 200 * time.Millisecond
+)
+
+type timeoutConfig struct {
+	// Upper bound for a single HTTP request to DSM.
+	DsmRequest *duration `json:"dsm_request,omitempty"`
+	// Time reserved out of the incoming gRPC deadline so that the plugin
+	// fails cleanly before the apiserver gives up on it.
+	SafetyMargin *duration `json:"safety_margin,omitempty"`
+}
+
+func (c timeoutConfig) validate() error {
+	if c.DsmRequest != nil && *c.DsmRequest <= 0 {
+		return errors.New("`timeouts.dsm_request` must be positive")
+	}
+	if c.SafetyMargin != nil && *c.SafetyMargin < 0 {
+		return errors.New("`timeouts.safety_margin` must not be negative")
+	}
+	return nil
+}
+
+func (c *timeoutConfig) dsmRequest() time.Duration {
+	if c == nil || c.DsmRequest == nil {
+		return defaultDsmRequestTimeout
+	}
+	return time.Duration(*c.DsmRequest)
+}
+
+func (c *timeoutConfig) safetyMargin() time.Duration {
+	if c == nil || c.SafetyMargin == nil {
+		return defaultSafetyMargin
+	}
+	return time.Duration(*c.SafetyMargin)
+}
+
+// dsmContext derives the context for a single DSM request from ctx. The
+// request gets at most the configured per-request timeout, and never more
+// than what is left of the incoming deadline minus the safety margin.
+func (p pluginConfig) dsmContext(ctx context.Context) (context.Context, context.CancelFunc, error) {
+	timeout := p.Timeouts.dsmRequest()
+	if deadline, ok := ctx.Deadline(); ok {
+		remaining := time.Until(deadline) - p.Timeouts.safetyMargin()
+		if remaining <= 0 {
+			return nil, nil, newPluginError(codes.DeadlineExceeded, reasonDeadlineExceeded, nil,
+				"not enough time left to call DSM before the request deadline")
+		}
+		if remaining < timeout {
+			timeout = remaining
+		}
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	return ctx, cancel, nil
+}
+
+// withDsmContext runs f with a context derived by dsmContext.
+func (p pluginConfig) withDsmContext(ctx context.Context, f func(ctx context.Context) error) error {
+	ctx, cancel, err := p.dsmContext(ctx)
+	if err != nil {
+		return err
+	}
+	defer cancel()
+	return f(ctx)
+}
@@ -0,0 +1,309 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"google.golang.org/grpc/codes"
+)
+
+const (
+	// keyUsageSaveInterval is how often changed usage records are written
+	// to `key_usage_file`.
+	keyUsageSaveInterval = time.Minute
+	// maxKeyEncrypts is the number of AES-GCM encryptions with random
+	// 96-bit IVs that NIST SP 800-38D allows under a single key.
+	maxKeyEncrypts = uint64(1) << 32
+	// defaultEncryptWarn is when the plugin starts warning by default.
+	defaultEncryptWarn = maxKeyEncrypts / 2
+)
+
+var (
+	keyDecryptsDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(metricsNamespace, "", "key_decrypts_total"),
+		"Decrypt requests served with ciphertext wrapped under the key.",
+		[]string{"kid"}, nil)
+	keyLastDecryptDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(metricsNamespace, "", "key_last_decrypt_timestamp_seconds"),
+		"Unix time of the last Decrypt request with ciphertext wrapped under the key.",
+		[]string{"kid"}, nil)
+	keyEncryptsDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(metricsNamespace, "", "key_encrypts_total"),
+		"Encrypt requests served with the key.",
+		[]string{"kid"}, nil)
+)
+
+// encryptLimitConfig sets how many Encrypt requests one key may serve
+// before the plugin warns, or rotates the key.
+type encryptLimitConfig struct {
+	Warn   *uint64 `json:"warn,omitempty"`
+	Rotate *uint64 `json:"rotate,omitempty"`
+}
+
+func (c encryptLimitConfig) validate() error {
+	if c.Warn != nil && (*c.Warn == 0 || *c.Warn >= maxKeyEncrypts) {
+		return fmt.Errorf("`encrypt_limit.warn` must be between 1 and %v", maxKeyEncrypts-1)
+	}
+	if c.Rotate != nil && (*c.Rotate == 0 || *c.Rotate >= maxKeyEncrypts) {
+		return fmt.Errorf("`encrypt_limit.rotate` must be between 1 and %v", maxKeyEncrypts-1)
+	}
+	return nil
+}
+
+// keyUsageRecord is what the plugin knows about the use of one key.
+type keyUsageRecord struct {
+	Decrypts     uint64     `json:"decrypts"`
+	FirstDecrypt *time.Time `json:"first_decrypt,omitempty"`
+	LastDecrypt  *time.Time `json:"last_decrypt,omitempty"`
+	Encrypts     uint64     `json:"encrypts"`
+	LastEncrypt  *time.Time `json:"last_encrypt,omitempty"`
+}
+
+// keyUsage records the keys the plugin decrypts with, so that operators
+// can tell when a key that was rotated out no longer protects any data,
+// and how many encryptions each key has served. Records are kept in
+// memory, and in a file if one is configured.
+type keyUsage struct {
+	path string // empty if usage is not persisted
+
+	mu    sync.Mutex
+	keys  map[string]*keyUsageRecord
+	dirty bool
+}
+
+// loadKeyUsage reads the records saved at path, if any.
+func loadKeyUsage(path string) (*keyUsage, error) {
+	u := &keyUsage{path: path, keys: make(map[string]*keyUsageRecord)}
+	if path == "" {
+		return u, nil
+	}
+	content, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return u, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(content, &u.keys); err != nil {
+		return nil, fmt.Errorf("failed to parse key usage file %v: %v", path, err)
+	}
+	return u, nil
+}
+
+func (u *keyUsage) recordDecrypt(kid string) {
+	now := time.Now().UTC()
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	r := u.recordLocked(kid)
+	r.Decrypts++
+	if r.FirstDecrypt == nil {
+		r.FirstDecrypt = &now
+	}
+	r.LastDecrypt = &now
+	u.dirty = true
+}
+
+// recordEncrypt counts an Encrypt request served with kid and returns the
+// number served so far.
+func (u *keyUsage) recordEncrypt(kid string) uint64 {
+	now := time.Now().UTC()
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	r := u.recordLocked(kid)
+	r.Encrypts++
+	r.LastEncrypt = &now
+	u.dirty = true
+	return r.Encrypts
+}
+
+// encrypts returns the number of Encrypt requests served with kid.
+func (u *keyUsage) encrypts(kid string) uint64 {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if r, ok := u.keys[kid]; ok {
+		return r.Encrypts
+	}
+	return 0
+}
+
+func (u *keyUsage) recordLocked(kid string) *keyUsageRecord {
+	r, ok := u.keys[kid]
+	if !ok {
+		r = &keyUsageRecord{}
+		u.keys[kid] = r
+	}
+	return r
+}
+
+// snapshot returns a copy of the records.
+func (u *keyUsage) snapshot() map[string]keyUsageRecord {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	keys := make(map[string]keyUsageRecord, len(u.keys))
+	for kid, r := range u.keys {
+		keys[kid] = *r
+	}
+	return keys
+}
+
+// run saves the records periodically.
+func (u *keyUsage) run() {
+	for range time.Tick(keyUsageSaveInterval) {
+		if err := u.save(); err != nil {
+			log.Printf("Failed to save key usage: %v", err)
+		}
+	}
+}
+
+// save writes the records to the file if they changed since the last save.
+// The file is replaced atomically so that a crash leaves the old records.
+func (u *keyUsage) save() error {
+	if u.path == "" {
+		return nil
+	}
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if !u.dirty {
+		return nil
+	}
+	content, err := json.MarshalIndent(u.keys, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(u.path), filepath.Base(u.path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	_, err = tmp.Write(content)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), u.path); err != nil {
+		return err
+	}
+	u.dirty = false
+	return nil
+}
+
+func (u *keyUsage) Describe(ch chan<- *prometheus.Desc) {
+	ch <- keyDecryptsDesc
+	ch <- keyLastDecryptDesc
+	ch <- keyEncryptsDesc
+}
+
+func (u *keyUsage) Collect(ch chan<- prometheus.Metric) {
+	for kid, r := range u.snapshot() {
+		ch <- prometheus.MustNewConstMetric(keyDecryptsDesc, prometheus.CounterValue, float64(r.Decrypts), kid)
+		ch <- prometheus.MustNewConstMetric(keyEncryptsDesc, prometheus.CounterValue, float64(r.Encrypts), kid)
+		if r.LastDecrypt != nil {
+			ch <- prometheus.MustNewConstMetric(keyLastDecryptDesc, prometheus.GaugeValue, float64(r.LastDecrypt.Unix()), kid)
+		}
+	}
+}
+
+// keyUsageEntry is one key in the response of the admin endpoint.
+type keyUsageEntry struct {
+	KID string `json:"kid"`
+	keyUsageRecord
+}
+
+// ServeHTTP lists the records by KID as JSON.
+func (u *keyUsage) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	entries := []keyUsageEntry{}
+	for kid, record := range u.snapshot() {
+		entries = append(entries, keyUsageEntry{KID: kid, keyUsageRecord: record})
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].KID < entries[j].KID })
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(entries)
+}
+
+// encryptLimits enforces the number of Encrypt requests a key may serve.
+// Counts are per plugin instance, so with several control plane nodes the
+// key has served up to that many times more.
+type encryptLimits struct {
+	usage  *keyUsage
+	warn   uint64
+	rotate uint64 // 0 if the key is not rotated on usage
+
+	mu     sync.Mutex
+	warned map[string]bool
+	// rotateNow asks the rotator to check the key.
+	rotateNow func()
+}
+
+func newEncryptLimits(config pluginConfig, usage *keyUsage) *encryptLimits {
+	l := &encryptLimits{usage: usage, warn: defaultEncryptWarn, warned: make(map[string]bool)}
+	if c := config.EncryptLimit; c != nil {
+		if c.Warn != nil {
+			l.warn = *c.Warn
+		}
+		if c.Rotate != nil {
+			l.rotate = *c.Rotate
+		}
+	}
+	return l
+}
+
+// record counts an encryption with kid, and warns or asks for rotation
+// when a threshold is crossed. It fails once kid has served more than the
+// maximum number of encryptions, and the caller must then discard what it
+// wrapped: only then is the KID known for sure, since with `key_name` the
+// backend picks the key on every request.
+func (l *encryptLimits) record(kid string) error {
+	n := l.usage.recordEncrypt(kid)
+	if n >= l.warn {
+		l.mu.Lock()
+		first := !l.warned[kid]
+		l.warned[kid] = true
+		l.mu.Unlock()
+		if first {
+			log.Printf("WARNING: %v, rotate it", l.describe(kid, n))
+		}
+	}
+	if l.rotate != 0 && n >= l.rotate && l.rotateNow != nil {
+		l.rotateNow()
+	}
+	if n > maxKeyEncrypts {
+		return newPluginError(codes.FailedPrecondition, reasonKeyUsageLimit, nil,
+			"key %v has served %v encryptions, the AES-GCM limit, rotate it", kid, maxKeyEncrypts)
+	}
+	return nil
+}
+
+// overRotate reports whether kid has served enough encryptions to be
+// rotated.
+func (l *encryptLimits) overRotate(kid string) bool {
+	return l.rotate != 0 && l.usage.encrypts(kid) >= l.rotate
+}
+
+// warning returns a note if kid is past the warning threshold.
+func (l *encryptLimits) warning(kid string) string {
+	if n := l.usage.encrypts(kid); n >= l.warn {
+		return l.describe(kid, n)
+	}
+	return ""
+}
+
+func (l *encryptLimits) describe(kid string, n uint64) string {
+	return fmt.Sprintf("key %v has served %v of at most %v encryptions", kid, n, maxKeyEncrypts)
+}